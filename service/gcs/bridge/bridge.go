@@ -146,6 +146,18 @@ func (b *bridge) loop() error {
 			if err != nil {
 				b.outputError(err)
 			}
+		case prot.ComputeSystemCheckpointV1:
+			utils.LogMsg("received from HCS: ComputeSystemCheckpointV1")
+			response, err = b.checkpointContainer(message)
+			if err != nil {
+				b.outputError(err)
+			}
+		case prot.ComputeSystemRestoreV1:
+			utils.LogMsg("received from HCS: ComputeSystemRestoreV1")
+			response, err = b.restoreContainer(message)
+			if err != nil {
+				b.outputError(err)
+			}
 		default:
 			// TODO: Should a response be returned in this case?
 			b.outputError(errors.Errorf("received invalid header type code from HCS: 0x%x", header.Type))
@@ -207,6 +219,14 @@ func (b *bridge) createContainer(message []byte) (*prot.ContainerCreateResponse,
 	if err := b.coreint.RegisterContainerExitHook(id, exitHook); err != nil {
 		return response, err
 	}
+	eventHook := func(notification prot.ContainerNotification) {
+		if err := b.sendContainerNotification(id, response.ActivityID, notification); err != nil {
+			b.outputError(err)
+		}
+	}
+	if err := b.coreint.RegisterContainerEventHook(id, eventHook); err != nil {
+		return response, err
+	}
 
 	response.SelectedProtocolVersion = prot.PvV3
 	return response, nil
@@ -244,27 +264,28 @@ func (b *bridge) execProcess(message []byte) (*prot.ContainerExecuteProcessRespo
 		Out: conns.Out,
 		Err: conns.Err,
 	}
-	pid, err := b.coreint.ExecProcess(id, params, stdioSet)
+	pid, startTime, err := b.coreint.ExecProcess(id, params, stdioSet)
 	if err != nil {
 		return response, err
 	}
 
 	// Close Connections on exit, but only for container processes without a
-	// terminal.
-	// TODO: Continue working on this so container processes without a terminal
-	// properly write everything to stdio as well.
+	// terminal. Exit hooks only run once the process's stdout and stderr have
+	// been drained to their Connections, or the drain has timed out, so none
+	// of its output is cut off.
 	if !params.EmulateConsole {
 		exitHook := func(state oslayer.ProcessExitState) {
 			if err := conns.Close(); err != nil {
 				b.outputError(errors.Wrap(err, "failed to close Connections"))
 			}
 		}
-		if err := b.coreint.RegisterProcessExitHook(pid, exitHook); err != nil {
+		if err := b.coreint.RegisterProcessExitHook(pid, startTime, exitHook); err != nil {
 			return response, err
 		}
 	}
 
 	response.ProcessID = uint32(pid)
+	response.ProcessStartTime = startTime
 	return response, nil
 }
 
@@ -306,7 +327,7 @@ func (b *bridge) terminateProcess(message []byte) (*prot.MessageResponseBase, er
 	}
 	response.ActivityID = request.ActivityID
 
-	if err := b.coreint.TerminateProcess(int(request.ProcessID)); err != nil {
+	if err := b.coreint.TerminateProcess(int(request.ProcessID), request.ProcessStartTime); err != nil {
 		return response, err
 	}
 
@@ -322,19 +343,61 @@ func (b *bridge) listProcesses(message []byte) (*prot.ContainerGetPropertiesResp
 	response.ActivityID = request.ActivityID
 	id := request.ContainerID
 
-	processes, err := b.coreint.ListProcesses(id)
-	if err != nil {
-		return response, err
+	var query prot.PropertyQuery
+	if request.Query != "" {
+		if err := json.Unmarshal([]byte(request.Query), &query); err != nil {
+			return response, errors.Wrapf(err, "failed to unmarshal JSON for property query \"%s\"", request.Query)
+		}
+	}
+	// A query for nothing but the container's processes is answered with the
+	// bare process list, as it was before other properties could be queried.
+	if len(query.PropertyTypes) == 0 || (len(query.PropertyTypes) == 1 && query.PropertyTypes[0] == prot.PtProcessList) {
+		processes, err := b.coreint.ListProcesses(id)
+		if err != nil {
+			return response, err
+		}
+
+		processJSON, err := json.Marshal(processes)
+		if err != nil {
+			return response, errors.Wrapf(err, "failed to marshal processes into JSON: %v", processes)
+		}
+		response.Properties = string(processJSON)
+		return response, nil
 	}
 
-	processJSON, err := json.Marshal(processes)
+	properties := make(map[prot.PropertyType]interface{})
+	for _, propertyType := range query.PropertyTypes {
+		property, err := b.getProperty(id, propertyType)
+		if err != nil {
+			return response, err
+		}
+		properties[propertyType] = property
+	}
+	propertiesJSON, err := json.Marshal(properties)
 	if err != nil {
-		return response, errors.Wrapf(err, "failed to marshal processes into JSON: %v", processes)
+		return response, errors.Wrapf(err, "failed to marshal properties into JSON: %v", properties)
 	}
-	response.Properties = string(processJSON)
+	response.Properties = string(propertiesJSON)
 	return response, nil
 }
 
+// getProperty returns the property of the given type for a ContainerGetProperties
+// request on the container with the given ID.
+func (b *bridge) getProperty(id string, propertyType prot.PropertyType) (interface{}, error) {
+	switch propertyType {
+	case prot.PtProcessList:
+		return b.coreint.ListProcesses(id)
+	case prot.PtExternalProcessList:
+		return b.coreint.ListExternalProcesses()
+	case prot.PtVMProcessList:
+		return b.coreint.ListVMProcesses()
+	case prot.PtVMResources:
+		return b.coreint.GetVMResources()
+	default:
+		return nil, errors.Errorf("property type \"%s\" is not supported", propertyType)
+	}
+}
+
 func (b *bridge) runExternalProcess(message []byte) (*prot.ContainerExecuteProcessResponse, error) {
 	response := &prot.ContainerExecuteProcessResponse{MessageResponseBase: newResponseBase()}
 	var request prot.ContainerExecuteProcess
@@ -359,12 +422,13 @@ func (b *bridge) runExternalProcess(message []byte) (*prot.ContainerExecuteProce
 		Out: conns.Out,
 		Err: conns.Err,
 	}
-	pid, err := b.coreint.RunExternalProcess(params, stdioSet)
+	pid, startTime, err := b.coreint.RunExternalProcess(params, stdioSet)
 	if err != nil {
 		return response, err
 	}
 
 	response.ProcessID = uint32(pid)
+	response.ProcessStartTime = startTime
 	return response, nil
 }
 
@@ -382,7 +446,7 @@ func (b *bridge) waitOnProcess(message []byte, header *prot.MessageHeader) (*pro
 			b.outputError(errors.Wrapf(err, "failed to send process exit response \"%v\"", response))
 		}
 	}
-	if err := b.coreint.RegisterProcessExitHook(int(request.ProcessID), exitHook); err != nil {
+	if err := b.coreint.RegisterProcessExitHook(int(request.ProcessID), request.ProcessStartTime, exitHook); err != nil {
 		return response, err
 	}
 
@@ -419,6 +483,69 @@ func (b *bridge) modifySettings(message []byte) (*prot.MessageResponseBase, erro
 	return response, nil
 }
 
+func (b *bridge) checkpointContainer(message []byte) (*prot.MessageResponseBase, error) {
+	response := newResponseBase()
+	var request prot.ContainerCheckpoint
+	if err := json.Unmarshal(message, &request); err != nil {
+		return response, errors.Wrapf(err, "failed to unmarshal JSON for message \"%s\"", message)
+	}
+	response.ActivityID = request.ActivityID
+
+	if err := b.coreint.CheckpointContainer(request.ContainerID, request.ImagePath, request.Options); err != nil {
+		return response, err
+	}
+
+	return response, nil
+}
+
+func (b *bridge) restoreContainer(message []byte) (*prot.ContainerExecuteProcessResponse, error) {
+	response := &prot.ContainerExecuteProcessResponse{MessageResponseBase: newResponseBase()}
+	var request prot.ContainerRestore
+	if err := json.Unmarshal(message, &request); err != nil {
+		return response, errors.Wrapf(err, "failed to unmarshal JSON for message \"%s\"", message)
+	}
+	response.ActivityID = request.ActivityID
+	id := request.ContainerID
+
+	// The request contains a JSON string field which is equivalent to an
+	// ExecuteProcessInfo struct, describing the restored init process.
+	var params prot.ProcessParameters
+	if err := json.Unmarshal([]byte(request.Settings.ProcessParameters), &params); err != nil {
+		return response, errors.Wrapf(err, "failed to unmarshal JSON for ProcessParameters \"%s\"", request.Settings.ProcessParameters)
+	}
+
+	conns, err := createAndConnectStdio(b.tport, params, request.Settings.VsockStdioRelaySettings)
+	if err != nil {
+		return response, err
+	}
+	stdioSet := &core.StdioSet{
+		In:  conns.In,
+		Out: conns.Out,
+		Err: conns.Err,
+	}
+	pid, startTime, err := b.coreint.RestoreContainer(id, request.ImagePath, params, stdioSet)
+	if err != nil {
+		return response, err
+	}
+
+	// Close Connections on exit, as for processes executed without a
+	// terminal.
+	if !params.EmulateConsole {
+		exitHook := func(state oslayer.ProcessExitState) {
+			if err := conns.Close(); err != nil {
+				b.outputError(errors.Wrap(err, "failed to close Connections"))
+			}
+		}
+		if err := b.coreint.RegisterProcessExitHook(pid, startTime, exitHook); err != nil {
+			return response, err
+		}
+	}
+
+	response.ProcessID = uint32(pid)
+	response.ProcessStartTime = startTime
+	return response, nil
+}
+
 // newResponseBase returns a MessageResponseBase with a default value.
 func newResponseBase() *prot.MessageResponseBase {
 	response := &prot.MessageResponseBase{
@@ -484,18 +611,29 @@ func (b *bridge) sendResponse(response interface{}, header *prot.MessageHeader)
 
 // sendExitNotification sends a notification to the HCS when the container with
 // ID=id exits. An oslayer.ProcessExitState parameter is given with the exit
-// state of the process.
+// state of the process. The notification tells the signal which terminated the
+// container, and whether it was killed by the OOM killer.
 func (b *bridge) sendExitNotification(id string, activityID string, state oslayer.ProcessExitState) error {
-	result := state.ExitCode()
 	notification := prot.ContainerNotification{
-		MessageBase: &prot.MessageBase{
-			ContainerID: id,
-			ActivityID:  activityID,
-		},
-		Type:       prot.NtUnexpectedExit, // TODO: Support different exit types.
-		Operation:  prot.AoNone,
-		Result:     int32(result),
-		ResultInfo: "",
+		Type:      prot.NtUnexpectedExit, // TODO: Support different exit types.
+		Operation: prot.AoNone,
+		Result:    int32(state.ExitCode()),
+		Signal:    int32(state.Signal()),
+	}
+	if containerState, ok := state.(core.ContainerExitState); ok && containerState.OOMKilled() {
+		notification.ResultInfo = "the container was killed by the OOM killer"
+	} else if notification.Signal != 0 {
+		notification.ResultInfo = fmt.Sprintf("the container was terminated by signal %d", notification.Signal)
+	}
+	return b.sendContainerNotification(id, activityID, notification)
+}
+
+// sendContainerNotification sends the given notification about the container
+// with ID=id to the HCS.
+func (b *bridge) sendContainerNotification(id string, activityID string, notification prot.ContainerNotification) error {
+	notification.MessageBase = &prot.MessageBase{
+		ContainerID: id,
+		ActivityID:  activityID,
 	}
 	notificationBytes, err := json.Marshal(notification)
 	if err != nil {
@@ -190,6 +190,89 @@ var _ = Describe("Bridge", func() {
 					Expect(notification.Operation).To(Equal(prot.AoNone))
 					Expect(notification.Result).To(Equal(int32(102)))
 					Expect(notification.ResultInfo).To(BeEmpty())
+					Expect(notification.Signal).To(BeZero())
+				})
+			})
+			Describe("sending the exit notification of a container killed by a signal", func() {
+				var notification prot.ContainerNotification
+				JustBeforeEach(func(done Done) {
+					defer close(done)
+
+					registerCallArgs := coreint.LastRegisterContainerExitHook
+					go func() {
+						defer GinkgoRecover()
+						registerCallArgs.ExitHook(mockos.NewSignaledProcessExitState(9))
+					}()
+					notificationString, _, err := serverReadString(commandConn)
+					Expect(err).NotTo(HaveOccurred())
+					err = json.Unmarshal([]byte(notificationString), &notification)
+					Expect(err).NotTo(HaveOccurred())
+				}, testTimeout)
+				It("should respond with the signal", func() {
+					Expect(notification.Type).To(Equal(prot.NtUnexpectedExit))
+					Expect(notification.Result).To(Equal(int32(-1)))
+					Expect(notification.Signal).To(Equal(int32(9)))
+					Expect(notification.ResultInfo).To(ContainSubstring("signal 9"))
+				})
+			})
+			Describe("sending the exit notification of a container killed by the OOM killer", func() {
+				var notification prot.ContainerNotification
+				JustBeforeEach(func(done Done) {
+					defer close(done)
+
+					registerCallArgs := coreint.LastRegisterContainerExitHook
+					go func() {
+						defer GinkgoRecover()
+						registerCallArgs.ExitHook(oomKilledExitState{mockos.NewSignaledProcessExitState(9)})
+					}()
+					notificationString, _, err := serverReadString(commandConn)
+					Expect(err).NotTo(HaveOccurred())
+					err = json.Unmarshal([]byte(notificationString), &notification)
+					Expect(err).NotTo(HaveOccurred())
+				}, testTimeout)
+				It("should respond with the OOM kill", func() {
+					Expect(notification.Signal).To(Equal(int32(9)))
+					Expect(notification.ResultInfo).To(ContainSubstring("OOM killer"))
+				})
+			})
+			Describe("sending an event notification", func() {
+				var (
+					notification     prot.ContainerNotification
+					registerCallArgs mockcore.RegisterContainerEventHookCall
+				)
+				JustBeforeEach(func(done Done) {
+					defer close(done)
+
+					registerCallArgs = coreint.LastRegisterContainerEventHook
+					go func() {
+						defer GinkgoRecover()
+						registerCallArgs.EventHook(prot.ContainerNotification{
+							Type:      prot.NtStatistics,
+							Operation: prot.AoNone,
+							Statistics: &prot.ContainerStatistics{
+								CPUUsage:     1000,
+								MemoryUsage:  2048,
+								ProcessCount: 3,
+							},
+						})
+					}()
+					notificationString, _, err := serverReadString(commandConn)
+					Expect(err).NotTo(HaveOccurred())
+					err = json.Unmarshal([]byte(notificationString), &notification)
+					Expect(err).NotTo(HaveOccurred())
+				}, testTimeout)
+				It("should have registered the hook on the container", func() {
+					Expect(registerCallArgs.ID).To(Equal(containerID))
+				})
+				It("should respond with the correct values", func() {
+					Expect(notification.ContainerID).To(Equal(containerID))
+					Expect(notification.ActivityID).To(Equal(activityID))
+					Expect(notification.Type).To(Equal(prot.NtStatistics))
+					Expect(notification.Statistics).To(Equal(&prot.ContainerStatistics{
+						CPUUsage:     1000,
+						MemoryUsage:  2048,
+						ProcessCount: 3,
+					}))
 				})
 			})
 		})
@@ -298,6 +381,7 @@ var _ = Describe("Bridge", func() {
 				AssertActivityIDCorrect()
 				It("should respond with the correct values", func() {
 					Expect(response.ProcessID).To(Equal(uint32(101)))
+					Expect(response.ProcessStartTime).To(Equal(uint64(1001)))
 				})
 				It("should have received the correct values", func() {
 					Expect(callArgs.ID).To(Equal(containerID))
@@ -372,6 +456,7 @@ var _ = Describe("Bridge", func() {
 				AssertActivityIDCorrect()
 				It("should respond with the correct values", func() {
 					Expect(response.ProcessID).To(Equal(uint32(101)))
+					Expect(response.ProcessStartTime).To(Equal(uint64(1001)))
 				})
 				It("should have received the correct values", func() {
 					Expect(callArgs.Params).To(Equal(params))
@@ -382,6 +467,97 @@ var _ = Describe("Bridge", func() {
 		}
 	})
 
+	Describe("calling checkpointContainer", func() {
+		var (
+			response prot.MessageResponseBase
+			callArgs mockcore.CheckpointContainerCall
+			options  prot.CheckpointOptions
+		)
+		BeforeEach(func() {
+			messageType = prot.ComputeSystemCheckpointV1
+		})
+		JustBeforeEach(func() {
+			err := json.Unmarshal([]byte(responseString), &response)
+			Expect(err).NotTo(HaveOccurred())
+			responseBase = &response
+			callArgs = coreint.LastCheckpointContainer
+		})
+		Context("the message is normal ASCII", func() {
+			BeforeEach(func() {
+				options = prot.CheckpointOptions{LeaveRunning: true, TCPEstablished: true}
+				message = prot.ContainerCheckpoint{
+					MessageBase: &prot.MessageBase{
+						ContainerID: containerID,
+						ActivityID:  activityID,
+					},
+					ImagePath: "/path/inside/container/checkpoint",
+					Options:   options,
+				}
+			})
+			AssertNoResponseErrors()
+			AssertActivityIDCorrect()
+			It("should have received the correct values", func() {
+				Expect(callArgs.ID).To(Equal(containerID))
+				Expect(callArgs.ImagePath).To(Equal("/path/inside/container/checkpoint"))
+				Expect(callArgs.Options).To(Equal(options))
+			})
+		})
+	})
+
+	Describe("calling restoreContainer", func() {
+		var (
+			response prot.ContainerExecuteProcessResponse
+			callArgs mockcore.RestoreContainerCall
+			params   prot.ProcessParameters
+		)
+		BeforeEach(func() {
+			messageType = prot.ComputeSystemRestoreV1
+		})
+		JustBeforeEach(func() {
+			err := json.Unmarshal([]byte(responseString), &response)
+			Expect(err).NotTo(HaveOccurred())
+			responseBase = response.MessageResponseBase
+			callArgs = coreint.LastRestoreContainer
+		})
+		Context("the message is normal ASCII", func() {
+			BeforeEach(func() {
+				params = prot.ProcessParameters{
+					CreateStdInPipe:  true,
+					CreateStdOutPipe: true,
+					OCISpecification: oci.Spec{
+						Version: "1.0.0-rc5-dev",
+						Process: oci.Process{Args: []string{"sh", "-c", "testexe"}, Cwd: "/"},
+						Root:    oci.Root{Path: "rootfs"},
+					},
+				}
+				paramsBytes, err := json.Marshal(params)
+				Expect(err).NotTo(HaveOccurred())
+				message = prot.ContainerRestore{
+					MessageBase: &prot.MessageBase{
+						ContainerID: containerID,
+						ActivityID:  activityID,
+					},
+					ImagePath: "/path/inside/container/checkpoint",
+					Settings: prot.ExecuteProcessSettings{
+						ProcessParameters:       string(paramsBytes),
+						VsockStdioRelaySettings: prot.ExecuteProcessVsockStdioRelaySettings{StdIn: 1, StdOut: 2},
+					},
+				}
+			})
+			AssertNoResponseErrors()
+			AssertActivityIDCorrect()
+			It("should respond with the correct values", func() {
+				Expect(response.ProcessID).To(Equal(uint32(101)))
+				Expect(response.ProcessStartTime).To(Equal(uint64(1001)))
+			})
+			It("should have received the correct values", func() {
+				Expect(callArgs.ID).To(Equal(containerID))
+				Expect(callArgs.ImagePath).To(Equal("/path/inside/container/checkpoint"))
+				Expect(callArgs.Params).To(Equal(params))
+			})
+		})
+	})
+
 	Describe("calling killContainer", func() {
 		var (
 			response prot.MessageResponseBase
@@ -463,13 +639,30 @@ var _ = Describe("Bridge", func() {
 						ContainerID: containerID,
 						ActivityID:  activityID,
 					},
-					ProcessID: processID,
+					ProcessID:        processID,
+					ProcessStartTime: 1001,
 				}
 			})
 			AssertNoResponseErrors()
 			AssertActivityIDCorrect()
 			It("should receive the correct values", func() {
 				Expect(callArgs.Pid).To(Equal(int(processID)))
+				Expect(callArgs.StartTime).To(Equal(uint64(1001)))
+			})
+		})
+		Context("the message is from a host which doesn't send the process start time", func() {
+			BeforeEach(func() {
+				message = map[string]interface{}{
+					"ContainerId": containerID,
+					"ActivityId":  activityID,
+					"ProcessId":   processID,
+				}
+			})
+			AssertNoResponseErrors()
+			AssertActivityIDCorrect()
+			It("should identify the process by its pid alone", func() {
+				Expect(callArgs.Pid).To(Equal(int(processID)))
+				Expect(callArgs.StartTime).To(BeZero())
 			})
 		})
 	})
@@ -515,6 +708,89 @@ var _ = Describe("Bridge", func() {
 				Expect(callArgs.ID).To(Equal(containerID))
 			})
 		})
+		Context("the query is for the process list only", func() {
+			BeforeEach(func() {
+				message = prot.ContainerGetProperties{
+					MessageBase: &prot.MessageBase{
+						ContainerID: containerID,
+						ActivityID:  activityID,
+					},
+					Query: `{"PropertyTypes":["ProcessList"]}`,
+				}
+			})
+			AssertNoResponseErrors()
+			AssertActivityIDCorrect()
+			It("should respond with the process list", func() {
+				var states []runtime.ContainerProcessState
+				err := json.Unmarshal([]byte(response.Properties), &states)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(states).To(HaveLen(1))
+				Expect(states[0].Pid).To(Equal(101))
+			})
+		})
+		Context("the query is for the utility VM's properties", func() {
+			BeforeEach(func() {
+				message = prot.ContainerGetProperties{
+					MessageBase: &prot.MessageBase{
+						ContainerID: containerID,
+						ActivityID:  activityID,
+					},
+					Query: `{"PropertyTypes":["ProcessList","ExternalProcessList","VmProcessList","VmResources"]}`,
+				}
+			})
+			AssertNoResponseErrors()
+			AssertActivityIDCorrect()
+			It("should respond with each property", func() {
+				var properties struct {
+					ProcessList         []runtime.ContainerProcessState
+					ExternalProcessList []prot.ExternalProcess
+					VMProcessList       []runtime.ContainerProcessState `json:"VmProcessList"`
+					VMResources         prot.VMResources                `json:"VmResources"`
+				}
+				err := json.Unmarshal([]byte(response.Properties), &properties)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(properties.ProcessList).To(HaveLen(1))
+				Expect(properties.ProcessList[0].Pid).To(Equal(101))
+				Expect(properties.ExternalProcessList).To(Equal([]prot.ExternalProcess{
+					prot.ExternalProcess{
+						ProcessID: 101,
+						Command:   []string{"sh", "-c", "testexe"},
+						Status:    prot.EpsRunning,
+					},
+				}))
+				Expect(properties.VMProcessList).To(HaveLen(1))
+				Expect(properties.VMProcessList[0].Command).To(Equal([]string{"init"}))
+				Expect(properties.VMResources.CPUCount).To(Equal(2))
+				Expect(properties.VMResources.ProcessCount).To(Equal(10))
+			})
+			It("should have received the correct values", func() {
+				Expect(callArgs.ID).To(Equal(containerID))
+			})
+		})
+		Context("the query is for an unsupported property", func() {
+			BeforeEach(func() {
+				message = prot.ContainerGetProperties{
+					MessageBase: &prot.MessageBase{
+						ContainerID: containerID,
+						ActivityID:  activityID,
+					},
+					Query: `{"PropertyTypes":["Memory"]}`,
+				}
+			})
+			AssertResponseErrors("property type \"Memory\" is not supported")
+		})
+		Context("the query is not valid JSON", func() {
+			BeforeEach(func() {
+				message = prot.ContainerGetProperties{
+					MessageBase: &prot.MessageBase{
+						ContainerID: containerID,
+						ActivityID:  activityID,
+					},
+					Query: "{",
+				}
+			})
+			AssertResponseErrors("failed to unmarshal JSON for property query")
+		})
 	})
 
 	Describe("calling waitOnProcess", func() {
@@ -538,8 +814,9 @@ var _ = Describe("Bridge", func() {
 						ContainerID: containerID,
 						ActivityID:  activityID,
 					},
-					ProcessID:   101,
-					TimeoutInMs: 1000,
+					ProcessID:        101,
+					ProcessStartTime: 1001,
+					TimeoutInMs:      1000,
 				}
 			})
 			AssertNoResponseErrors()
@@ -549,6 +826,24 @@ var _ = Describe("Bridge", func() {
 			})
 			It("should have received the correct values", func() {
 				Expect(callArgs.Pid).To(Equal(101))
+				Expect(callArgs.StartTime).To(Equal(uint64(1001)))
+			})
+		})
+		Context("the message is from a host which doesn't send the process start time", func() {
+			BeforeEach(func() {
+				message = map[string]interface{}{
+					"ContainerId": containerID,
+					"ActivityId":  activityID,
+					"ProcessId":   101,
+					"TimeoutInMs": 1000,
+				}
+			})
+			AssertNoResponseErrors()
+			AssertActivityIDCorrect()
+			It("should identify the process by its pid alone", func() {
+				Expect(response.ExitCode).To(Equal(uint32(103)))
+				Expect(callArgs.Pid).To(Equal(101))
+				Expect(callArgs.StartTime).To(BeZero())
 			})
 		})
 	})
@@ -770,3 +1065,13 @@ func serverReadBytes(conn transport.Connection, n int) ([]byte, error) {
 	}
 	return returnBytes, nil
 }
+
+// oomKilledExitState is the exit state of a container killed by the OOM
+// killer, as given to container exit hooks by the core.
+type oomKilledExitState struct {
+	oslayer.ProcessExitState
+}
+
+func (oomKilledExitState) OOMKilled() bool {
+	return true
+}
@@ -25,33 +25,61 @@ type StdioSet struct {
 	Err StdioPipe
 }
 
+// ContainerExitState is the exit state given to the exit hooks registered on a
+// container, which tells whether the container was killed by the OOM killer on
+// top of the exit state of its init process.
+type ContainerExitState interface {
+	oslayer.ProcessExitState
+	OOMKilled() bool
+}
+
 // Core is the interface defining the core functionality of the GCS-like
 // program. For a real implementation, this may include creating and configuring
 // containers. However, it is also easily mocked out for testing.
+// A process is identified by its pid together with the start time returned
+// when it was started, so that a request for a process which has exited isn't
+// applied to a later process reusing its pid.
 type Core interface {
 	CreateContainer(id string,
 		info prot.VMHostedContainerSettings) error
 
 	ExecProcess(id string,
 		info prot.ProcessParameters,
-		stdioSet *StdioSet) (pid int, err error)
+		stdioSet *StdioSet) (pid int, startTime uint64, err error)
 
 	SignalContainer(id string, signal oslayer.Signal) error
 
-	TerminateProcess(pid int) error
+	TerminateProcess(pid int, startTime uint64) error
 
 	ListProcesses(id string) ([]runtime.ContainerProcessState, error)
+	ListExternalProcesses() ([]prot.ExternalProcess, error)
+	ListVMProcesses() ([]runtime.ContainerProcessState, error)
+	GetVMResources() (*prot.VMResources, error)
 
 	RunExternalProcess(info prot.ProcessParameters,
-		stdioSet *StdioSet) (pid int, err error)
+		stdioSet *StdioSet) (pid int, startTime uint64, err error)
 
 	ModifySettings(id string,
 		request prot.ResourceModificationRequestResponse) error
 
+	CheckpointContainer(id string,
+		imagePath string,
+		options prot.CheckpointOptions) error
+	RestoreContainer(id string,
+		imagePath string,
+		info prot.ProcessParameters,
+		stdioSet *StdioSet) (pid int, startTime uint64, err error)
+
 	RegisterContainerExitHook(id string,
 		onExit func(oslayer.ProcessExitState)) error
 	RegisterProcessExitHook(pid int,
+		startTime uint64,
 		onExit func(oslayer.ProcessExitState)) error
+	// RegisterContainerEventHook registers a hook which is called with a
+	// notification for each OOM event of the container and each sample of
+	// its resource usage, until it exits.
+	RegisterContainerEventHook(id string,
+		onEvent func(prot.ContainerNotification)) error
 
 	CleanupContainer(id string) error
 }
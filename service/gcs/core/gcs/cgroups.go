@@ -0,0 +1,273 @@
+package gcs
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+)
+
+const (
+	// cgroupRoot is where the cgroup hierarchies are mounted.
+	cgroupRoot = "/sys/fs/cgroup"
+	// cgroupParent is the cgroup under which the cgroup of each container is
+	// created, in every hierarchy.
+	cgroupParent = "/gcs"
+	// unlimitedCgroupV1Memory is the smallest memory limit of a v1 cgroup
+	// considered to be unlimited.
+	unlimitedCgroupV1Memory = 1 << 62
+)
+
+// cgroupVersion is the version of the cgroup hierarchy used by the utility VM.
+type cgroupVersion int
+
+const (
+	// cgroupV1 has a hierarchy per controller, mounted under cgroupRoot.
+	cgroupV1 = cgroupVersion(1)
+	// cgroupV2 has a single unified hierarchy mounted on cgroupRoot.
+	cgroupV2 = cgroupVersion(2)
+)
+
+// cgroupStats is a sample of the resource usage and limits of a container,
+// read from its cgroup. Limits are 0 when unlimited.
+type cgroupStats struct {
+	// CPUUsage is the total CPU time consumed, in nanoseconds.
+	CPUUsage uint64
+	// MemoryUsage, MemoryMaxUsage and MemoryLimit are in bytes.
+	// MemoryMaxUsage is 0 on kernels which don't track the peak usage of a
+	// unified hierarchy.
+	MemoryUsage    uint64
+	MemoryMaxUsage uint64
+	MemoryLimit    uint64
+	// MemoryWorkingSet is MemoryUsage less the inactive file cache, which the
+	// kernel reclaims before invoking the OOM killer.
+	MemoryWorkingSet uint64
+	Pids             uint64
+	PidsLimit        uint64
+	// OOMKills is the number of processes of the cgroup killed by the OOM
+	// killer. v1 hierarchies only count them from Linux 4.13, and it is 0 on
+	// older kernels.
+	OOMKills uint64
+	// UnderOOM is set while a v1 cgroup is out of memory, on kernels which
+	// don't count OOM kills. The OOM killer usually frees memory before the
+	// cgroup is next sampled, so only some OOM kills are seen through it.
+	UnderOOM bool
+}
+
+// detectCgroupVersion returns the version of the cgroup hierarchy mounted on
+// cgroupRoot. Hybrid setups, which mount the unified hierarchy alongside the
+// v1 hierarchies, use v1 for the controllers.
+func detectCgroupVersion(o oslayer.OS) cgroupVersion {
+	if exists, err := o.PathExists(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil && exists {
+		return cgroupV2
+	}
+	return cgroupV1
+}
+
+// containerCgroupPath returns the path of the cgroup of the container with the
+// given ID, relative to the root of each hierarchy.
+func containerCgroupPath(id string) string {
+	return path.Join(cgroupParent, id)
+}
+
+// readCgroupStats reads the resource usage and limits of the container with
+// the given ID from its cgroup.
+func (c *gcsCore) readCgroupStats(id string) (*cgroupStats, error) {
+	var stats *cgroupStats
+	var err error
+	if c.cgroupVersion == cgroupV2 {
+		stats, err = c.readCgroupV2Stats(filepath.Join(cgroupRoot, containerCgroupPath(id)))
+	} else {
+		stats, err = c.readCgroupV1Stats(containerCgroupPath(id))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the cgroup statistics of container %s", id)
+	}
+	return stats, nil
+}
+
+// readCgroupV2Stats reads the statistics of the cgroup in the given directory
+// of the unified hierarchy.
+func (c *gcsCore) readCgroupV2Stats(dir string) (*cgroupStats, error) {
+	stats := &cgroupStats{}
+	values := []struct {
+		file  string
+		value *uint64
+	}{
+		{"memory.current", &stats.MemoryUsage},
+		{"memory.max", &stats.MemoryLimit},
+		{"pids.current", &stats.Pids},
+		{"pids.max", &stats.PidsLimit},
+	}
+	for _, v := range values {
+		var err error
+		if *v.value, err = c.readCgroupValue(filepath.Join(dir, v.file)); err != nil {
+			return nil, err
+		}
+	}
+	// memory.peak was only added in Linux 5.19.
+	peak, err := c.readOptionalCgroupValue(filepath.Join(dir, "memory.peak"))
+	if err != nil {
+		return nil, err
+	}
+	stats.MemoryMaxUsage = peak
+
+	cpuStat, err := c.readCgroupKeyedValues(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	stats.CPUUsage = cpuStat["usage_usec"] * 1000
+	memoryStat, err := c.readCgroupKeyedValues(filepath.Join(dir, "memory.stat"))
+	if err != nil {
+		return nil, err
+	}
+	stats.MemoryWorkingSet = workingSet(stats.MemoryUsage, memoryStat["inactive_file"])
+	memoryEvents, err := c.readCgroupKeyedValues(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return nil, err
+	}
+	stats.OOMKills = memoryEvents["oom_kill"]
+	return stats, nil
+}
+
+// readCgroupV1Stats reads the statistics of the cgroup at the given path of
+// each v1 hierarchy. Only the memory controller is required, and the values of
+// the cpuacct and pids controllers are left 0 if they aren't mounted.
+func (c *gcsCore) readCgroupV1Stats(cgroupPath string) (*cgroupStats, error) {
+	stats := &cgroupStats{}
+	values := []struct {
+		controller string
+		file       string
+		value      *uint64
+		optional   bool
+	}{
+		{"cpuacct", "cpuacct.usage", &stats.CPUUsage, true},
+		{"memory", "memory.usage_in_bytes", &stats.MemoryUsage, false},
+		// memory.max_usage_in_bytes is missing when the memory controller
+		// doesn't track the peak usage.
+		{"memory", "memory.max_usage_in_bytes", &stats.MemoryMaxUsage, true},
+		{"memory", "memory.limit_in_bytes", &stats.MemoryLimit, false},
+		{"pids", "pids.current", &stats.Pids, true},
+		{"pids", "pids.max", &stats.PidsLimit, true},
+	}
+	for _, v := range values {
+		filePath := filepath.Join(cgroupRoot, v.controller, cgroupPath, v.file)
+		var err error
+		if v.optional {
+			*v.value, err = c.readOptionalCgroupValue(filePath)
+		} else {
+			*v.value, err = c.readCgroupValue(filePath)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// v1 reports an unlimited memory limit as the largest page aligned value.
+	if stats.MemoryLimit >= unlimitedCgroupV1Memory {
+		stats.MemoryLimit = 0
+	}
+
+	memoryDir := filepath.Join(cgroupRoot, "memory", cgroupPath)
+	memoryStat, err := c.readCgroupKeyedValues(filepath.Join(memoryDir, "memory.stat"))
+	if err != nil {
+		return nil, err
+	}
+	stats.MemoryWorkingSet = workingSet(stats.MemoryUsage, memoryStat["total_inactive_file"])
+	oomControl, err := c.readCgroupKeyedValues(filepath.Join(memoryDir, "memory.oom_control"))
+	if err != nil {
+		return nil, err
+	}
+	// oom_kill was only added in Linux 4.13.
+	if oomKills, ok := oomControl["oom_kill"]; ok {
+		stats.OOMKills = oomKills
+	} else {
+		stats.UnderOOM = oomControl["under_oom"] != 0
+	}
+	return stats, nil
+}
+
+// workingSet returns the working set of a cgroup using the given amount of
+// memory with the given amount of inactive file cache.
+func workingSet(usage, inactiveFile uint64) uint64 {
+	if inactiveFile > usage {
+		return 0
+	}
+	return usage - inactiveFile
+}
+
+// readCgroupValue reads the single value cgroup file at the given path.
+func (c *gcsCore) readCgroupValue(filePath string) (uint64, error) {
+	contents, err := c.OS.ReadFile(filePath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read %s", filePath)
+	}
+	value, err := parseCgroupValue(contents)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s", filePath)
+	}
+	return value, nil
+}
+
+// readOptionalCgroupValue reads the single value cgroup file at the given path,
+// returning 0 if the file doesn't exist.
+func (c *gcsCore) readOptionalCgroupValue(filePath string) (uint64, error) {
+	value, err := c.readCgroupValue(filePath)
+	if err != nil && os.IsNotExist(errors.Cause(err)) {
+		return 0, nil
+	}
+	return value, err
+}
+
+// readCgroupKeyedValues reads the flat keyed cgroup file at the given path.
+func (c *gcsCore) readCgroupKeyedValues(filePath string) (map[string]uint64, error) {
+	contents, err := c.OS.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", filePath)
+	}
+	values, err := parseCgroupKeyedValues(contents)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", filePath)
+	}
+	return values, nil
+}
+
+// parseCgroupValue parses the contents of a cgroup file holding a single
+// value, where "max" means unlimited and is returned as 0.
+func parseCgroupValue(contents []byte) (uint64, error) {
+	s := strings.TrimSpace(string(contents))
+	if s == "max" {
+		return 0, nil
+	}
+	value, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid value \"%s\"", s)
+	}
+	return value, nil
+}
+
+// parseCgroupKeyedValues parses the contents of a flat keyed cgroup file, such
+// as memory.stat or cpu.stat, made of a key and a value on each line. Lines
+// which aren't made of a key and a single value are ignored.
+func parseCgroupKeyedValues(contents []byte) (map[string]uint64, error) {
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value \"%s\" of %s", fields[1], fields[0])
+		}
+		values[fields[0]] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,136 @@
+package gcs
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/core"
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+)
+
+// CheckpointContainer saves the state of the container's processes as an
+// image in the given directory, which must be on a writable mapped virtual
+// disk attached to the container. Once the image has been flushed to the
+// disk, the host may detach it and restore the container from it in another
+// utility VM. Unless options.LeaveRunning is set, the container exits once it
+// has been checkpointed.
+// Dumping the container can take a long time, so the GCS's other containers
+// aren't locked while it happens. Changes to the container itself are
+// rejected until it is done.
+func (c *gcsCore) CheckpointContainer(id string, imagePath string, options prot.CheckpointOptions) error {
+	c.containerCacheMutex.Lock()
+	containerEntry, ok := c.containerCache[id]
+	if !ok {
+		c.containerCacheMutex.Unlock()
+		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	if containerEntry.checkpointing {
+		c.containerCacheMutex.Unlock()
+		return errors.Errorf("container %s is already being checkpointed", id)
+	}
+	if len(containerEntry.Processes) == 0 {
+		c.containerCacheMutex.Unlock()
+		return errors.Errorf("container %s cannot be checkpointed before its init process has been started", id)
+	}
+	if err := checkCheckpointImagePath(containerEntry, imagePath, true); err != nil {
+		c.containerCacheMutex.Unlock()
+		return err
+	}
+	containerEntry.checkpointing = true
+	c.containerCacheMutex.Unlock()
+	defer func() {
+		c.containerCacheMutex.Lock()
+		containerEntry.checkpointing = false
+		c.containerCacheMutex.Unlock()
+	}()
+
+	runtimeOptions := runtime.CheckpointOptions{
+		LeaveRunning:        options.LeaveRunning,
+		TCPEstablished:      options.TCPEstablished,
+		ExternalUnixSockets: options.ExternalUnixSockets,
+		ShellJob:            options.ShellJob,
+		FileLocks:           options.FileLocks,
+	}
+	if err := c.Rtime.CheckpointContainer(id, imagePath, runtimeOptions); err != nil {
+		return errors.Wrapf(err, "failed to checkpoint container %s to %s", id, imagePath)
+	}
+	c.OS.Sync()
+	return nil
+}
+
+// RestoreContainer recreates the container's init process from the image in
+// the given directory, which must be on a mapped virtual disk attached to the
+// container, in place of executing it with ExecProcess. The container must
+// have been created with CreateContainer, and its init process described by
+// params, with its stdio forwarded through the given core.StdioSet.
+func (c *gcsCore) RestoreContainer(id string, imagePath string, params prot.ProcessParameters, stdioSet *core.StdioSet) (pid int, startTime uint64, err error) {
+	c.containerCacheMutex.Lock()
+	defer c.containerCacheMutex.Unlock()
+
+	containerEntry, ok := c.containerCache[id]
+	if !ok {
+		return -1, 0, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	if containerEntry.checkpointing {
+		return -1, 0, errors.Errorf("container %s cannot be restored while it is being checkpointed", id)
+	}
+	if len(containerEntry.Processes) != 0 {
+		return -1, 0, errors.Errorf("container %s cannot be restored after its init process has been started", id)
+	}
+	if err := checkCheckpointImagePath(containerEntry, imagePath, false); err != nil {
+		return -1, 0, err
+	}
+	processEntry := newContainerProcessCacheEntry()
+	// The process's exit hooks wait for its stdio to be drained, which never
+	// happens if it isn't forwarded.
+	defer func() {
+		if err != nil {
+			close(processEntry.stdioDrained)
+		}
+	}()
+
+	if err := c.writeConfigFile(id, params.OCISpecification); err != nil {
+		return -1, 0, err
+	}
+	stdioOptions := runtime.StdioOptions{
+		CreateIn:  params.CreateStdInPipe,
+		CreateOut: params.CreateStdOutPipe,
+		CreateErr: params.CreateStdErrPipe,
+	}
+	pid, err = c.Rtime.RestoreContainer(id, c.getContainerStoragePath(id), imagePath, stdioOptions)
+	if err != nil {
+		return -1, 0, errors.Wrapf(err, "failed to restore container %s from %s", id, imagePath)
+	}
+	if err := c.setupInitProcess(id, pid, containerEntry, processEntry); err != nil {
+		return -1, 0, err
+	}
+	if err := c.addProcess(id, pid, containerEntry, processEntry, stdioSet); err != nil {
+		return -1, 0, err
+	}
+	return pid, processEntry.StartTime, nil
+}
+
+// checkCheckpointImagePath checks that the given checkpoint image directory is
+// on a mapped virtual disk attached to the given container. If writable is
+// true, the disk must not be read-only.
+func checkCheckpointImagePath(containerEntry *containerCacheEntry, imagePath string, writable bool) error {
+	if !filepath.IsAbs(imagePath) {
+		return errors.Errorf("checkpoint image path %s is not absolute", imagePath)
+	}
+	imagePath = filepath.Clean(imagePath)
+	for _, disk := range containerEntry.MappedVirtualDisks {
+		rel, err := filepath.Rel(filepath.Clean(disk.ContainerPath), imagePath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if writable && disk.ReadOnly {
+			return errors.Errorf("checkpoint image path %s is on read-only mapped virtual disk %s", imagePath, disk.ContainerPath)
+		}
+		return nil
+	}
+	return errors.Errorf("checkpoint image path %s is not on a mapped virtual disk attached to container %s", imagePath, containerEntry.ID)
+}
@@ -4,7 +4,6 @@ import (
 	"github.com/Sirupsen/logrus"
 
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
-	"github.com/Microsoft/opengcs/service/gcs/prot"
 )
 
 // CleanupContainer cleans up the state left behind by the container with the
@@ -19,18 +18,36 @@ func (c *gcsCore) CleanupContainer(id string) error {
 		}
 	}
 
-	diskMap := c.containerCache[id].MappedVirtualDisks
-	disks := make([]prot.MappedVirtualDisk, 0, len(diskMap))
-	for _, disk := range diskMap {
-		disks = append(disks, disk)
-	}
-	if err := c.unmountMappedVirtualDisks(disks); err != nil {
-		logrus.Warn(err)
+	if err := c.releaseContainerStorage(id, c.containerCache[id]); err != nil {
 		if errToReturn == nil {
 			errToReturn = err
 		}
 	}
 
+	return errToReturn
+}
+
+// releaseContainerStorage releases the mapped virtual disks held by the given
+// cache entry, which may be nil, and the layers and scratch space of the
+// container with the given ID, and removes the files the GCS stores for it.
+// Errors are logged, and the first one is returned.
+func (c *gcsCore) releaseContainerStorage(id string, containerEntry *containerCacheEntry) error {
+	var errToReturn error
+
+	// Detach the container's mapped virtual disks. Disks which are still
+	// attached to other containers stay mounted.
+	if containerEntry != nil {
+		for lun, disk := range containerEntry.MappedVirtualDisks {
+			if err := c.releaseMappedVirtualDisk(disk, false); err != nil {
+				logrus.Warn(err)
+				if errToReturn == nil {
+					errToReturn = err
+				}
+			}
+			delete(containerEntry.MappedVirtualDisks, lun)
+		}
+	}
+
 	if err := c.unmountLayers(id); err != nil {
 		logrus.Warn(err)
 		if errToReturn == nil {
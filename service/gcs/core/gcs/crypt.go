@@ -0,0 +1,64 @@
+package gcs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// cryptCipher is the cipher used to encrypt scratch devices.
+	cryptCipher = "aes-xts-plain64"
+
+	// cryptKeySize is the size in bytes of the random key used to encrypt a
+	// scratch device. AES-XTS splits it into two AES-256 keys.
+	cryptKeySize = 64
+)
+
+// getCryptScratchName returns the name of the device-mapper device which
+// encrypts the scratch device of the container with the given ID.
+func getCryptScratchName(id string) string {
+	return "gcs-scratch-" + id
+}
+
+// cryptTable returns the device-mapper table for a dm-crypt device of the given
+// size in 512-byte sectors, which encrypts the device at the given path with
+// the given key.
+func cryptTable(sectors uint64, key []byte, devicePath string) string {
+	return fmt.Sprintf("0 %d crypt %s %s 0 %s 0\n", sectors, cryptCipher, hex.EncodeToString(key), devicePath)
+}
+
+// createCryptDevice sets up a device-mapper device with the given name which
+// encrypts the given block device (sda, sdb, etc.) with a random key, and
+// returns the path of the new device. The key is never stored, so the
+// device's contents are unreadable once it is removed.
+func (c *gcsCore) createCryptDevice(name, device string) (string, error) {
+	sizePath := filepath.Join("/sys/class/block", device, "size")
+	contents, err := c.OS.ReadFile(sizePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read size of device %s", device)
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse size of device %s", device)
+	}
+
+	key := make([]byte, cryptKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.Wrap(err, "failed to generate encryption key")
+	}
+	table := cryptTable(sectors, key, filepath.Join("/dev", device))
+	for i := range key {
+		key[i] = 0
+	}
+	devicePath, err := c.createDeviceMapperDevice(name, table, false)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create encrypted device %s", name)
+	}
+	return devicePath, nil
+}
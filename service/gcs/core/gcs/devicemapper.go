@@ -0,0 +1,53 @@
+package gcs
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// deviceMapperPath is the directory containing the nodes of device-mapper
+// devices, named after the devices.
+const deviceMapperPath = "/dev/mapper"
+
+// createDeviceMapperDevice creates a device-mapper device with the given name
+// and table, and returns the path of its node. If readOnly is true, the device
+// can't be written to.
+func (c *gcsCore) createDeviceMapperDevice(name, table string, readOnly bool) (string, error) {
+	args := []string{"create", "--noudevsync"}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	args = append(args, name)
+	// The table is passed on stdin rather than on the command line, so that
+	// any key it contains doesn't show up in the process list.
+	cmd := c.OS.Command("dmsetup", args...)
+	cmd.SetStdin(strings.NewReader(table))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "failed to create device-mapper device %s: %s", name, out)
+	}
+	// There is no udev in the utility VM to create the device node.
+	if out, err := c.OS.Command("dmsetup", "mknodes", name).CombinedOutput(); err != nil {
+		c.removeDeviceMapperDevice(name)
+		return "", errors.Wrapf(err, "failed to create node for device-mapper device %s: %s", name, out)
+	}
+	return filepath.Join(deviceMapperPath, name), nil
+}
+
+// removeDeviceMapperDevice removes the device-mapper device with the given
+// name, if it exists.
+func (c *gcsCore) removeDeviceMapperDevice(name string) error {
+	devicePath := filepath.Join(deviceMapperPath, name)
+	exists, err := c.OS.PathExists(devicePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to determine if device-mapper device %s exists", devicePath)
+	}
+	if !exists {
+		return nil
+	}
+	if out, err := c.OS.Command("dmsetup", "remove", "--noudevsync", "--retry", name).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to remove device-mapper device %s: %s", name, out)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package gcs
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+)
+
+const (
+	// statsInterval is the interval at which the resource usage of each
+	// container is read from its cgroup and sent to its event hooks.
+	statsInterval = 30 * time.Second
+	// eventsDrainTimeout bounds how long the exit hooks of a container wait
+	// for the container's remaining events to be handled, so that an OOM
+	// kill which caused the exit is reported with it.
+	eventsDrainTimeout = 5 * time.Second
+)
+
+// containerExitState is the exit state given to the exit hooks of a
+// container. It implements core.ContainerExitState.
+type containerExitState struct {
+	oslayer.ProcessExitState
+	oomKilled bool
+}
+
+func (s containerExitState) OOMKilled() bool {
+	return s.oomKilled
+}
+
+// watchContainerEvents starts forwarding the OOM events of the given container
+// reported by the runtime to the container's event hooks as notifications,
+// along with its resource usage read from its cgroup every statsInterval. The
+// OOM events of a container whose runtime can't report them are found from
+// the OOM kill count of its cgroup instead.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) watchContainerEvents(id string, containerEntry *containerCacheEntry) {
+	events, err := c.Rtime.Events(id, 0)
+	if err != nil {
+		logrus.Warnf("finding the OOM kills of container %s from its cgroup: %v", id, err)
+		containerEntry.pollOOM = true
+	}
+	if stats, err := c.readCgroupStats(id); err == nil {
+		containerEntry.oomKills = stats.OOMKills
+		containerEntry.underOOM = stats.UnderOOM
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	containerEntry.stopEvents = stop
+	containerEntry.eventsDone = done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		tick := ticker.C
+		// The OOM events reported by the runtime until the container has been
+		// deleted are still handled once the container has been stopped.
+		for events != nil || stop != nil {
+			select {
+			case event, ok := <-events:
+				c.containerCacheMutex.Lock()
+				if !ok {
+					events = nil
+					if stop != nil {
+						logrus.Warnf("the runtime stopped reporting the events of container %s, finding its OOM kills from its cgroup", id)
+						containerEntry.pollOOM = true
+					}
+				} else if event.Type == runtime.EventOOM {
+					c.containerOOMKilled(containerEntry)
+				}
+				c.containerCacheMutex.Unlock()
+			case <-tick:
+				c.sampleContainerStats(id, containerEntry)
+			case <-stop:
+				tick = nil
+				stop = nil
+			}
+		}
+	}()
+}
+
+// stopContainerEvents stops sending the resource usage of the given container
+// to its event hooks, once its init process has exited. If the container's OOM
+// events are found from its cgroup, the cgroup is checked one last time.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) stopContainerEvents(id string, containerEntry *containerCacheEntry) {
+	if containerEntry.stopEvents == nil {
+		return
+	}
+	if containerEntry.pollOOM {
+		if stats, err := c.readCgroupStats(id); err != nil {
+			logrus.Warn(err)
+		} else {
+			c.checkOOMKills(containerEntry, stats)
+		}
+	}
+	close(containerEntry.stopEvents)
+	containerEntry.stopEvents = nil
+}
+
+// sampleContainerStats reads the resource usage of the given container from
+// its cgroup, and sends it to the container's event hooks.
+func (c *gcsCore) sampleContainerStats(id string, containerEntry *containerCacheEntry) {
+	stats, err := c.readCgroupStats(id)
+	if err != nil {
+		logrus.Warn(err)
+		return
+	}
+	c.containerCacheMutex.Lock()
+	defer c.containerCacheMutex.Unlock()
+	c.checkOOMKills(containerEntry, stats)
+	c.notifyContainerEvent(containerEntry, prot.ContainerNotification{
+		Type:      prot.NtStatistics,
+		Operation: prot.AoNone,
+		Statistics: &prot.ContainerStatistics{
+			CPUUsage:         stats.CPUUsage,
+			MemoryUsage:      stats.MemoryUsage,
+			MemoryMaxUsage:   stats.MemoryMaxUsage,
+			MemoryLimit:      stats.MemoryLimit,
+			MemoryWorkingSet: stats.MemoryWorkingSet,
+			ProcessCount:     stats.Pids,
+			ProcessLimit:     stats.PidsLimit,
+		},
+	})
+}
+
+// checkOOMKills records the OOM kill count of the container's cgroup from the
+// given sample, and sends an OOM notification if it has grown and the runtime
+// doesn't report the container's OOM events. On kernels which don't count OOM
+// kills, the notification is sent when the cgroup is found to have run out of
+// memory instead.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) checkOOMKills(containerEntry *containerCacheEntry, stats *cgroupStats) {
+	if containerEntry.pollOOM && (stats.OOMKills > containerEntry.oomKills || (stats.UnderOOM && !containerEntry.underOOM)) {
+		c.containerOOMKilled(containerEntry)
+	}
+	containerEntry.oomKills = stats.OOMKills
+	containerEntry.underOOM = stats.UnderOOM
+}
+
+// containerOOMKilled records that a process of the given container has been
+// killed by the OOM killer, and sends an OOM notification.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) containerOOMKilled(containerEntry *containerCacheEntry) {
+	containerEntry.OOMKilled = true
+	c.notifyContainerEvent(containerEntry, prot.ContainerNotification{
+		Type:      prot.NtOutOfMemory,
+		Operation: prot.AoNone,
+	})
+}
+
+// notifyContainerEvent calls the event hooks of the given container with the
+// given notification.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) notifyContainerEvent(containerEntry *containerCacheEntry, notification prot.ContainerNotification) {
+	for _, hook := range containerEntry.EventHooks {
+		hook(notification)
+	}
+}
+
+// waitContainerEvents waits up to eventsDrainTimeout for the events of the
+// container with the given ID to have all been handled, once the container has
+// been deleted. eventsDone is the channel closed by watchContainerEvents once
+// they have, if it was able to watch them.
+func waitContainerEvents(id string, eventsDone <-chan struct{}) {
+	if eventsDone == nil {
+		return
+	}
+	select {
+	case <-eventsDone:
+	case <-time.After(eventsDrainTimeout):
+		logrus.Warnf("timed out waiting for the events of container %s", id)
+	}
+}
+
+// RegisterContainerEventHook registers a hook on the container with the given
+// ID which is called with a notification for each OOM event of the container,
+// and with its resource usage and limits every statsInterval. No notifications are sent
+// once the container has exited.
+func (c *gcsCore) RegisterContainerEventHook(id string, eventHook func(prot.ContainerNotification)) error {
+	c.containerCacheMutex.Lock()
+	defer c.containerCacheMutex.Unlock()
+
+	entry, ok := c.containerCache[id]
+	if !ok {
+		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	entry.AddEventHook(eventHook)
+	return nil
+}
@@ -0,0 +1,209 @@
+package gcs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/mountopts"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+)
+
+const (
+	// superblockProbeSize is the number of bytes read from the start of a
+	// device in order to determine the filesystem it contains. It must be
+	// large enough to cover the superblock of every supported filesystem.
+	superblockProbeSize = 4096
+
+	// blankProbeSize is the number of bytes at the start of a device which
+	// must be zero for the device to be considered blank. It is larger than
+	// superblockProbeSize so that filesystems whose superblocks are further
+	// into the device, which aren't otherwise detected, are never mistaken
+	// for a blank device and overwritten.
+	blankProbeSize = 128 * 1024
+
+	// defaultFilesystemType is the filesystem type assumed for a device
+	// whose superblock isn't recognized.
+	defaultFilesystemType = "ext4"
+)
+
+// Filesystem types which may be detected by probeFilesystemType.
+const (
+	fsTypeExt4     = "ext4"
+	fsTypeXFS      = "xfs"
+	fsTypeVFAT     = "vfat"
+	fsTypeSquashfs = "squashfs"
+)
+
+// probeFilesystemType reads the start of a device from r and returns the type
+// of the filesystem whose superblock it finds there. If no supported
+// filesystem is recognized, an empty string is returned.
+func probeFilesystemType(r io.Reader) (string, error) {
+	buf := make([]byte, superblockProbeSize)
+	if _, err := io.ReadFull(r, buf); err != nil && err != io.ErrUnexpectedEOF {
+		return "", errors.Wrap(err, "failed to read superblock")
+	}
+
+	switch {
+	// The ext2/3/4 superblock starts at byte 1024, and its magic number is
+	// at offset 56 within it.
+	case binary.LittleEndian.Uint16(buf[1080:1082]) == 0xEF53:
+		return fsTypeExt4, nil
+	case bytes.Equal(buf[0:4], []byte("XFSB")):
+		return fsTypeXFS, nil
+	case bytes.Equal(buf[0:4], []byte("hsqs")):
+		return fsTypeSquashfs, nil
+	// FAT boot sectors carry the 0x55AA signature, and store the filesystem
+	// type string in a location which differs between FAT12/16 and FAT32.
+	case buf[510] == 0x55 && buf[511] == 0xAA &&
+		(bytes.HasPrefix(buf[54:62], []byte("FAT")) || bytes.HasPrefix(buf[82:90], []byte("FAT32"))):
+		return fsTypeVFAT, nil
+	}
+	return "", nil
+}
+
+// isBlank returns whether the given data, read from the start of a device, is
+// all zeros, as it is on a newly created virtual disk.
+func isBlank(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mkfsExt4Args returns the arguments to pass to mkfs.ext4 in order to create a
+// filesystem with the given options on the device at the given path.
+func mkfsExt4Args(devicePath string, options *prot.SandboxFormatOptions) []string {
+	args := []string{"-q"}
+	if options == nil {
+		return append(args, devicePath)
+	}
+	if options.BlockSize != 0 {
+		args = append(args, "-b", strconv.FormatUint(uint64(options.BlockSize), 10))
+	}
+	if options.InodeSize != 0 {
+		args = append(args, "-I", strconv.FormatUint(uint64(options.InodeSize), 10))
+	}
+	if options.InodeCount != 0 {
+		args = append(args, "-N", strconv.FormatUint(options.InodeCount, 10))
+	}
+	args = append(args, devicePath)
+	if options.SizeInMB != 0 {
+		args = append(args, fmt.Sprintf("%dM", options.SizeInMB))
+	}
+	return args
+}
+
+// readOnlyMountData returns the filesystem-specific options which prevent the
+// given filesystem type from writing to its device (e.g. by replaying its
+// journal) when it is mounted read-only.
+func readOnlyMountData(fsType string) []string {
+	switch fsType {
+	case fsTypeExt4:
+		return []string{"noload"}
+	case fsTypeXFS:
+		return []string{"norecovery"}
+	}
+	return nil
+}
+
+// daxMountOption is the mount option which enables direct access (DAX) to a
+// persistent memory device, bypassing the page cache.
+const daxMountOption = "dax"
+
+// filterDaxMountData removes the dax option from the given mount data if the
+// given filesystem type doesn't support DAX, so that it can be requested for
+// any filesystem found on a persistent memory device.
+func filterDaxMountData(fsType string, data []string) []string {
+	if fsType == fsTypeExt4 || fsType == fsTypeXFS {
+		return data
+	}
+	filtered := make([]string, 0, len(data))
+	for _, option := range data {
+		if option != daxMountOption {
+			filtered = append(filtered, option)
+		}
+	}
+	return filtered
+}
+
+// getFilesystemType probes the device at the given path for the type of the
+// filesystem it contains. If the filesystem isn't recognized,
+// defaultFilesystemType is returned.
+func (c *gcsCore) getFilesystemType(devicePath string) (string, error) {
+	device, err := c.OS.OpenFile(devicePath, os.O_RDONLY, 0)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open device %s", devicePath)
+	}
+	defer device.Close()
+	fsType, err := probeFilesystemType(device)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to probe filesystem type of device %s", devicePath)
+	}
+	if fsType == "" {
+		logrus.Warnf("could not detect filesystem type of device %s, assuming %s", devicePath, defaultFilesystemType)
+		fsType = defaultFilesystemType
+	}
+	return fsType, nil
+}
+
+// isBlankDevice returns whether the start of the device at the given path is
+// all zeros, meaning that it holds neither a filesystem nor a partition table.
+func (c *gcsCore) isBlankDevice(devicePath string) (bool, error) {
+	device, err := c.OS.OpenFile(devicePath, os.O_RDONLY, 0)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to open device %s", devicePath)
+	}
+	defer device.Close()
+	buf := make([]byte, blankProbeSize)
+	if _, err := io.ReadFull(device, buf); err != nil && err != io.ErrUnexpectedEOF {
+		return false, errors.Wrapf(err, "failed to read device %s", devicePath)
+	}
+	return isBlank(buf), nil
+}
+
+// formatDevice creates an ext4 filesystem with the given options on the device
+// at the given path. options may be nil to use the default settings.
+func (c *gcsCore) formatDevice(devicePath string, options *prot.SandboxFormatOptions) error {
+	out, err := c.OS.Command("mkfs.ext4", mkfsExt4Args(devicePath, options)...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to format device %s: %s", devicePath, out)
+	}
+	return nil
+}
+
+// mountDevice mounts the filesystem on the device at the given path to the
+// given target. The filesystem type is detected from the device's superblock.
+// options may contain any mount options, such as "noexec" or "discard".
+func (c *gcsCore) mountDevice(devicePath, target string, readOnly bool, options []string) error {
+	fsType, err := c.getFilesystemType(devicePath)
+	if err != nil {
+		return err
+	}
+	flags, data := mountopts.Parse(options)
+	data = filterDaxMountData(fsType, data)
+	// squashfs can only ever be mounted read-only.
+	if fsType == fsTypeSquashfs {
+		readOnly = true
+	}
+	if readOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	if flags&syscall.MS_RDONLY != 0 {
+		data = append(readOnlyMountData(fsType), data...)
+	}
+	if err := c.OS.Mount(devicePath, target, fsType, flags, strings.Join(data, ",")); err != nil {
+		return errors.Wrapf(err, "failed to mount %s filesystem on device %s to %s", fsType, devicePath, target)
+	}
+	return nil
+}
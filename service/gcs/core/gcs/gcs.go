@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -28,6 +30,10 @@ import (
 
 const (
 	terminateProcessTimeout = time.Second * 10
+	// stdioDrainTimeout bounds how long the exit hooks of a container process
+	// wait for the process's stdout and stderr to be copied to their
+	// connections, which a process's children can keep open after it exits.
+	stdioDrainTimeout = time.Second * 5
 )
 
 // gcsCore is an implementation of the Core interface, defining the
@@ -39,6 +45,10 @@ type gcsCore struct {
 	// OS is the OS interface used by the GCS core.
 	OS oslayer.OS
 
+	// cgroupVersion is the version of the cgroup hierarchy the containers'
+	// cgroups are read from.
+	cgroupVersion cgroupVersion
+
 	containerCacheMutex sync.RWMutex
 	// containerCache stores information about containers which persists
 	// between calls into the gcsCore. It is structured as a map from container
@@ -48,24 +58,48 @@ type gcsCore struct {
 	processCacheMutex sync.RWMutex
 	// processCache stores information about processes which persists between
 	// calls into the gcsCore. It is structured as a map from pid to cache
-	// entry.
+	// entry. Exited processes are removed once they have expired, or once
+	// their pid is reused by another process.
 	processCache map[int]*processCacheEntry
 
 	externalProcessCacheMutex sync.RWMutex
 	// externalProcessCache stores information about external processes which
-	// persists between calls into the gcsCore. It is structured as a map from
-	// pid to cache entry.
+	// persists between calls into the gcsCore. It is structured like
+	// processCache, and a pid is only ever in one of the two.
 	externalProcessCache map[int]*processCacheEntry
+
+	mappedVirtualDiskCacheMutex sync.Mutex
+	// mappedVirtualDiskCache stores information about the mapped virtual disks
+	// mounted in the utility VM. Since a disk may back more than one
+	// container, it is shared between all containers rather than kept in
+	// their cache entries. It is structured as a map from the disk's SCSI
+	// address and mount path to cache entry.
+	mappedVirtualDiskCache map[mappedVirtualDiskKey]*mappedVirtualDiskCacheEntry
+
+	layerCacheMutex sync.Mutex
+	// layerCache stores information about the layer devices mounted in the
+	// utility VM. Each layer is mounted once and shared between all
+	// containers using it. It is structured as a map from the layer's device
+	// name to cache entry.
+	layerCache map[string]*layerCacheEntry
+
+	// journal records each state transition of the caches, so that a later
+	// instance of the GCS can rebuild them. It is nil until Reconcile has
+	// been called.
+	journal *journal
 }
 
 // NewGCSCore creates a new gcsCore struct initialized with the given Runtime.
 func NewGCSCore(rtime runtime.Runtime, os oslayer.OS) *gcsCore {
 	return &gcsCore{
-		Rtime:                rtime,
-		OS:                   os,
-		containerCache:       make(map[string]*containerCacheEntry),
-		processCache:         make(map[int]*processCacheEntry),
-		externalProcessCache: make(map[int]*processCacheEntry),
+		Rtime:                  rtime,
+		OS:                     os,
+		cgroupVersion:          detectCgroupVersion(os),
+		containerCache:         make(map[string]*containerCacheEntry),
+		processCache:           make(map[int]*processCacheEntry),
+		externalProcessCache:   make(map[int]*processCacheEntry),
+		mappedVirtualDiskCache: make(map[mappedVirtualDiskKey]*mappedVirtualDiskCacheEntry),
+		layerCache:             make(map[string]*layerCacheEntry),
 	}
 }
 
@@ -75,19 +109,48 @@ type containerCacheEntry struct {
 	ExitStatus         oslayer.ProcessExitState
 	Processes          []int
 	ExitHooks          []func(oslayer.ProcessExitState)
-	MappedVirtualDisks map[uint8]prot.MappedVirtualDisk
+	EventHooks         []func(prot.ContainerNotification)
+	MappedVirtualDisks map[prot.ScsiAddress]prot.MappedVirtualDisk
 	NetworkAdapters    []prot.NetworkAdapter
+	// ExitHookPending is set on entries restored from the journal when the
+	// host was waiting on the container's exit, and is cleared once an exit
+	// hook has been run for it.
+	ExitHookPending bool
+	// OOMKilled is set once a process in the container has been killed by
+	// the OOM killer.
+	OOMKilled bool
+	// checkpointing is set while the container is being checkpointed, during
+	// which other changes to it are rejected.
+	checkpointing bool
+	// pollOOM is set when the runtime doesn't report the container's OOM
+	// events, which are then found from the OOM kill count of its cgroup.
+	// oomKills and underOOM are the count and the out of memory state last
+	// seen.
+	pollOOM  bool
+	oomKills uint64
+	underOOM bool
+	// stopEvents is closed to stop watching the events of the container, and
+	// eventsDone is closed once all of them have been handled. They are nil
+	// if the container's events aren't being watched.
+	stopEvents chan struct{}
+	eventsDone chan struct{}
 }
 
 func newContainerCacheEntry(id string) *containerCacheEntry {
 	return &containerCacheEntry{
 		ID:                 id,
-		MappedVirtualDisks: make(map[uint8]prot.MappedVirtualDisk),
+		MappedVirtualDisks: make(map[prot.ScsiAddress]prot.MappedVirtualDisk),
 	}
 }
 func (e *containerCacheEntry) AddExitHook(hook func(oslayer.ProcessExitState)) {
 	e.ExitHooks = append(e.ExitHooks, hook)
 }
+func (e *containerCacheEntry) AddEventHook(hook func(prot.ContainerNotification)) {
+	e.EventHooks = append(e.EventHooks, hook)
+}
+func (e *containerCacheEntry) exitHookPending() bool {
+	return e.ExitHookPending || (e.ExitStatus == nil && len(e.ExitHooks) > 0)
+}
 func (e *containerCacheEntry) AddProcess(pid int) {
 	e.Processes = append(e.Processes, pid)
 }
@@ -95,17 +158,19 @@ func (e *containerCacheEntry) AddNetworkAdapter(adapter prot.NetworkAdapter) {
 	e.NetworkAdapters = append(e.NetworkAdapters, adapter)
 }
 func (e *containerCacheEntry) AddMappedVirtualDisk(disk prot.MappedVirtualDisk) error {
-	if _, ok := e.MappedVirtualDisks[disk.Lun]; ok {
-		return errors.Errorf("a mapped virtual disk with lun %d is already attached to container %s", disk.Lun, e.ID)
+	address := mappedVirtualDiskScsiAddress(disk)
+	if _, ok := e.MappedVirtualDisks[address]; ok {
+		return errors.Errorf("a mapped virtual disk with controller %d, lun %d is already attached to container %s", disk.Controller, disk.Lun, e.ID)
 	}
-	e.MappedVirtualDisks[disk.Lun] = disk
+	e.MappedVirtualDisks[address] = disk
 	return nil
 }
 func (e *containerCacheEntry) RemoveMappedVirtualDisk(disk prot.MappedVirtualDisk) error {
-	if _, ok := e.MappedVirtualDisks[disk.Lun]; !ok {
-		return errors.Errorf("a mapped virtual disk with lun %d is not attached to container %s", disk.Lun, e.ID)
+	address := mappedVirtualDiskScsiAddress(disk)
+	if _, ok := e.MappedVirtualDisks[address]; !ok {
+		return errors.Errorf("a mapped virtual disk with controller %d, lun %d is not attached to container %s", disk.Controller, disk.Lun, e.ID)
 	}
-	delete(e.MappedVirtualDisks, disk.Lun)
+	delete(e.MappedVirtualDisks, address)
 	return nil
 }
 
@@ -113,19 +178,70 @@ func (e *containerCacheEntry) RemoveMappedVirtualDisk(disk prot.MappedVirtualDis
 type processCacheEntry struct {
 	ExitStatus oslayer.ProcessExitState
 	ExitHooks  []func(oslayer.ProcessExitState)
+	// Command is the command line of an external process. It is unset for
+	// container processes, and for external processes adopted from a
+	// previous instance of the GCS.
+	Command []string
+	// StartTime is the start time of the process, in clock ticks after boot,
+	// or zero if it is unknown. Together with the pid, it identifies the
+	// process even once the pid has been reused.
+	StartTime uint64
+	// ExitTime is when the process's exit was recorded, from which it
+	// expires after exitedProcessRetention.
+	ExitTime time.Time
+	// stdioDrained is closed once the process's stdout and stderr have been
+	// copied to their connections. It is nil for processes whose stdio isn't
+	// forwarded by setupStdioPipes.
+	stdioDrained chan struct{}
+	// ExitHookPending is set on entries restored from the journal when the
+	// host was waiting on the process's exit, and is cleared once an exit
+	// hook has been run for it.
+	ExitHookPending bool
+	// exitHooksDelayed is set while the process has exited but its exit
+	// hooks are waiting for its output to be sent.
+	exitHooksDelayed bool
 }
 
 func newProcessCacheEntry() *processCacheEntry {
 	return &processCacheEntry{}
 }
+
+// newContainerProcessCacheEntry returns the cache entry of a container
+// process, whose stdio is to be forwarded by setupStdioPipes.
+func newContainerProcessCacheEntry() *processCacheEntry {
+	return &processCacheEntry{stdioDrained: make(chan struct{})}
+}
 func (e *processCacheEntry) AddExitHook(hook func(oslayer.ProcessExitState)) {
 	e.ExitHooks = append(e.ExitHooks, hook)
 }
+func (e *processCacheEntry) exitHookPending() bool {
+	return e.ExitHookPending || ((e.ExitStatus == nil || e.exitHooksDelayed) && len(e.ExitHooks) > 0)
+}
+
+// mappedVirtualDiskKey identifies a mounted mapped virtual disk in the
+// mappedVirtualDiskCache.
+type mappedVirtualDiskKey struct {
+	Address       prot.ScsiAddress
+	ContainerPath string
+}
+
+func newMappedVirtualDiskKey(disk prot.MappedVirtualDisk) mappedVirtualDiskKey {
+	return mappedVirtualDiskKey{Address: mappedVirtualDiskScsiAddress(disk), ContainerPath: disk.ContainerPath}
+}
+
+// mappedVirtualDiskCacheEntry stores cached information for a single mounted
+// mapped virtual disk.
+type mappedVirtualDiskCacheEntry struct {
+	Disk prot.MappedVirtualDisk
+	// RefCount is the number of containers the disk is attached to. The disk
+	// is unmounted once it drops to zero.
+	RefCount int
+}
 
 // CreateContainer creates all the infrastructure for a container, including
 // setting up layers and networking, and then starts up its init process in a
 // suspended state waiting for a call to StartContainer.
-func (c *gcsCore) CreateContainer(id string, settings prot.VMHostedContainerSettings) error {
+func (c *gcsCore) CreateContainer(id string, settings prot.VMHostedContainerSettings) (err error) {
 	c.containerCacheMutex.Lock()
 	defer c.containerCacheMutex.Unlock()
 
@@ -134,6 +250,13 @@ func (c *gcsCore) CreateContainer(id string, settings prot.VMHostedContainerSett
 	}
 
 	containerEntry := newContainerCacheEntry(id)
+	// Release whatever was set up before a failure, so that the disks and
+	// layers aren't left referenced by a container which doesn't exist.
+	defer func() {
+		if err != nil {
+			c.releaseContainerStorage(id, containerEntry)
+		}
+	}()
 
 	// Set up mapped virtual disks.
 	if err := c.setupMappedVirtualDisks(id, settings.MappedVirtualDisks, containerEntry); err != nil {
@@ -141,11 +264,27 @@ func (c *gcsCore) CreateContainer(id string, settings prot.VMHostedContainerSett
 	}
 
 	// Set up layers.
-	scratchDevice, layers, err := c.getLayerDevices(settings.SandboxDataPath, settings.Layers)
+	scratchAddress, err := sandboxScsiAddress(settings)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get sandbox address for container %s", id)
+	}
+	if scratchAddress != nil && settings.EphemeralScratchSizeInMB != 0 {
+		return errors.Errorf("container %s cannot have both a sandbox device and ephemeral scratch space", id)
+	}
+	if scratchAddress == nil && settings.EncryptSandbox {
+		return errors.Errorf("container %s cannot have an encrypted sandbox without a sandbox device", id)
+	}
+	scratchDevice, layers, err := c.getLayerDevices(scratchAddress, settings.Layers)
 	if err != nil {
 		return errors.Wrapf(err, "failed to get layer devices for container %s", id)
 	}
-	if err := c.mountLayers(id, scratchDevice, layers); err != nil {
+	scratch := scratchSpace{
+		Device:            scratchDevice,
+		FormatOptions:     settings.SandboxFormatOptions,
+		Encrypted:         settings.EncryptSandbox,
+		EphemeralSizeInMB: settings.EphemeralScratchSizeInMB,
+	}
+	if err := c.mountLayers(id, scratch, layers); err != nil {
 		return errors.Wrapf(err, "failed to mount layers for container %s", id)
 	}
 
@@ -158,21 +297,38 @@ func (c *gcsCore) CreateContainer(id string, settings prot.VMHostedContainerSett
 	}
 
 	c.containerCache[id] = containerEntry
+	c.journal.record(journalRecord{
+		Op:                 journalCreateContainer,
+		ID:                 id,
+		MappedVirtualDisks: settings.MappedVirtualDisks,
+		NetworkAdapters:    settings.NetworkAdapters,
+	})
 
 	return nil
 }
 
 // ExecProcess executes a new process in the container. It forwards the
-// process's stdio through the members of the core.StdioSet provided.
-func (c *gcsCore) ExecProcess(id string, params prot.ProcessParameters, stdioSet *core.StdioSet) (pid int, err error) {
+// process's stdio through the members of the core.StdioSet provided, and
+// returns the process's pid and start time.
+func (c *gcsCore) ExecProcess(id string, params prot.ProcessParameters, stdioSet *core.StdioSet) (pid int, startTime uint64, err error) {
 	c.containerCacheMutex.Lock()
 	defer c.containerCacheMutex.Unlock()
 
 	containerEntry, ok := c.containerCache[id]
 	if !ok {
-		return -1, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+		return -1, 0, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
 	}
-	processEntry := newProcessCacheEntry()
+	if containerEntry.checkpointing {
+		return -1, 0, errors.Errorf("container %s cannot execute a process while it is being checkpointed", id)
+	}
+	processEntry := newContainerProcessCacheEntry()
+	// The process's exit hooks wait for its stdio to be drained, which never
+	// happens if it isn't forwarded.
+	defer func() {
+		if err != nil {
+			close(processEntry.stdioDrained)
+		}
+	}()
 
 	stdioOptions := runtime.StdioOptions{
 		CreateIn:  params.CreateStdInPipe,
@@ -182,63 +338,28 @@ func (c *gcsCore) ExecProcess(id string, params prot.ProcessParameters, stdioSet
 	isInitProcess := len(containerEntry.Processes) == 0
 	if isInitProcess {
 		if err := c.writeConfigFile(id, params.OCISpecification); err != nil {
-			return -1, err
+			return -1, 0, err
 		}
 
 		pid, err = c.Rtime.CreateContainer(id, c.getContainerStoragePath(id), stdioOptions)
 		if err != nil {
-			return -1, err
+			return -1, 0, err
 		}
-
-		// Move the container's network adapters into its namespace.
-		for _, adapter := range containerEntry.NetworkAdapters {
-			if err := c.moveAdapterIntoNamespace(id, adapter); err != nil {
-				return -1, err
-			}
+		if err := c.setupInitProcess(id, pid, containerEntry, processEntry); err != nil {
+			return -1, 0, err
 		}
 
-		go func() {
-			state, err := c.Rtime.WaitOnContainer(id)
-			c.containerCacheMutex.Lock()
-			if err != nil {
-				logrus.Error(err)
-				if err := c.CleanupContainer(id); err != nil {
-					logrus.Error(err)
-				}
-			}
-			utils.LogMsgf("container init process %d exited with exit status %d", pid, state.ExitCode())
-
-			if err := c.CleanupContainer(id); err != nil {
-				logrus.Error(err)
-			}
-			c.containerCacheMutex.Unlock()
-
-			c.processCacheMutex.Lock()
-			processEntry.ExitStatus = state
-			for _, hook := range processEntry.ExitHooks {
-				hook(state)
-			}
-			c.processCacheMutex.Unlock()
-			c.containerCacheMutex.Lock()
-			containerEntry.ExitStatus = state
-			for _, hook := range containerEntry.ExitHooks {
-				hook(state)
-			}
-			delete(c.containerCache, id)
-			c.containerCacheMutex.Unlock()
-		}()
-
 		if err := c.Rtime.StartContainer(id); err != nil {
-			return -1, err
+			return -1, 0, err
 		}
 	} else {
 		ociProcess, err := processParametersToOCI(params)
 		if err != nil {
-			return -1, err
+			return -1, 0, err
 		}
 		pid, err = c.Rtime.ExecProcess(id, ociProcess, stdioOptions)
 		if err != nil {
-			return -1, err
+			return -1, 0, err
 		}
 		go func() {
 			state, err := c.Rtime.WaitOnProcess(id, pid)
@@ -246,10 +367,15 @@ func (c *gcsCore) ExecProcess(id string, params prot.ProcessParameters, stdioSet
 				logrus.Error(err)
 			}
 			utils.LogMsgf("container process %d exited with exit status %d", pid, state.ExitCode())
+			c.processCacheMutex.Lock()
+			processEntry.recordExit(state)
+			c.processCacheMutex.Unlock()
+
+			waitStdioDrained(pid, processEntry.stdioDrained)
 
-			// Close stdin.
-			// TODO: Remove this conditional when stdio forwarding for non-terminal processes is fixed.
-			if ociProcess.Terminal {
+			// Close stdin once the output has been sent, which ends the
+			// copy of any input the host hasn't closed to the process.
+			if stdioSet.In != nil {
 				if err := stdioSet.In.CloseRead(); err != nil {
 					logrus.Errorf("failed call to CloseRead for non-initial process stdin: %v: %s", ociProcess.Args, err)
 				}
@@ -257,41 +383,114 @@ func (c *gcsCore) ExecProcess(id string, params prot.ProcessParameters, stdioSet
 					logrus.Errorf("failed call to Close for non-initial process stdin: %v: %s", ociProcess.Args, err)
 				}
 			}
-
 			c.processCacheMutex.Lock()
-			processEntry.ExitStatus = state
-			for _, hook := range processEntry.ExitHooks {
-				hook(state)
-			}
+			processEntry.runExitHooks()
 			c.processCacheMutex.Unlock()
+			c.journal.record(journalRecord{Op: journalProcessExited, ID: id, Pid: pid, ExitCode: state.ExitCode()})
 			if err := c.Rtime.DeleteProcess(id, pid); err != nil {
 				logrus.Error(err)
 			}
 		}()
 	}
 
+	if err := c.addProcess(id, pid, containerEntry, processEntry, stdioSet); err != nil {
+		return -1, 0, err
+	}
+	return pid, processEntry.StartTime, nil
+}
+
+// setupInitProcess finishes setting up the container's init process with the
+// given pid once the runtime has created it. It moves the container's network
+// adapters into the process's namespace, and waits on the process in the
+// background so that the container is cleaned up once it exits.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) setupInitProcess(id string, pid int, containerEntry *containerCacheEntry, processEntry *processCacheEntry) error {
+	// Move the container's network adapters into its namespace.
+	for _, adapter := range containerEntry.NetworkAdapters {
+		if err := c.moveAdapterIntoNamespace(id, adapter); err != nil {
+			return err
+		}
+	}
+	if len(containerEntry.NetworkAdapters) > 0 {
+		c.journal.record(journalRecord{Op: journalMoveNetworkAdapter, ID: id, NetworkAdapters: containerEntry.NetworkAdapters})
+	}
+
+	c.watchContainerEvents(id, containerEntry)
+	go func() {
+		state, err := c.Rtime.WaitOnContainer(id)
+		c.containerCacheMutex.Lock()
+		if err != nil {
+			logrus.Error(err)
+			if err := c.CleanupContainer(id); err != nil {
+				logrus.Error(err)
+			}
+		}
+		utils.LogMsgf("container init process %d exited with exit status %d", pid, state.ExitCode())
+		c.containerCacheMutex.Unlock()
+
+		c.containerExited(id, pid, containerEntry, processEntry, state)
+	}()
+	return nil
+}
+
+// addProcess connects the stdio of the container process with the given pid
+// to the given stdioSet, and adds the process to the caches.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) addProcess(id string, pid int, containerEntry *containerCacheEntry, processEntry *processCacheEntry, stdioSet *core.StdioSet) error {
 	// Connect the container's stdio to the stdio pipes.
-	if err := c.setupStdioPipes(id, pid, stdioSet); err != nil {
-		return -1, err
+	if err := c.setupStdioPipes(id, pid, stdioSet, processEntry.stdioDrained); err != nil {
+		return err
 	}
 
+	// Processes are kept in the cache for a while after they exit, so that
+	// the HCS can still wait on a process which has already exited, due to a
+	// race condition between the wait call and the process exiting.
+	c.processStarted(id, pid, processEntry)
+	containerEntry.AddProcess(pid)
+	return nil
+}
+
+// containerExited cleans up the container with the given ID after its init
+// process, with the given pid, has exited with the given state, and then runs
+// the exit hooks of the init process and of the container. The exit hooks are
+// run once the init process's output and the container's remaining events have
+// been handled, and the container's are told whether it was killed by the OOM
+// killer. The init process's exit is recorded straight away, so that its pid,
+// which may be reused meanwhile, is no longer treated as its own.
+func (c *gcsCore) containerExited(id string, pid int, containerEntry *containerCacheEntry, processEntry *processCacheEntry, state oslayer.ProcessExitState) {
 	c.processCacheMutex.Lock()
-	// If a processCacheEntry with the given pid already exists in the cache,
-	// this will overwrite it. This behavior is expected. Processes are kept in
-	// the cache even after they exit, which allows for exit hooks registered
-	// on exited processed to still run. For example, if the HCS were to wait
-	// on a process which had already exited (due to a race condition between
-	// the wait call and the process exiting), the process's exit state would
-	// still be available to send back to the HCS. However, when pids are
-	// reused on the system, it makes sense to overwrite the old cache entry.
-	// This is because registering an exit hook on the pid and expecting it to
-	// apply to the old process no longer makes sense, so since the old
-	// process's pid has been reused, its cache entry can also be reused.  This
-	// applies to external processes as well.
-	c.processCache[pid] = processEntry
+	processEntry.recordExit(state)
 	c.processCacheMutex.Unlock()
-	containerEntry.AddProcess(pid)
-	return pid, nil
+
+	c.containerCacheMutex.Lock()
+	// An OOM kill causing the exit has to be found before the container's
+	// cgroup is removed along with it.
+	c.stopContainerEvents(id, containerEntry)
+	if err := c.CleanupContainer(id); err != nil {
+		logrus.Error(err)
+	}
+	eventsDone := containerEntry.eventsDone
+	c.containerCacheMutex.Unlock()
+	waitContainerEvents(id, eventsDone)
+	waitStdioDrained(pid, processEntry.stdioDrained)
+
+	c.processCacheMutex.Lock()
+	processEntry.runExitHooks()
+	c.processCacheMutex.Unlock()
+	c.containerCacheMutex.Lock()
+	containerState := containerExitState{ProcessExitState: state, oomKilled: containerEntry.OOMKilled}
+	containerEntry.ExitStatus = containerState
+	containerEntry.EventHooks = nil
+	for _, hook := range containerEntry.ExitHooks {
+		hook(containerState)
+	}
+	// A container restored from the journal which the host was waiting on is
+	// kept in the cache until the host registers an exit hook on it again.
+	if !containerEntry.ExitHookPending || len(containerEntry.ExitHooks) > 0 {
+		delete(c.containerCache, id)
+		c.journal.record(journalRecord{Op: journalContainerExited, ID: id, ExitCode: state.ExitCode()})
+	}
+	c.containerCacheMutex.Unlock()
 }
 
 // SignalContainer sends the specified signal to the container's init process.
@@ -309,20 +508,23 @@ func (c *gcsCore) SignalContainer(id string, signal oslayer.Signal) error {
 	return nil
 }
 
-// TerminateProcess sends a SIGTERM signal to the given process. If it does not
-// exit after a timeout, it then sends a SIGKILL.
-func (c *gcsCore) TerminateProcess(pid int) error {
+// TerminateProcess sends a SIGTERM signal to the process with the given pid and
+// start time. If it does not exit after a timeout, it then sends a SIGKILL. A
+// process which has already exited isn't signaled, since its pid may belong to
+// another process by now.
+func (c *gcsCore) TerminateProcess(pid int, startTime uint64) error {
 	c.processCacheMutex.Lock()
 	c.externalProcessCacheMutex.Lock()
-	if _, ok := c.processCache[pid]; !ok {
-		if _, ok := c.externalProcessCache[pid]; !ok {
-			c.processCacheMutex.Unlock()
-			c.externalProcessCacheMutex.Unlock()
-			return errors.WithStack(gcserr.NewProcessDoesNotExistError(pid))
-		}
-	}
+	entry, err := c.lookupProcess(pid, startTime)
+	exited := err == nil && entry.ExitStatus != nil
 	c.processCacheMutex.Unlock()
 	c.externalProcessCacheMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if exited {
+		return nil
+	}
 
 	// First, send the process a SIGTERM. If it doesn't exit before the
 	// specified timeout, send it a SIGKILL.
@@ -330,7 +532,7 @@ func (c *gcsCore) TerminateProcess(pid int) error {
 	exitHook := func(state oslayer.ProcessExitState) {
 		exitedChannel <- true
 	}
-	if err := c.RegisterProcessExitHook(pid, exitHook); err != nil {
+	if err := c.RegisterProcessExitHook(pid, startTime, exitHook); err != nil {
 		return errors.Wrapf(err, "failed to register exit hook during call to TerminateProcess for process %d", pid)
 	}
 	if err := c.OS.Kill(pid, syscall.SIGTERM); err != nil {
@@ -354,7 +556,8 @@ func (c *gcsCore) TerminateProcess(pid int) error {
 	return nil
 }
 
-// ListProcesses returns all container processes, even zombies.
+// ListProcesses returns all container processes, even zombies, along with
+// their details read from /proc.
 func (c *gcsCore) ListProcesses(id string) ([]runtime.ContainerProcessState, error) {
 	c.containerCacheMutex.Lock()
 	defer c.containerCacheMutex.Unlock()
@@ -367,14 +570,16 @@ func (c *gcsCore) ListProcesses(id string) ([]runtime.ContainerProcessState, err
 	if err != nil {
 		return nil, err
 	}
+	_, _, rootfsPath := c.getUnioningPaths(id)
+	c.addProcessDetails(processes, c.readUsers(filepath.Join(rootfsPath, "etc", "passwd")))
 	return processes, nil
 }
 
 // RunExternalProcess runs a process in the utility VM outside of a container's
 // namespace.
 // This can be used for things like debugging or diagnosing the utility VM's
-// state.
-func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *core.StdioSet) (pid int, err error) {
+// state. The process's pid and start time are returned.
+func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *core.StdioSet) (pid int, startTime uint64, err error) {
 	stdioOptions := runtime.StdioOptions{
 		CreateIn:  params.CreateStdInPipe,
 		CreateOut: params.CreateStdOutPipe,
@@ -390,17 +595,17 @@ func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *co
 		var consolePath string
 		master, consolePath, err = runc.NewConsole()
 		if err != nil {
-			return -1, errors.Wrap(err, "failed to create console for external process")
+			return -1, 0, errors.Wrap(err, "failed to create console for external process")
 		}
 		console, err = c.OS.OpenFile(consolePath, os.O_RDWR, 0777)
 		if err != nil {
-			return -1, errors.Wrap(err, "failed to open console file for external process")
+			return -1, 0, errors.Wrap(err, "failed to open console file for external process")
 		}
 	}
 
 	ociProcess, err := processParametersToOCI(params)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 	cmd := c.OS.Command(ociProcess.Args[0], ociProcess.Args[1:]...)
 	cmd.SetDir(ociProcess.Cwd)
@@ -436,7 +641,7 @@ func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *co
 			// closing the pipe after the process exits.
 			cmdStdin, err := cmd.StdinPipe()
 			if err != nil {
-				return -1, errors.Wrap(err, "failed to get stdin pipe for command")
+				return -1, 0, errors.Wrap(err, "failed to get stdin pipe for command")
 			}
 			wg.Add(1)
 			go func() {
@@ -453,10 +658,11 @@ func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *co
 		}
 	}
 	if err := cmd.Start(); err != nil {
-		return -1, errors.Wrap(err, "failed call to Start for external process")
+		return -1, 0, errors.Wrap(err, "failed call to Start for external process")
 	}
 
 	processEntry := newProcessCacheEntry()
+	processEntry.Command = ociProcess.Args
 	go func() {
 		if err := cmd.Wait(); err != nil {
 			// TODO: When cmd is a shell, and last command in the shell
@@ -467,6 +673,10 @@ func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *co
 			logrus.Error(errors.Wrap(err, "failed call to Wait for external process"))
 		}
 		utils.LogMsgf("external process %d exited with exit status %d", cmd.Process().Pid(), cmd.ExitState().ExitCode())
+		state := cmd.ExitState()
+		c.externalProcessCacheMutex.Lock()
+		processEntry.recordExit(state)
+		c.externalProcessCacheMutex.Unlock()
 
 		// Close stdin so that the copying goroutine is safely unblocked; this is necessary
 		// because the host expects stdin to be closed before it will report process
@@ -500,20 +710,15 @@ func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *co
 		}
 
 		// Run exit hooks for the process.
-		state := cmd.ExitState()
 		c.externalProcessCacheMutex.Lock()
-		processEntry.ExitStatus = state
-		for _, hook := range processEntry.ExitHooks {
-			hook(state)
-		}
+		processEntry.runExitHooks()
 		c.externalProcessCacheMutex.Unlock()
+		c.journal.record(journalRecord{Op: journalProcessExited, Pid: cmd.Process().Pid(), ExitCode: state.ExitCode()})
 	}()
 
 	pid = cmd.Process().Pid()
-	c.externalProcessCacheMutex.Lock()
-	c.externalProcessCache[pid] = processEntry
-	c.externalProcessCacheMutex.Unlock()
-	return pid, nil
+	c.processStarted("", pid, processEntry)
+	return pid, processEntry.StartTime, nil
 }
 
 // ModifySettings takes the given request and performs the modification it
@@ -523,16 +728,21 @@ func (c *gcsCore) ModifySettings(id string, request prot.ResourceModificationReq
 	c.containerCacheMutex.Lock()
 	defer c.containerCacheMutex.Unlock()
 
-	if _, ok := c.containerCache[id]; !ok {
+	containerEntry, ok := c.containerCache[id]
+	if !ok {
 		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
 	}
+	// The checkpoint image is written to a mapped virtual disk, which must
+	// stay attached until it is done.
+	if containerEntry.checkpointing {
+		return errors.Errorf("the settings of container %s cannot be modified while it is being checkpointed", id)
+	}
 
 	switch request.RequestType {
 	case prot.RtAdd:
 		if request.ResourceType != prot.PtMappedVirtualDisk {
 			return errors.Errorf("only the resource type \"%s\" is currently supported for request type \"%s\"", prot.PtMappedVirtualDisk, request.RequestType)
 		}
-		containerEntry := c.containerCache[id]
 		settings, ok := request.Settings.(prot.ResourceModificationSettings)
 		if !ok {
 			return errors.New("the request's settings are not of type ResourceModificationSettings")
@@ -540,11 +750,11 @@ func (c *gcsCore) ModifySettings(id string, request prot.ResourceModificationReq
 		if err := c.setupMappedVirtualDisks(id, []prot.MappedVirtualDisk{*settings.MappedVirtualDisk}, containerEntry); err != nil {
 			return errors.Wrapf(err, "failed to hot add mapped virtual disk for container %s", id)
 		}
+		c.journal.record(journalRecord{Op: journalAttachMappedVirtualDisk, ID: id, MappedVirtualDisks: []prot.MappedVirtualDisk{*settings.MappedVirtualDisk}})
 	case prot.RtRemove:
 		if request.ResourceType != prot.PtMappedVirtualDisk {
 			return errors.Errorf("only the resource type \"%s\" is currently supported for request type \"%s\"", prot.PtMappedVirtualDisk, request.RequestType)
 		}
-		containerEntry := c.containerCache[id]
 		settings, ok := request.Settings.(prot.ResourceModificationSettings)
 		if !ok {
 			return errors.New("the request's settings are not of type ResourceModificationSettings")
@@ -552,6 +762,7 @@ func (c *gcsCore) ModifySettings(id string, request prot.ResourceModificationReq
 		if err := c.removeMappedVirtualDisks(id, []prot.MappedVirtualDisk{*settings.MappedVirtualDisk}, containerEntry); err != nil {
 			return errors.Wrapf(err, "failed to hot remove mapped virtual disk for container %s", id)
 		}
+		c.journal.record(journalRecord{Op: journalDetachMappedVirtualDisk, ID: id, MappedVirtualDisks: []prot.MappedVirtualDisk{*settings.MappedVirtualDisk}})
 	default:
 		return errors.Errorf("the request type \"%s\" is not yet supported", request.RequestType)
 	}
@@ -577,48 +788,56 @@ func (c *gcsCore) RegisterContainerExitHook(id string, exitHook func(oslayer.Pro
 	// Otherwise, add it to the container's hook list.
 	if exitStatus != nil {
 		exitHook(exitStatus)
+		// Only containers restored from the journal are kept in the cache
+		// after exiting, until the host has been told of their exit.
+		delete(c.containerCache, id)
+		c.journal.record(journalRecord{Op: journalContainerExited, ID: id, ExitCode: exitStatus.ExitCode()})
 	} else {
 		entry.AddExitHook(exitHook)
+		c.journal.record(journalRecord{Op: journalRegisterExitHook, ID: id})
 	}
 	return nil
 }
 
 // RegisterProcessExitHook registers an exit hook on the process with the given
-// pid. When the process exits, the given exit function will be called. if the
-// process has already exited, the function will be called immediately. A
-// process may have multiple exit hooks registered for it.
+// pid and start time. When the process exits, the given exit function will be
+// called. if the process has already exited, the function will be called
+// immediately, as long as its cache entry hasn't expired. A process may have
+// multiple exit hooks registered for it.
 // This function works for both processes that are running in a container, and
 // ones that are running externally to a container.
-func (c *gcsCore) RegisterProcessExitHook(pid int, exitHook func(oslayer.ProcessExitState)) error {
+func (c *gcsCore) RegisterProcessExitHook(pid int, startTime uint64, exitHook func(oslayer.ProcessExitState)) error {
 	c.processCacheMutex.Lock()
 	defer c.processCacheMutex.Unlock()
 	c.externalProcessCacheMutex.Lock()
 	defer c.externalProcessCacheMutex.Unlock()
 
-	var entry *processCacheEntry
-	var ok bool
-	entry, ok = c.processCache[pid]
-	if !ok {
-		entry, ok = c.externalProcessCache[pid]
-		if !ok {
-			return errors.WithStack(gcserr.NewProcessDoesNotExistError(pid))
-		}
+	entry, err := c.lookupProcess(pid, startTime)
+	if err != nil {
+		return err
 	}
 
 	exitStatus := entry.ExitStatus
 	// If the process has already exited, run the hook immediately.  Otherwise,
-	// add it to the process's hook list.
-	if exitStatus != nil {
+	// add it to the process's hook list, as is done while the process's exit
+	// hooks wait for its output to be sent.
+	if exitStatus != nil && !entry.exitHooksDelayed {
 		exitHook(exitStatus)
+		if entry.ExitHookPending {
+			entry.ExitHookPending = false
+			c.journal.record(journalRecord{Op: journalProcessExited, Pid: pid, ExitCode: exitStatus.ExitCode()})
+		}
 	} else {
 		entry.AddExitHook(exitHook)
+		c.journal.record(journalRecord{Op: journalRegisterExitHook, Pid: pid})
 	}
 	return nil
 }
 
 // setupStdioPipes begins copying data between each stdioSet reader/writer and
-// the container's stdio pipes.
-func (c *gcsCore) setupStdioPipes(id string, pid int, stdioSet *core.StdioSet) error {
+// the container's stdio pipes. drained is closed once the process's stdout and
+// stderr have been copied in full.
+func (c *gcsCore) setupStdioPipes(id string, pid int, stdioSet *core.StdioSet, drained chan struct{}) error {
 	pipes, err := c.Rtime.GetStdioPipes(id, pid)
 	if err != nil {
 		return err
@@ -630,37 +849,62 @@ func (c *gcsCore) setupStdioPipes(id string, pid int, stdioSet *core.StdioSet) e
 			stdioSet.In.Close()
 		}()
 	}
+	var wg sync.WaitGroup
 	if pipes.Out != nil {
+		wg.Add(1)
 		go func() {
 			io.Copy(stdioSet.Out, pipes.Out)
 			pipes.Out.Close()
 			stdioSet.Out.Close()
+			wg.Done()
 		}()
 	}
 	if pipes.Err != nil {
+		wg.Add(1)
 		go func() {
 			io.Copy(stdioSet.Err, pipes.Err)
 			pipes.Err.Close()
 			stdioSet.Err.Close()
+			wg.Done()
 		}()
 	}
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
 
 	return nil
 }
 
-// setupMappedVirtualDisks is a helper function which calls into the functions
-// in storage.go to set up a set of mapped virtual disks for a given container.
-// It then adds them to the container's cache entry.
-// This function expects containerCacheMutex to be locked on entry.
-func (c *gcsCore) setupMappedVirtualDisks(id string, disks []prot.MappedVirtualDisk, containerEntry *containerCacheEntry) error {
-	devices, err := c.getMappedVirtualDiskDevices(disks)
-	if err != nil {
-		return errors.Wrapf(err, "failed to get mapped virtual disk devices for container %s", id)
+// waitStdioDrained waits up to stdioDrainTimeout for the stdout and stderr of
+// the process with the given pid to have been copied to their connections once
+// it has exited, so that its exit hooks don't close the connections before the
+// last of its output has been sent. drained is the channel closed by
+// setupStdioPipes once they have, or nil if the process's stdio isn't
+// forwarded.
+func waitStdioDrained(pid int, drained <-chan struct{}) {
+	if drained == nil {
+		return
 	}
-	if err := c.mountMappedVirtualDisks(disks, devices); err != nil {
-		return errors.Wrapf(err, "failed to mount mapped virtual disks for container %s", id)
+	select {
+	case <-drained:
+	case <-time.After(stdioDrainTimeout):
+		logrus.Warnf("timed out waiting for the output of process %d to be sent", pid)
 	}
+}
+
+// setupMappedVirtualDisks is a helper function which attaches a set of mapped
+// virtual disks to a given container, mounting any disks which aren't already
+// mounted in the utility VM. It then adds them to the container's cache entry.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) setupMappedVirtualDisks(id string, disks []prot.MappedVirtualDisk, containerEntry *containerCacheEntry) error {
 	for _, disk := range disks {
+		if _, ok := containerEntry.MappedVirtualDisks[mappedVirtualDiskScsiAddress(disk)]; ok {
+			return errors.Errorf("a mapped virtual disk with controller %d, lun %d is already attached to container %s", disk.Controller, disk.Lun, id)
+		}
+		if err := c.attachMappedVirtualDisk(disk); err != nil {
+			return errors.Wrapf(err, "failed to attach mapped virtual disk %s, controller %d, lun %d to container %s", disk.ContainerPath, disk.Controller, disk.Lun, id)
+		}
 		if err := containerEntry.AddMappedVirtualDisk(disk); err != nil {
 			return err
 		}
@@ -668,19 +912,112 @@ func (c *gcsCore) setupMappedVirtualDisks(id string, disks []prot.MappedVirtualD
 	return nil
 }
 
-// removeMappedVirtualDisks is a helper function which calls into the functions
-// in storage.go to unmount a set of mapped virtual disks for a given
-// container. It then removes them from the container's cache entry.
+// removeMappedVirtualDisks is a helper function which detaches a set of mapped
+// virtual disks from a given container so that the host can hot-remove them.
+// Since the host removes the whole SCSI device, each disk is unmounted and
+// detached from the utility VM even if other containers are still using it,
+// and is removed from the cache entries of those containers as well as the
+// given one.
 // This function expects containerCacheMutex to be locked on entry.
 func (c *gcsCore) removeMappedVirtualDisks(id string, disks []prot.MappedVirtualDisk, containerEntry *containerCacheEntry) error {
-	if err := c.unmountMappedVirtualDisks(disks); err != nil {
-		return errors.Wrapf(err, "failed to mount mapped virtual disks for container %s", id)
-	}
 	for _, disk := range disks {
+		address := mappedVirtualDiskScsiAddress(disk)
+		attachedDisk, ok := containerEntry.MappedVirtualDisks[address]
+		if !ok {
+			return errors.Errorf("a mapped virtual disk with controller %d, lun %d is not attached to container %s", disk.Controller, disk.Lun, id)
+		}
+		if err := c.releaseMappedVirtualDisk(attachedDisk, true); err != nil {
+			return errors.Wrapf(err, "failed to detach mapped virtual disk %s, controller %d, lun %d from container %s", attachedDisk.ContainerPath, attachedDisk.Controller, attachedDisk.Lun, id)
+		}
 		if err := containerEntry.RemoveMappedVirtualDisk(disk); err != nil {
 			return err
 		}
+		for otherID, otherEntry := range c.containerCache {
+			otherDisk, ok := otherEntry.MappedVirtualDisks[address]
+			if otherID == id || !ok {
+				continue
+			}
+			logrus.Warnf("mapped virtual disk %s, controller %d, lun %d was hot-removed while still attached to container %s", otherDisk.ContainerPath, otherDisk.Controller, otherDisk.Lun, otherID)
+			delete(otherEntry.MappedVirtualDisks, address)
+			c.journal.record(journalRecord{Op: journalDetachMappedVirtualDisk, ID: otherID, MappedVirtualDisks: []prot.MappedVirtualDisk{otherDisk}})
+		}
+	}
+	return nil
+}
+
+// attachMappedVirtualDisk adds a reference to the given disk in the
+// mappedVirtualDiskCache, mounting it if this is the first reference. A disk
+// which is already mounted may only be shared if both it and the new
+// attachment are read-only.
+func (c *gcsCore) attachMappedVirtualDisk(disk prot.MappedVirtualDisk) error {
+	c.mappedVirtualDiskCacheMutex.Lock()
+	defer c.mappedVirtualDiskCacheMutex.Unlock()
+
+	key := newMappedVirtualDiskKey(disk)
+	for otherKey, entry := range c.mappedVirtualDiskCache {
+		if otherKey.Address != key.Address {
+			continue
+		}
+		if !disk.ReadOnly || !entry.Disk.ReadOnly {
+			return errors.Errorf("controller %d, lun %d is already mounted at %s, and only read-only disks may be shared", entry.Disk.Controller, entry.Disk.Lun, entry.Disk.ContainerPath)
+		}
+	}
+	if entry, ok := c.mappedVirtualDiskCache[key]; ok {
+		entry.RefCount++
+		return nil
+	}
+
+	devices, err := c.getMappedVirtualDiskDevices([]prot.MappedVirtualDisk{disk})
+	if err != nil {
+		return err
+	}
+	if err := c.mountMappedVirtualDisks([]prot.MappedVirtualDisk{disk}, devices); err != nil {
+		return err
+	}
+	c.mappedVirtualDiskCache[key] = &mappedVirtualDiskCacheEntry{Disk: disk, RefCount: 1}
+	return nil
+}
+
+// releaseMappedVirtualDisk removes a reference to the given disk from the
+// mappedVirtualDiskCache, unmounting it if this was the last reference. If
+// detach is true, the host is about to hot-remove the disk, so every mount of
+// its SCSI address is flushed and unmounted regardless of its references, and
+// its SCSI device is removed from the utility VM.
+func (c *gcsCore) releaseMappedVirtualDisk(disk prot.MappedVirtualDisk, detach bool) error {
+	c.mappedVirtualDiskCacheMutex.Lock()
+	defer c.mappedVirtualDiskCacheMutex.Unlock()
+
+	key := newMappedVirtualDiskKey(disk)
+	entry, ok := c.mappedVirtualDiskCache[key]
+	if !ok {
+		return errors.Errorf("mapped virtual disk %s, controller %d, lun %d is not mounted", disk.ContainerPath, disk.Controller, disk.Lun)
+	}
+	if detach {
+		var keys []mappedVirtualDiskKey
+		var disks []prot.MappedVirtualDisk
+		for otherKey, otherEntry := range c.mappedVirtualDiskCache {
+			if otherKey.Address == key.Address {
+				keys = append(keys, otherKey)
+				disks = append(disks, otherEntry.Disk)
+			}
+		}
+		sort.Slice(disks, func(i, j int) bool { return disks[i].ContainerPath < disks[j].ContainerPath })
+		if err := c.detachMappedVirtualDisk(disks); err != nil {
+			return err
+		}
+		for _, otherKey := range keys {
+			delete(c.mappedVirtualDiskCache, otherKey)
+		}
+		return nil
+	}
+	if entry.RefCount > 1 {
+		entry.RefCount--
+		return nil
+	}
+	if err := c.unmountMappedVirtualDisks([]prot.MappedVirtualDisk{entry.Disk}); err != nil {
+		return err
 	}
+	delete(c.mappedVirtualDiskCache, key)
 	return nil
 }
 
@@ -1,11 +1,23 @@
 package gcs
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
 
 	"github.com/Microsoft/opengcs/service/gcs/core"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
@@ -13,6 +25,7 @@ import (
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	gcsverity "github.com/Microsoft/opengcs/service/gcsutils/verity"
 )
 
 var _ = Describe("GCS", func() {
@@ -561,6 +574,759 @@ var _ = Describe("GCS", func() {
 			})
 		})
 
+		Describe("calling probeFilesystemType", func() {
+			var (
+				superblock []byte
+				fsType     string
+			)
+			BeforeEach(func() {
+				superblock = make([]byte, superblockProbeSize)
+			})
+			JustBeforeEach(func() {
+				fsType, err = probeFilesystemType(bytes.NewReader(superblock))
+			})
+			Context("the device is blank", func() {
+				AssertNoError()
+				It("should not recognize a filesystem", func() {
+					Expect(fsType).To(BeEmpty())
+				})
+			})
+			Context("the device contains ext4", func() {
+				BeforeEach(func() {
+					superblock[1080] = 0x53
+					superblock[1081] = 0xEF
+				})
+				AssertNoError()
+				It("should detect ext4", func() {
+					Expect(fsType).To(Equal("ext4"))
+				})
+			})
+			Context("the device contains xfs", func() {
+				BeforeEach(func() {
+					copy(superblock, "XFSB")
+				})
+				AssertNoError()
+				It("should detect xfs", func() {
+					Expect(fsType).To(Equal("xfs"))
+				})
+			})
+			Context("the device contains squashfs", func() {
+				BeforeEach(func() {
+					copy(superblock, "hsqs")
+				})
+				AssertNoError()
+				It("should detect squashfs", func() {
+					Expect(fsType).To(Equal("squashfs"))
+				})
+			})
+			Context("the device contains FAT32", func() {
+				BeforeEach(func() {
+					copy(superblock[82:], "FAT32   ")
+					superblock[510] = 0x55
+					superblock[511] = 0xAA
+				})
+				AssertNoError()
+				It("should detect vfat", func() {
+					Expect(fsType).To(Equal("vfat"))
+				})
+			})
+			Context("the device contains FAT16", func() {
+				BeforeEach(func() {
+					copy(superblock[54:], "FAT16   ")
+					superblock[510] = 0x55
+					superblock[511] = 0xAA
+				})
+				AssertNoError()
+				It("should detect vfat", func() {
+					Expect(fsType).To(Equal("vfat"))
+				})
+			})
+			Context("the device is smaller than the probe size", func() {
+				BeforeEach(func() {
+					superblock = []byte("hsqs")
+				})
+				AssertNoError()
+				It("should still detect the filesystem", func() {
+					Expect(fsType).To(Equal("squashfs"))
+				})
+			})
+		})
+
+		Describe("calling isBlank", func() {
+			Context("the data is all zeros", func() {
+				It("should be blank", func() {
+					Expect(isBlank(make([]byte, blankProbeSize))).To(BeTrue())
+				})
+			})
+			Context("the data has a non-zero byte past the superblock probe size", func() {
+				It("should not be blank", func() {
+					data := make([]byte, blankProbeSize)
+					data[64*1024+64] = 'B'
+					Expect(isBlank(data)).To(BeFalse())
+				})
+			})
+		})
+
+		Describe("calling mkfsExt4Args", func() {
+			Context("no options are given", func() {
+				It("should only pass the device", func() {
+					Expect(mkfsExt4Args("/dev/sdb", nil)).To(Equal([]string{"-q", "/dev/sdb"}))
+				})
+			})
+			Context("all options are given", func() {
+				It("should pass each option and the size after the device", func() {
+					options := &prot.SandboxFormatOptions{
+						SizeInMB:   1024,
+						BlockSize:  4096,
+						InodeSize:  256,
+						InodeCount: 65536,
+					}
+					Expect(mkfsExt4Args("/dev/sdb", options)).To(Equal([]string{
+						"-q", "-b", "4096", "-I", "256", "-N", "65536", "/dev/sdb", "1024M",
+					}))
+				})
+			})
+		})
+
+		Describe("calling cryptTable", func() {
+			It("should map the whole device through dm-crypt with the hex-encoded key", func() {
+				key := []byte{0x00, 0x01, 0xfe, 0xff}
+				Expect(cryptTable(2048, key, "/dev/sdb")).To(Equal("0 2048 crypt aes-xts-plain64 0001feff 0 /dev/sdb 0\n"))
+			})
+		})
+
+		Describe("calling verityTable", func() {
+			var (
+				verity prot.LayerVerity
+				table  string
+			)
+			BeforeEach(func() {
+				verity = prot.LayerVerity{
+					RootDigest:        strings.Repeat("ab", 32),
+					Salt:              "0123",
+					HashOffsetInBytes: 8 * 4096,
+				}
+			})
+			JustBeforeEach(func() {
+				table, err = verityTable("/dev/sdb", &verity)
+			})
+			Context("the hash tree is valid", func() {
+				AssertNoError()
+				It("should verify the data before the tree against the tree", func() {
+					Expect(table).To(Equal("0 64 verity 1 /dev/sdb /dev/sdb 4096 4096 8 8 sha256 " + verity.RootDigest + " 0123\n"))
+				})
+			})
+			Context("the hash tree has no salt", func() {
+				BeforeEach(func() {
+					verity.Salt = ""
+				})
+				AssertNoError()
+				It("should pass an empty salt", func() {
+					Expect(table).To(HaveSuffix(" -\n"))
+				})
+			})
+			Context("the root digest is too short", func() {
+				BeforeEach(func() {
+					verity.RootDigest = "abcd"
+				})
+				AssertError()
+			})
+			Context("the hash offset is not block aligned", func() {
+				BeforeEach(func() {
+					verity.HashOffsetInBytes = 4097
+				})
+				AssertError()
+			})
+			Context("the hash tree was appended by gcstools", func() {
+				BeforeEach(func() {
+					f, err := ioutil.TempFile("", "verity")
+					Expect(err).NotTo(HaveOccurred())
+					defer os.Remove(f.Name())
+					defer f.Close()
+					_, err = f.Write(make([]byte, 3*4096+1))
+					Expect(err).NotTo(HaveOccurred())
+					appended, err := gcsverity.AppendHashTree(f)
+					Expect(err).NotTo(HaveOccurred())
+					verity = *appended
+				})
+				AssertNoError()
+				It("should verify the padded data against the tree", func() {
+					Expect(table).To(Equal("0 32 verity 1 /dev/sdb /dev/sdb 4096 4096 4 4 sha256 " + verity.RootDigest + " " + verity.Salt + "\n"))
+				})
+			})
+		})
+
+		Describe("calling verityTableRootDigest", func() {
+			Context("the table is a dm-verity table", func() {
+				It("should return the root digest", func() {
+					digest, err := verityTableRootDigest("0 64 verity 1 8:16 8:16 4096 4096 8 8 sha256 abcd 0123\n")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(digest).To(Equal("abcd"))
+				})
+			})
+			Context("the table is not a dm-verity table", func() {
+				It("should produce an error", func() {
+					_, err := verityTableRootDigest("0 2048 crypt aes-xts-plain64 0001feff 0 8:16 0\n")
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
+		Describe("calling parseMounts", func() {
+			It("should parse each mount and find the lower directories of overlays", func() {
+				mounts := parseMounts([]byte("/dev/sdb /mnt/gcs/layers/sdb ext4 ro,relatime,noload 0 0\n" +
+					"overlay /mnt/gcs/abc/rootfs overlay rw,lowerdir=/mnt/gcs/layers/sdb:/mnt/gcs/l/sdc:/tmp/base,upperdir=/mnt/gcs/abc/scratch/upper 0 0\n"))
+				Expect(mounts).To(HaveLen(2))
+				Expect(mounts[0]).To(Equal(mountEntry{
+					Source:  "/dev/sdb",
+					Target:  "/mnt/gcs/layers/sdb",
+					FSType:  "ext4",
+					Options: []string{"ro", "relatime", "noload"},
+				}))
+				mount, ok := findMount(mounts, "/mnt/gcs/abc/rootfs")
+				Expect(ok).To(BeTrue())
+				Expect(overlayLowerDirs(mount)).To(Equal([]string{"/mnt/gcs/layers/sdb", "/mnt/gcs/l/sdc", "/tmp/base"}))
+			})
+		})
+
+		Describe("calling parseProcStat", func() {
+			Context("the command name contains spaces and parentheses", func() {
+				It("should find the state and start time after the command name", func() {
+					stat := "42 (my (odd) cmd) S 1 42 42 0 -1 4194560 100 0 0 0 1 2 0 0 20 0 1 0 98765 1000 10 18446744073709551615\n"
+					state, startTime, err := parseProcStat([]byte(stat))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(state).To(Equal("S"))
+					Expect(startTime).To(Equal(uint64(98765)))
+				})
+			})
+			Context("the stat is truncated", func() {
+				It("should produce an error", func() {
+					_, _, err := parseProcStat([]byte("42 (cmd) S 1 42"))
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
+		Describe("calling parseProcStatDetails", func() {
+			It("should parse the details of the process", func() {
+				stat := "42 (my (odd) cmd) S 1 42 42 0 -1 4194560 100 0 0 0 150 50 0 0 20 0 4 0 98765 1000 10 18446744073709551615\n"
+				details, err := parseProcStatDetails([]byte(stat))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(details).To(Equal(&procStat{
+					State:       "S",
+					ParentPid:   1,
+					CPUTime:     2 * time.Second,
+					ThreadCount: 4,
+					StartTime:   98765,
+					RSS:         10,
+				}))
+			})
+			Context("the stat is truncated", func() {
+				It("should produce an error", func() {
+					_, err := parseProcStatDetails([]byte("42 (cmd) S 1 42"))
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+		Describe("calling parseProcStatusUID", func() {
+			It("should return the real user ID", func() {
+				status := "Name:\tcat\nState:\tR (running)\nPPid:\t1\nUid:\t1000\t0\t0\t0\nGid:\t0\t0\t0\t0\n"
+				uid, err := parseProcStatusUID([]byte(status))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(uid).To(Equal(1000))
+			})
+			It("should produce an error without a Uid field", func() {
+				_, err := parseProcStatusUID([]byte("Name:\tcat\n"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Describe("calling parseBootTime", func() {
+			It("should return the boot time", func() {
+				bootTime, err := parseBootTime([]byte("cpu  1 2 3 4\nintr 100\nbtime 1500000000\nprocesses 10\n"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bootTime).To(Equal(time.Unix(1500000000, 0).UTC()))
+			})
+			It("should produce an error without a btime line", func() {
+				_, err := parseBootTime([]byte("cpu  1 2 3 4\n"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Describe("calling parsePasswd", func() {
+			It("should map user IDs to the first name using them", func() {
+				passwd := "root:x:0:0:root:/root:/bin/sh\nbroken\nnobody:x:65534:65534::/:/sbin/nologin\ntoor:x:0:0::/:/bin/sh\n"
+				Expect(parsePasswd([]byte(passwd))).To(Equal(map[int]string{
+					0:     "root",
+					65534: "nobody",
+				}))
+			})
+		})
+
+		Describe("calling detachMappedVirtualDisk", func() {
+			var (
+				recorder *recordingOS
+				coreint  *gcsCore
+				disks    []prot.MappedVirtualDisk
+			)
+			BeforeEach(func() {
+				recorder = &recordingOS{OS: mockos.NewOS()}
+				coreint = NewGCSCore(mockruntime.NewRuntime(), recorder)
+				disks = []prot.MappedVirtualDisk{
+					{ContainerPath: "/mnt/disk0", Lun: 5, CreateInUtilityVM: true},
+					{ContainerPath: "/mnt/disk1", Lun: 5, CreateInUtilityVM: true},
+				}
+			})
+			It("should flush, unmount and delete the device, then wait for its removal", func() {
+				Expect(coreint.detachMappedVirtualDisk(disks)).To(Succeed())
+				Expect(recorder.calls).To(Equal([]string{
+					"sync",
+					"flush /dev/sda",
+					"unmount /mnt/disk0",
+					"unmount /mnt/disk1",
+					"write /sys/bus/scsi/devices/0:0:0:5/delete 1",
+					"wait for removal of sda",
+				}))
+			})
+			It("should fail if the device can't be flushed", func() {
+				recorder.flushErr = errors.New("flush failed")
+				Expect(coreint.detachMappedVirtualDisk(disks)).NotTo(Succeed())
+				Expect(recorder.calls).To(Equal([]string{"sync", "flush /dev/sda"}))
+			})
+			It("should fail if the device can't be deleted", func() {
+				recorder.writeErr = errors.New("write failed")
+				Expect(coreint.detachMappedVirtualDisk(disks)).NotTo(Succeed())
+				Expect(recorder.calls).NotTo(ContainElement("wait for removal of sda"))
+			})
+			It("should fail if the device isn't removed in time", func() {
+				recorder.removalErr = context.DeadlineExceeded
+				err := coreint.detachMappedVirtualDisk(disks)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("was not removed"))
+			})
+		})
+
+		Describe("calling pruneProcessCache", func() {
+			It("should only remove the processes which exited before the retention window", func() {
+				now := time.Now()
+				expired := now.Add(-exitedProcessRetention)
+				cache := map[int]*processCacheEntry{
+					10: &processCacheEntry{},
+					11: &processCacheEntry{ExitStatus: mockos.NewProcessExitState(0), ExitTime: now},
+					12: &processCacheEntry{ExitStatus: mockos.NewProcessExitState(0), ExitTime: expired},
+					13: &processCacheEntry{ExitStatus: mockos.NewProcessExitState(0), ExitTime: expired, ExitHookPending: true},
+				}
+				pruneProcessCache(cache, now)
+				Expect(cache).To(HaveLen(3))
+				Expect(cache).To(HaveKey(10))
+				Expect(cache).To(HaveKey(11))
+				Expect(cache).To(HaveKey(13))
+			})
+		})
+
+		Describe("calling parseMeminfo", func() {
+			It("should return the total and available memory in bytes", func() {
+				meminfo := "MemTotal:        2048000 kB\nMemFree:          512000 kB\nMemAvailable:    1024000 kB\nHugePages_Total:       0\n"
+				total, available, err := parseMeminfo([]byte(meminfo))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(total).To(Equal(uint64(2048000 * 1024)))
+				Expect(available).To(Equal(uint64(1024000 * 1024)))
+			})
+			It("should fail if the available memory is missing", func() {
+				_, _, err := parseMeminfo([]byte("MemTotal:        2048000 kB\n"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Describe("calling parseLoadAverage", func() {
+			It("should return the three load averages", func() {
+				loadAverage, err := parseLoadAverage([]byte("0.50 0.25 0.10 1/123 4567\n"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(loadAverage).To(Equal([3]float64{0.5, 0.25, 0.1}))
+			})
+			It("should fail on too few fields", func() {
+				_, err := parseLoadAverage([]byte("0.50 0.25\n"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Describe("calling parseUptime", func() {
+			It("should return the uptime in seconds", func() {
+				uptime, err := parseUptime([]byte("350735.47 234388.90\n"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(uptime).To(Equal(350735.47))
+			})
+			It("should fail on empty contents", func() {
+				_, err := parseUptime(nil)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Describe("calling parseCgroupValue", func() {
+			It("should parse a value", func() {
+				value, err := parseCgroupValue([]byte("1073741824\n"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal(uint64(1073741824)))
+			})
+			It("should parse max as unlimited", func() {
+				value, err := parseCgroupValue([]byte("max\n"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(BeZero())
+			})
+			It("should fail on an invalid value", func() {
+				_, err := parseCgroupValue([]byte("-1\n"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Describe("calling parseCgroupKeyedValues", func() {
+			It("should parse cpu.stat", func() {
+				values, err := parseCgroupKeyedValues([]byte("usage_usec 2500\nuser_usec 2000\nsystem_usec 500\n"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(values).To(Equal(map[string]uint64{
+					"usage_usec":  2500,
+					"user_usec":   2000,
+					"system_usec": 500,
+				}))
+			})
+			It("should parse memory.oom_control", func() {
+				values, err := parseCgroupKeyedValues([]byte("oom_kill_disable 0\nunder_oom 0\noom_kill 2\n"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(values["oom_kill"]).To(Equal(uint64(2)))
+			})
+			It("should ignore lines which aren't a key and a value", func() {
+				values, err := parseCgroupKeyedValues([]byte("some avg10=0.00 avg60=0.00\nanon 4096\n"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(values).To(Equal(map[string]uint64{"anon": 4096}))
+			})
+			It("should fail on an invalid value", func() {
+				_, err := parseCgroupKeyedValues([]byte("anon lots\n"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Describe("calling readCgroupV1Stats", func() {
+			var (
+				files map[string]string
+				stats *cgroupStats
+			)
+			BeforeEach(func() {
+				files = map[string]string{
+					"/sys/fs/cgroup/cpuacct/gcs/a/cpuacct.usage":            "2500\n",
+					"/sys/fs/cgroup/memory/gcs/a/memory.usage_in_bytes":     "8192\n",
+					"/sys/fs/cgroup/memory/gcs/a/memory.max_usage_in_bytes": "16384\n",
+					"/sys/fs/cgroup/memory/gcs/a/memory.limit_in_bytes":     "9223372036854771712\n",
+					"/sys/fs/cgroup/memory/gcs/a/memory.stat":               "total_inactive_file 4096\n",
+					"/sys/fs/cgroup/memory/gcs/a/memory.oom_control":        "oom_kill_disable 0\nunder_oom 0\noom_kill 2\n",
+					"/sys/fs/cgroup/pids/gcs/a/pids.current":                "3\n",
+					"/sys/fs/cgroup/pids/gcs/a/pids.max":                    "max\n",
+				}
+			})
+			JustBeforeEach(func() {
+				c := &gcsCore{OS: cgroupFilesOS{files: files}}
+				stats, err = c.readCgroupV1Stats(containerCgroupPath("a"))
+			})
+			Context("every controller is mounted", func() {
+				AssertNoError()
+				It("should read every value", func() {
+					Expect(*stats).To(Equal(cgroupStats{
+						CPUUsage:         2500,
+						MemoryUsage:      8192,
+						MemoryMaxUsage:   16384,
+						MemoryWorkingSet: 4096,
+						Pids:             3,
+						OOMKills:         2,
+					}))
+				})
+			})
+			Context("the pids and cpuacct controllers are not mounted", func() {
+				BeforeEach(func() {
+					delete(files, "/sys/fs/cgroup/cpuacct/gcs/a/cpuacct.usage")
+					delete(files, "/sys/fs/cgroup/pids/gcs/a/pids.current")
+					delete(files, "/sys/fs/cgroup/pids/gcs/a/pids.max")
+				})
+				AssertNoError()
+				It("should leave their values 0", func() {
+					Expect(stats.CPUUsage).To(BeZero())
+					Expect(stats.Pids).To(BeZero())
+					Expect(stats.MemoryUsage).To(Equal(uint64(8192)))
+					Expect(stats.OOMKills).To(Equal(uint64(2)))
+				})
+			})
+			Context("the peak memory usage is not tracked", func() {
+				BeforeEach(func() {
+					delete(files, "/sys/fs/cgroup/memory/gcs/a/memory.max_usage_in_bytes")
+				})
+				AssertNoError()
+				It("should leave it 0", func() {
+					Expect(stats.MemoryMaxUsage).To(BeZero())
+				})
+			})
+			Context("the memory controller is not mounted", func() {
+				BeforeEach(func() {
+					delete(files, "/sys/fs/cgroup/memory/gcs/a/memory.usage_in_bytes")
+				})
+				AssertError()
+			})
+			Context("the kernel doesn't count OOM kills", func() {
+				BeforeEach(func() {
+					files["/sys/fs/cgroup/memory/gcs/a/memory.oom_control"] = "oom_kill_disable 0\nunder_oom 1\n"
+				})
+				AssertNoError()
+				It("should report whether the cgroup is out of memory", func() {
+					Expect(stats.OOMKills).To(BeZero())
+					Expect(stats.UnderOOM).To(BeTrue())
+				})
+			})
+		})
+		Describe("calling checkOOMKills", func() {
+			var (
+				c              *gcsCore
+				containerEntry *containerCacheEntry
+				notifications  int
+			)
+			BeforeEach(func() {
+				c = &gcsCore{}
+				containerEntry = newContainerCacheEntry("a")
+				containerEntry.pollOOM = true
+				notifications = 0
+				containerEntry.AddEventHook(func(prot.ContainerNotification) {
+					notifications++
+				})
+			})
+			It("should notify when the OOM kill count grows", func() {
+				c.checkOOMKills(containerEntry, &cgroupStats{OOMKills: 0})
+				c.checkOOMKills(containerEntry, &cgroupStats{OOMKills: 2})
+				c.checkOOMKills(containerEntry, &cgroupStats{OOMKills: 2})
+				Expect(notifications).To(Equal(1))
+				Expect(containerEntry.OOMKilled).To(BeTrue())
+			})
+			It("should notify each time the cgroup runs out of memory on kernels which don't count OOM kills", func() {
+				for _, underOOM := range []bool{false, true, true, false, true} {
+					c.checkOOMKills(containerEntry, &cgroupStats{UnderOOM: underOOM})
+				}
+				Expect(notifications).To(Equal(2))
+				Expect(containerEntry.OOMKilled).To(BeTrue())
+			})
+			It("should not notify when the runtime reports OOM events", func() {
+				containerEntry.pollOOM = false
+				c.checkOOMKills(containerEntry, &cgroupStats{OOMKills: 1, UnderOOM: true})
+				Expect(notifications).To(BeZero())
+			})
+		})
+		Describe("calling workingSet", func() {
+			It("should subtract the inactive file cache", func() {
+				Expect(workingSet(4096, 1024)).To(Equal(uint64(3072)))
+			})
+			It("should not underflow", func() {
+				Expect(workingSet(1024, 4096)).To(BeZero())
+			})
+		})
+		Describe("calling replayJournal", func() {
+			var (
+				state *journaledState
+			)
+			disk0 := prot.MappedVirtualDisk{ContainerPath: "/disk0", Lun: 0, CreateInUtilityVM: true}
+			disk1 := prot.MappedVirtualDisk{ContainerPath: "/disk1", Lun: 1, CreateInUtilityVM: true}
+			adapter := prot.NetworkAdapter{AdapterInstanceID: "adapter"}
+			Context("the journal describes running and exited containers and processes", func() {
+				BeforeEach(func() {
+					state, err = replayJournal([]byte(`{"Op":"CreateContainer","ID":"a","MappedVirtualDisks":[{"ContainerPath":"/disk0","Lun":0,"CreateInUtilityVM":true}],"NetworkAdapters":[{"AdapterInstanceID":"adapter"}]}
+{"Op":"AttachMappedVirtualDisk","ID":"a","MappedVirtualDisks":[{"ContainerPath":"/disk1","Lun":1,"CreateInUtilityVM":true}]}
+{"Op":"MoveNetworkAdapter","ID":"a","NetworkAdapters":[{"AdapterInstanceID":"adapter"}]}
+{"Op":"StartProcess","ID":"a","Pid":10,"StartTime":100}
+{"Op":"RegisterExitHook","ID":"a"}
+{"Op":"StartProcess","ID":"a","Pid":11,"StartTime":110}
+{"Op":"RegisterExitHook","Pid":11}
+{"Op":"StartProcess","ID":"a","Pid":12,"StartTime":120}
+{"Op":"ProcessExited","ID":"a","Pid":12,"ExitCode":1}
+{"Op":"CreateContainer","ID":"b"}
+{"Op":"StartProcess","ID":"b","Pid":20}
+{"Op":"ContainerExited","ID":"b"}
+{"Op":"StartProcess","Pid":30,"StartTime":300}
+{"Op":"DetachMappedVirtualDisk","ID":"a","MappedVirtualDisks":[{"ContainerPath":"/disk0","Lun":0,"CreateInUtilityVM":true}]}
+{"Op":"StartPro`))
+				})
+				It("should not produce an error", func() {
+					Expect(err).NotTo(HaveOccurred())
+				})
+				It("should describe the containers and processes which haven't exited", func() {
+					Expect(state.Containers).To(HaveLen(1))
+					Expect(state.Containers["a"]).To(Equal(&journaledContainer{
+						MappedVirtualDisks:   []prot.MappedVirtualDisk{disk1},
+						NetworkAdapters:      []prot.NetworkAdapter{adapter},
+						MovedNetworkAdapters: []prot.NetworkAdapter{adapter},
+						Processes: []*journaledProcess{
+							{Pid: 10, StartTime: 100},
+							{Pid: 11, StartTime: 110, ExitHookPending: true},
+						},
+						ExitHookPending: true,
+					}))
+					Expect(state.ExternalProcesses).To(Equal(map[int]*journaledProcess{
+						30: {Pid: 30, StartTime: 300},
+					}))
+				})
+			})
+			Context("a record other than the last is corrupt", func() {
+				BeforeEach(func() {
+					state, err = replayJournal([]byte("{\"Op\":\"Create\n{\"Op\":\"CreateContainer\",\"ID\":\"a\"}\n"))
+				})
+				It("should produce an error", func() {
+					Expect(err).To(HaveOccurred())
+				})
+			})
+			Context("the journal is a snapshot of the caches", func() {
+				BeforeEach(func() {
+					coreint := NewGCSCore(mockruntime.NewRuntime(), mockos.NewOS())
+					entry := newContainerCacheEntry("a")
+					Expect(entry.AddMappedVirtualDisk(disk1)).To(Succeed())
+					Expect(entry.AddMappedVirtualDisk(disk0)).To(Succeed())
+					entry.AddNetworkAdapter(adapter)
+					entry.AddProcess(10)
+					entry.AddProcess(11)
+					entry.AddProcess(12)
+					entry.ExitHookPending = true
+					coreint.containerCache["a"] = entry
+					coreint.processCache[10] = &processCacheEntry{StartTime: 100}
+					coreint.processCache[11] = &processCacheEntry{StartTime: 110, ExitStatus: adoptedExitState{}, ExitHookPending: true}
+					coreint.processCache[12] = &processCacheEntry{StartTime: 120, ExitStatus: adoptedExitState{}}
+					coreint.externalProcessCache[30] = &processCacheEntry{StartTime: 300}
+					coreint.externalProcessCache[31] = &processCacheEntry{StartTime: 310, ExitStatus: adoptedExitState{}}
+
+					var contents bytes.Buffer
+					encoder := json.NewEncoder(&contents)
+					for _, record := range coreint.snapshotJournal() {
+						Expect(encoder.Encode(record)).To(Succeed())
+					}
+					state, err = replayJournal(contents.Bytes())
+				})
+				It("should not produce an error", func() {
+					Expect(err).NotTo(HaveOccurred())
+				})
+				It("should describe the same containers and processes", func() {
+					Expect(state.Containers).To(Equal(map[string]*journaledContainer{
+						"a": {
+							MappedVirtualDisks:   []prot.MappedVirtualDisk{disk0, disk1},
+							NetworkAdapters:      []prot.NetworkAdapter{adapter},
+							MovedNetworkAdapters: []prot.NetworkAdapter{adapter},
+							Processes: []*journaledProcess{
+								{Pid: 10, StartTime: 100},
+								{Pid: 11, StartTime: 110, ExitHookPending: true},
+							},
+							ExitHookPending: true,
+						},
+					}))
+					Expect(state.ExternalProcesses).To(Equal(map[int]*journaledProcess{
+						30: {Pid: 30, StartTime: 300},
+					}))
+				})
+			})
+		})
+
+		Describe("journaling many processes starting and exiting", func() {
+			var (
+				coreint *gcsCore
+				files   *memoryOS
+				path    string
+			)
+			BeforeEach(func() {
+				files = &memoryOS{OS: mockos.NewOS(), files: make(map[string]*bytes.Buffer)}
+				coreint = NewGCSCore(mockruntime.NewRuntime(), files)
+				path = coreint.getJournalPath()
+				coreint.containerCacheMutex.Lock()
+				err = coreint.compactJournal()
+				coreint.containerCacheMutex.Unlock()
+				Expect(err).NotTo(HaveOccurred())
+
+				coreint.processStarted("", 1, &processCacheEntry{})
+				for pid := 2; pid < 2+5*journalCompactionThreshold; pid++ {
+					entry := &processCacheEntry{}
+					coreint.processStarted("", pid, entry)
+					coreint.externalProcessCacheMutex.Lock()
+					entry.exited(adoptedExitState{})
+					coreint.externalProcessCacheMutex.Unlock()
+					coreint.journal.record(journalRecord{Op: journalProcessExited, Pid: pid, ExitCode: -1})
+				}
+			})
+			It("should compact the journal", func() {
+				Eventually(func() int {
+					return bytes.Count(files.contents(path), []byte{'\n'})
+				}).Should(BeNumerically("<=", journalCompactionThreshold+1))
+			})
+			It("should close the replaced journal files", func() {
+				Eventually(files.openFiles).Should(Equal(1))
+			})
+			It("should still describe the running processes", func() {
+				state, replayErr := replayJournal(files.contents(path))
+				Expect(replayErr).NotTo(HaveOccurred())
+				Expect(state.Containers).To(BeEmpty())
+				Expect(state.ExternalProcesses).To(Equal(map[int]*journaledProcess{
+					1: {Pid: 1},
+				}))
+			})
+		})
+
+		Describe("calling filterDaxMountData", func() {
+			Context("the filesystem supports DAX", func() {
+				It("should keep the dax option", func() {
+					Expect(filterDaxMountData("ext4", []string{"dax", "noload"})).To(Equal([]string{"dax", "noload"}))
+					Expect(filterDaxMountData("xfs", []string{"dax"})).To(Equal([]string{"dax"}))
+				})
+			})
+			Context("the filesystem does not support DAX", func() {
+				It("should remove the dax option", func() {
+					Expect(filterDaxMountData("squashfs", []string{"dax", "noatime"})).To(Equal([]string{"noatime"}))
+				})
+			})
+		})
+
+		Describe("calling overlayMountData", func() {
+			It("should list the lower directories in order", func() {
+				data := overlayMountData([]string{"/mnt/gcs/layers/sdb", "/mnt/gcs/layers/sdc", "/mnt/base/"}, "/scratch/upper", "/scratch/work")
+				Expect(data).To(Equal("lowerdir=/mnt/gcs/layers/sdb:/mnt/gcs/layers/sdc:/mnt/base/,upperdir=/scratch/upper,workdir=/scratch/work"))
+			})
+			It("should omit the upper and work directories for a read-only filesystem", func() {
+				data := overlayMountData([]string{"/mnt/gcs/layers/sdb", "/mnt/base/"}, "", "")
+				Expect(data).To(Equal("lowerdir=/mnt/gcs/layers/sdb:/mnt/base/"))
+			})
+		})
+
+		Describe("calling fitsInMountData", func() {
+			Context("the data is shorter than a page", func() {
+				It("should fit", func() {
+					Expect(fitsInMountData(strings.Repeat("a", syscall.Getpagesize()-1))).To(BeTrue())
+				})
+			})
+			Context("the data and its terminator are longer than a page", func() {
+				It("should not fit", func() {
+					Expect(fitsInMountData(strings.Repeat("a", syscall.Getpagesize()))).To(BeFalse())
+				})
+			})
+		})
+
+		Describe("calling scsiDeviceAddress", func() {
+			It("should return the address of the device on the given SCSI host", func() {
+				Expect(scsiDeviceAddress(2, 3)).To(Equal("2:0:0:3"))
+			})
+		})
+
+		Describe("calling layerScsiAddress", func() {
+			Context("the layer has an address", func() {
+				It("should return the address", func() {
+					address, err := layerScsiAddress(prot.Layer{Path: "1", Address: &prot.ScsiAddress{Controller: 2, Lun: 3}})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(address).To(Equal(prot.ScsiAddress{Controller: 2, Lun: 3}))
+				})
+			})
+			Context("the layer only has a LUN path", func() {
+				It("should return the LUN on the first controller", func() {
+					address, err := layerScsiAddress(prot.Layer{Path: "5"})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(address).To(Equal(prot.ScsiAddress{Controller: 0, Lun: 5}))
+				})
+			})
+			Context("the layer path is not a LUN", func() {
+				It("should produce an error", func() {
+					_, err := layerScsiAddress(prot.Layer{Path: "0-1"})
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
 		Describe("calling into the primary GCS functions", func() {
 			var (
 				coreint                              *gcsCore
@@ -704,13 +1470,174 @@ var _ = Describe("GCS", func() {
 					JustBeforeEach(func() {
 						err = coreint.CreateContainer(containerID, createSettings)
 					})
-					It("should not produce an error", func() {
-						Expect(err).NotTo(HaveOccurred())
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+				})
+				Context("mapped virtual disk is created in the container namespace", func() {
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettingsCreateInUtilityVMFalse)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+				Context("mapped virtual disk selects a partition by index", func() {
+					JustBeforeEach(func() {
+						createSettings.MappedVirtualDisks[0].Partition = 1
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+				})
+				Context("layers are given by SCSI address on the first controller", func() {
+					BeforeEach(func() {
+						createSettings.Layers = []prot.Layer{
+							prot.Layer{Address: &prot.ScsiAddress{Controller: 0, Lun: 0}},
+							prot.Layer{Address: &prot.ScsiAddress{Controller: 0, Lun: 1}},
+						}
+						createSettings.SandboxDataAddress = &prot.ScsiAddress{Controller: 0, Lun: 2}
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+				})
+				Context("layers are on both persistent memory and SCSI devices", func() {
+					BeforeEach(func() {
+						pmemDevice := uint32(0)
+						createSettings.Layers = []prot.Layer{
+							prot.Layer{PmemDevice: &pmemDevice},
+							prot.Layer{Address: &prot.ScsiAddress{Controller: 0, Lun: 1}},
+						}
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+				})
+				Context("the second layer fails to mount", func() {
+					BeforeEach(func() {
+						pmemDevices := []uint32{0, 1, 2}
+						createSettings.Layers = []prot.Layer{
+							prot.Layer{PmemDevice: &pmemDevices[0]},
+							prot.Layer{PmemDevice: &pmemDevices[1]},
+							prot.Layer{PmemDevice: &pmemDevices[2]},
+						}
+						coreint.OS = &failingMountOS{OS: coreint.OS, target: coreint.getLayerPath("pmem1")}
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+					It("should release the mapped virtual disks and layers it acquired", func() {
+						Expect(coreint.mappedVirtualDiskCache).To(BeEmpty())
+						Expect(coreint.layerCache).To(BeEmpty())
+						Expect(coreint.containerCache).NotTo(HaveKey(containerID))
+					})
+					It("should allow the container to be created again", func() {
+						coreint.OS = coreint.OS.(*failingMountOS).OS
+						Expect(coreint.CreateContainer(containerID, createSettings)).To(Succeed())
+						for _, entry := range coreint.mappedVirtualDiskCache {
+							Expect(entry.RefCount).To(Equal(1))
+						}
+						Expect(coreint.layerCache).To(HaveLen(3))
+						for _, entry := range coreint.layerCache {
+							Expect(entry.Containers).To(HaveLen(1))
+						}
+					})
+				})
+				Context("the layers are verified with dm-verity", func() {
+					BeforeEach(func() {
+						for i := range createSettings.Layers {
+							createSettings.Layers[i].Verity = &prot.LayerVerity{
+								RootDigest:        strings.Repeat("ab", 32),
+								HashOffsetInBytes: 4096,
+							}
+						}
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+				})
+				Context("a layer has an invalid dm-verity root digest", func() {
+					BeforeEach(func() {
+						createSettings.Layers[0].Verity = &prot.LayerVerity{
+							RootDigest:        "not hex",
+							HashOffsetInBytes: 4096,
+						}
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+				Context("a layer is on a SCSI controller which does not exist", func() {
+					BeforeEach(func() {
+						createSettings.Layers = []prot.Layer{
+							prot.Layer{Address: &prot.ScsiAddress{Controller: 1, Lun: 0}},
+						}
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+				Context("ephemeral scratch space is requested without a sandbox", func() {
+					BeforeEach(func() {
+						createSettings.SandboxDataPath = ""
+						createSettings.EphemeralScratchSizeInMB = 64
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+				})
+				Context("ephemeral scratch space is requested along with a sandbox", func() {
+					BeforeEach(func() {
+						createSettings.SandboxDataAddress = &prot.ScsiAddress{Controller: 0, Lun: 2}
+						createSettings.EphemeralScratchSizeInMB = 64
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
 					})
 				})
-				Context("mapped virtual disk is created in the container namespace", func() {
+				Context("an encrypted sandbox is requested without a sandbox", func() {
+					BeforeEach(func() {
+						createSettings.SandboxDataPath = ""
+						createSettings.EncryptSandbox = true
+					})
 					JustBeforeEach(func() {
-						err = coreint.CreateContainer(containerID, createSettingsCreateInUtilityVMFalse)
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+				Context("mapped virtual disk selects a partition by both index and label", func() {
+					JustBeforeEach(func() {
+						createSettings.MappedVirtualDisks[0].Partition = 1
+						createSettings.MappedVirtualDisks[0].PartitionLabel = "data"
+						err = coreint.CreateContainer(containerID, createSettings)
 					})
 					It("should produce an error", func() {
 						Expect(err).To(HaveOccurred())
@@ -719,11 +1646,12 @@ var _ = Describe("GCS", func() {
 			})
 			Describe("calling ExecProcess", func() {
 				var (
-					params prot.ProcessParameters
-					pid    int
+					params    prot.ProcessParameters
+					pid       int
+					startTime uint64
 				)
 				JustBeforeEach(func() {
-					pid, err = coreint.ExecProcess(containerID, params, fullStdioSet)
+					pid, startTime, err = coreint.ExecProcess(containerID, params, fullStdioSet)
 				})
 				Context("it is the initial process", func() {
 					BeforeEach(func() {
@@ -738,6 +1666,63 @@ var _ = Describe("GCS", func() {
 							Expect(err).NotTo(HaveOccurred())
 						})
 					})
+					Context("the process's output is still being copied when it exits", func() {
+						var (
+							out *bytes.Buffer
+						)
+						BeforeEach(func() {
+							coreint.Rtime = lateOutputRuntime{Runtime: coreint.Rtime}
+							stdout := mockos.NewMockReadWriteCloser()
+							out = stdout.Buffer
+							fullStdioSet.Out = stdout
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should run the exit hooks once all of the output has been copied", func() {
+							Expect(err).NotTo(HaveOccurred())
+							outputs := make(chan string, 1)
+							hookErr := coreint.RegisterProcessExitHook(pid, startTime, func(oslayer.ProcessExitState) {
+								outputs <- out.String()
+							})
+							Expect(hookErr).NotTo(HaveOccurred())
+							Eventually(outputs).Should(Receive(Equal("the last line of output\n")))
+						})
+					})
+					Context("the process's output is held up when it exits", func() {
+						var (
+							release chan struct{}
+						)
+						BeforeEach(func() {
+							release = make(chan struct{})
+							coreint.Rtime = heldOutputRuntime{Runtime: coreint.Rtime, release: release}
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						AfterEach(func() {
+							close(release)
+						})
+						It("should record the exit before the output has been copied", func() {
+							Expect(err).NotTo(HaveOccurred())
+							exited := func() bool {
+								coreint.processCacheMutex.Lock()
+								defer coreint.processCacheMutex.Unlock()
+								return coreint.processCache[pid].ExitStatus != nil
+							}
+							Eventually(exited).Should(BeTrue())
+							Expect(coreint.TerminateProcess(pid, startTime)).To(Succeed())
+						})
+						It("should hold the exit hooks until the output has been copied", func() {
+							Expect(err).NotTo(HaveOccurred())
+							states := make(chan oslayer.ProcessExitState, 1)
+							hookErr := coreint.RegisterProcessExitHook(pid, startTime, func(state oslayer.ProcessExitState) {
+								states <- state
+							})
+							Expect(hookErr).NotTo(HaveOccurred())
+							Consistently(states).ShouldNot(Receive())
+							release <- struct{}{}
+							Eventually(states).Should(Receive())
+						})
+					})
 					Context("the container has not already been created", func() {
 						It("should produce an error", func() {
 							Expect(err).To(HaveOccurred())
@@ -755,12 +1740,26 @@ var _ = Describe("GCS", func() {
 						})
 						Context("the container already has an initial process in it", func() {
 							BeforeEach(func() {
-								pid, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+								pid, startTime, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
 								Expect(err).NotTo(HaveOccurred())
 							})
 							It("should not produce an error", func() {
 								Expect(err).NotTo(HaveOccurred())
 							})
+							Context("the process doesn't have a terminal", func() {
+								var (
+									stdin *closeRecordingPipe
+								)
+								BeforeEach(func() {
+									params.EmulateConsole = false
+									stdin = newCloseRecordingPipe()
+									fullStdioSet.In = stdin
+								})
+								It("should close its stdin once it has exited", func() {
+									Expect(err).NotTo(HaveOccurred())
+									Eventually(stdin.closed).Should(BeClosed())
+								})
+							})
 						})
 						Context("the container does not already have an initial process in it", func() {
 							It("should produce an error", func() {
@@ -777,6 +1776,151 @@ var _ = Describe("GCS", func() {
 					})
 				})
 			})
+			Describe("calling CheckpointContainer", func() {
+				var (
+					imagePath string
+				)
+				BeforeEach(func() {
+					imagePath = "/path/inside/container/checkpoint"
+				})
+				JustBeforeEach(func() {
+					err = coreint.CheckpointContainer(containerID, imagePath, prot.CheckpointOptions{LeaveRunning: true})
+				})
+				Context("the container has already been started", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, _, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					Context("the image path is on a mapped virtual disk", func() {
+						It("should not produce an error", func() {
+							Expect(err).NotTo(HaveOccurred())
+						})
+					})
+					Context("the image path is not on a mapped virtual disk", func() {
+						BeforeEach(func() {
+							imagePath = "/path/inside/container/../checkpoint"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("the container has been created but not started", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+				Context("the container has not already been created", func() {
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+			Describe("checkpointing a container while calling into it", func() {
+				var (
+					rtime      *blockingCheckpointRuntime
+					checkpoint chan error
+				)
+				BeforeEach(func() {
+					rtime = &blockingCheckpointRuntime{
+						Runtime: coreint.Rtime,
+						started: make(chan struct{}),
+						release: make(chan struct{}),
+						exit:    make(chan struct{}),
+					}
+					coreint.Rtime = rtime
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					_, _, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					Expect(err).NotTo(HaveOccurred())
+
+					// The checkpoint may outlive the spec, so the goroutine doesn't
+					// refer to the variables which the next spec overwrites.
+					done := make(chan error, 1)
+					checkpoint = done
+					go func(coreint *gcsCore, id string) {
+						done <- coreint.CheckpointContainer(id, "/path/inside/container/checkpoint", prot.CheckpointOptions{LeaveRunning: true})
+					}(coreint, containerID)
+					Eventually(rtime.started).Should(BeClosed())
+				})
+				AfterEach(func() {
+					close(rtime.release)
+					close(rtime.exit)
+				})
+				It("should not hold the container cache while the container is dumped", func() {
+					Expect(coreint.CreateContainer("other", prot.VMHostedContainerSettings{})).To(Succeed())
+				})
+				It("should reject executing processes in the container", func() {
+					_, _, execErr := coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+					Expect(execErr).To(MatchError(ContainSubstring("being checkpointed")))
+				})
+				It("should reject modifying the container's settings", func() {
+					Expect(coreint.ModifySettings(containerID, modificationRequest)).To(MatchError(ContainSubstring("being checkpointed")))
+				})
+				It("should reject checkpointing the container again", func() {
+					Expect(coreint.CheckpointContainer(containerID, "/path/inside/container/checkpoint", prot.CheckpointOptions{LeaveRunning: true})).To(MatchError(ContainSubstring("being checkpointed")))
+				})
+				It("should accept executing processes once the checkpoint is done", func() {
+					rtime.release <- struct{}{}
+					Eventually(checkpoint).Should(Receive(BeNil()))
+					_, _, execErr := coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+					Expect(execErr).NotTo(HaveOccurred())
+				})
+			})
+			Describe("calling RestoreContainer", func() {
+				var (
+					imagePath string
+					pid       int
+				)
+				BeforeEach(func() {
+					imagePath = "/path/inside/container/checkpoint"
+				})
+				JustBeforeEach(func() {
+					pid, _, err = coreint.RestoreContainer(containerID, imagePath, initialExecParams, fullStdioSet)
+				})
+				Context("the container has already been created", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					Context("the image path is on a mapped virtual disk", func() {
+						It("should not produce an error", func() {
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should return the pid of the restored init process", func() {
+							Expect(pid).To(Equal(101))
+						})
+					})
+					Context("the image path is not on a mapped virtual disk", func() {
+						BeforeEach(func() {
+							imagePath = "/checkpoint"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+					Context("the container has already been started", func() {
+						BeforeEach(func() {
+							_, _, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("the container has not already been created", func() {
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
 			Describe("calling SignalContainer", func() {
 				Context("using signal SIGKILL", func() {
 					JustBeforeEach(func() {
@@ -818,14 +1962,17 @@ var _ = Describe("GCS", func() {
 				})
 			})
 			Describe("calling TerminateProcess", func() {
+				var (
+					startTime uint64
+				)
 				JustBeforeEach(func() {
-					err = coreint.TerminateProcess(processID)
+					err = coreint.TerminateProcess(processID, startTime)
 				})
 				Context("the process has already been created", func() {
 					BeforeEach(func() {
 						err = coreint.CreateContainer(containerID, createSettings)
 						Expect(err).NotTo(HaveOccurred())
-						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						_, startTime, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
 						Expect(err).NotTo(HaveOccurred())
 					})
 					It("should not produce an error", func() {
@@ -834,7 +1981,7 @@ var _ = Describe("GCS", func() {
 				})
 				Context("the external process has already been created", func() {
 					BeforeEach(func() {
-						_, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
+						_, startTime, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
 						Expect(err).NotTo(HaveOccurred())
 					})
 					It("should not produce an error", func() {
@@ -871,14 +2018,131 @@ var _ = Describe("GCS", func() {
 			})
 			Describe("calling RunExternalProcess", func() {
 				var (
-					pid int
+					pid       int
+					startTime uint64
 				)
 				JustBeforeEach(func() {
-					pid, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
+					pid, startTime, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
 				})
 				It("should not produce an error", func() {
 					Expect(err).NotTo(HaveOccurred())
 				})
+				Context("a container process which had the same pid has exited", func() {
+					var (
+						oldEntry *processCacheEntry
+					)
+					BeforeEach(func() {
+						oldEntry = &processCacheEntry{ExitStatus: mockos.NewProcessExitState(1), ExitTime: time.Now()}
+						coreint.processCache[101] = oldEntry
+					})
+					It("should replace the exited process", func() {
+						Expect(coreint.processCache).NotTo(HaveKey(pid))
+						Expect(coreint.externalProcessCache[pid]).NotTo(Equal(oldEntry))
+					})
+					It("should not run exit hooks with the exited process's state", func() {
+						exitCodes := make(chan int, 1)
+						hookErr := coreint.RegisterProcessExitHook(pid, startTime, func(state oslayer.ProcessExitState) {
+							select {
+							case exitCodes <- state.ExitCode():
+							default:
+							}
+						})
+						Expect(hookErr).NotTo(HaveOccurred())
+						Expect(exitCodes).NotTo(Receive(Equal(1)))
+					})
+				})
+				It("should list the process", func() {
+					processes, listErr := coreint.ListExternalProcesses()
+					Expect(listErr).NotTo(HaveOccurred())
+					Expect(processes).To(Equal([]prot.ExternalProcess{
+						prot.ExternalProcess{
+							ProcessID: uint32(pid),
+							Command:   []string{"cat", "file"},
+							Status:    prot.EpsRunning,
+						},
+					}))
+				})
+			})
+			Describe("reusing the pid of an exited process", func() {
+				var (
+					procOS       *startTimeOS
+					oldStartTime uint64
+					newStartTime uint64
+				)
+				BeforeEach(func() {
+					procOS = &startTimeOS{OS: coreint.OS}
+					coreint.OS = procOS
+					procOS.setStartTime(1000)
+					_, oldStartTime, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
+					Expect(err).NotTo(HaveOccurred())
+					coreint.externalProcessCacheMutex.Lock()
+					coreint.externalProcessCache[processID].exited(mockos.NewProcessExitState(1))
+					coreint.externalProcessCacheMutex.Unlock()
+
+					procOS.setStartTime(2000)
+					newStdioSet := &core.StdioSet{
+						In:  mockos.NewMockReadWriteCloser(),
+						Out: mockos.NewMockReadWriteCloser(),
+						Err: mockos.NewMockReadWriteCloser(),
+					}
+					_, newStartTime, err = coreint.RunExternalProcess(externalParams, newStdioSet)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				It("should return the start time of each process", func() {
+					Expect(oldStartTime).To(Equal(uint64(1000)))
+					Expect(newStartTime).To(Equal(uint64(2000)))
+				})
+				It("should not register exit hooks for the exited process on the new one", func() {
+					hookErr := coreint.RegisterProcessExitHook(processID, oldStartTime, func(oslayer.ProcessExitState) {})
+					Expect(hookErr).To(HaveOccurred())
+					Expect(hookErr.Error()).To(ContainSubstring("its pid was reused"))
+					Expect(coreint.externalProcessCache[processID].ExitHooks).To(BeEmpty())
+				})
+				It("should not terminate the new process in place of the exited one", func() {
+					Expect(coreint.TerminateProcess(processID, oldStartTime)).NotTo(Succeed())
+				})
+				It("should register exit hooks for the new process", func() {
+					Expect(coreint.RegisterProcessExitHook(processID, newStartTime, func(oslayer.ProcessExitState) {})).To(Succeed())
+					Expect(coreint.externalProcessCache[processID].ExitHooks).To(HaveLen(1))
+				})
+				It("should register exit hooks for the new process when no start time is given", func() {
+					Expect(coreint.RegisterProcessExitHook(processID, 0, func(oslayer.ProcessExitState) {})).To(Succeed())
+					Expect(coreint.externalProcessCache[processID].ExitHooks).To(HaveLen(1))
+				})
+			})
+			Describe("reusing the pid of a process before it is seen to exit", func() {
+				var (
+					procOS *startTimeOS
+				)
+				BeforeEach(func() {
+					procOS = &startTimeOS{OS: coreint.OS}
+					coreint.OS = procOS
+					procOS.setStartTime(1000)
+					_, _, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				It("should find the process by its pid alone while it is running", func() {
+					Expect(coreint.RegisterProcessExitHook(processID, 0, func(oslayer.ProcessExitState) {})).To(Succeed())
+				})
+				It("should not find the process by its pid alone once the pid is reused", func() {
+					procOS.setStartTime(2000)
+					Expect(coreint.TerminateProcess(processID, 0)).To(MatchError(ContainSubstring("its pid was reused")))
+				})
+			})
+			Describe("calling Reconcile", func() {
+				var (
+					report *ReconcileReport
+				)
+				JustBeforeEach(func() {
+					report, err = coreint.Reconcile()
+				})
+				It("should not produce an error", func() {
+					Expect(err).NotTo(HaveOccurred())
+				})
+				It("should remove the containers whose init process can't be found", func() {
+					Expect(report.AdoptedContainers).To(BeEmpty())
+					Expect(report.RemovedContainers).To(ConsistOf("abcdef", "a"))
+				})
 			})
 			Describe("calling ModifySettings", func() {
 				Context("adding a mapped virtual disk", func() {
@@ -931,7 +2195,8 @@ var _ = Describe("GCS", func() {
 							BeforeEach(func() {
 								err = coreint.CreateContainer(containerID, createSettings)
 								Expect(err).NotTo(HaveOccurred())
-								coreint.containerCache[containerID].AddMappedVirtualDisk(mappedVirtualDisk)
+								err = coreint.ModifySettings(containerID, modificationRequest)
+								Expect(err).NotTo(HaveOccurred())
 							})
 							It("should not produce an error", func() {
 								Expect(err).NotTo(HaveOccurred())
@@ -945,6 +2210,59 @@ var _ = Describe("GCS", func() {
 					})
 				})
 			})
+			Describe("sharing a mapped virtual disk between containers", func() {
+				var (
+					otherContainerID string
+				)
+				BeforeEach(func() {
+					otherContainerID = "76543210-89ab-cdef-0123-456789abcdef"
+					createSettings.MappedVirtualDisks = nil
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					err = coreint.CreateContainer(otherContainerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("the disk is read-only", func() {
+					BeforeEach(func() {
+						mappedVirtualDisk.ReadOnly = true
+						err = coreint.ModifySettings(containerID, modificationRequest)
+						Expect(err).NotTo(HaveOccurred())
+						err = coreint.ModifySettings(otherContainerID, modificationRequest)
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should mount the disk only once", func() {
+						key := newMappedVirtualDiskKey(mappedVirtualDisk)
+						Expect(coreint.mappedVirtualDiskCache).To(HaveLen(1))
+						Expect(coreint.mappedVirtualDiskCache[key].RefCount).To(Equal(2))
+					})
+					It("should unmount the disk for every container when the host removes it", func() {
+						key := newMappedVirtualDiskKey(mappedVirtualDisk)
+						err = coreint.ModifySettings(containerID, modificationRequestRemove)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(coreint.mappedVirtualDiskCache).NotTo(HaveKey(key))
+						Expect(coreint.containerCache[otherContainerID].MappedVirtualDisks).To(BeEmpty())
+						err = coreint.ModifySettings(otherContainerID, modificationRequestRemove)
+						Expect(err).To(HaveOccurred())
+					})
+					It("should keep the disk mounted when one of the containers is cleaned up", func() {
+						key := newMappedVirtualDiskKey(mappedVirtualDisk)
+						coreint.CleanupContainer(containerID)
+						Expect(coreint.mappedVirtualDiskCache[key].RefCount).To(Equal(1))
+					})
+				})
+				Context("the disk is writable", func() {
+					BeforeEach(func() {
+						err = coreint.ModifySettings(containerID, modificationRequest)
+						Expect(err).NotTo(HaveOccurred())
+						err = coreint.ModifySettings(otherContainerID, modificationRequest)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
 			Describe("calling RegisterContainerExitHook", func() {
 				JustBeforeEach(func() {
 					err = coreint.RegisterContainerExitHook(containerID, func(oslayer.ProcessExitState) {})
@@ -964,12 +2282,63 @@ var _ = Describe("GCS", func() {
 					})
 				})
 			})
+			Describe("calling RegisterContainerEventHook", func() {
+				var notifications chan prot.ContainerNotification
+				JustBeforeEach(func() {
+					notifications = make(chan prot.ContainerNotification, 2)
+					err = coreint.RegisterContainerEventHook(containerID, func(notification prot.ContainerNotification) {
+						notifications <- notification
+					})
+				})
+				Context("the container has already been created", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+					Context("the container's init process is started", func() {
+						var exitStates chan oslayer.ProcessExitState
+						JustBeforeEach(func() {
+							states := make(chan oslayer.ProcessExitState, 1)
+							exitStates = states
+							hookErr := coreint.RegisterContainerExitHook(containerID, func(state oslayer.ProcessExitState) {
+								states <- state
+							})
+							Expect(hookErr).NotTo(HaveOccurred())
+							_, _, execErr := coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							Expect(execErr).NotTo(HaveOccurred())
+						})
+						It("should send the container's OOM events as notifications", func() {
+							var notification prot.ContainerNotification
+							Eventually(notifications).Should(Receive(&notification))
+							Expect(notification.Type).To(Equal(prot.NtOutOfMemory))
+							Consistently(notifications).ShouldNot(Receive())
+						})
+						It("should tell the exit hooks the container was killed by the OOM killer", func() {
+							var state oslayer.ProcessExitState
+							Eventually(exitStates).Should(Receive(&state))
+							containerState, ok := state.(core.ContainerExitState)
+							Expect(ok).To(BeTrue())
+							Expect(containerState.OOMKilled()).To(BeTrue())
+							Expect(containerState.ExitCode()).To(Equal(123))
+						})
+					})
+				})
+				Context("the container has not already been created", func() {
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
 			Describe("calling RegisterProcessExitHook", func() {
 				var (
-					pid int
+					pid       int
+					startTime uint64
 				)
 				JustBeforeEach(func() {
-					err = coreint.RegisterProcessExitHook(pid, func(oslayer.ProcessExitState) {})
+					err = coreint.RegisterProcessExitHook(pid, startTime, func(oslayer.ProcessExitState) {})
 				})
 				Context("the container has already been created", func() {
 					BeforeEach(func() {
@@ -978,7 +2347,7 @@ var _ = Describe("GCS", func() {
 					})
 					Context("the process has already been started", func() {
 						BeforeEach(func() {
-							pid, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							pid, startTime, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
 							Expect(err).NotTo(HaveOccurred())
 						})
 						It("should not produce an error", func() {
@@ -1000,3 +2369,262 @@ var _ = Describe("GCS", func() {
 		})
 	})
 })
+
+// lateOutputRuntime is a mock runtime whose processes' output is still being
+// written to their stdout pipe for a while after they have exited.
+type lateOutputRuntime struct {
+	runtime.Runtime
+}
+
+func (r lateOutputRuntime) GetStdioPipes(id string, pid int) (*runtime.StdioPipes, error) {
+	out, w := io.Pipe()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("the last line of output\n"))
+		w.Close()
+	}()
+	return &runtime.StdioPipes{Out: out}, nil
+}
+
+// closeRecordingPipe is a mock stdio pipe which closes closed once it is
+// closed.
+type closeRecordingPipe struct {
+	core.StdioPipe
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newCloseRecordingPipe() *closeRecordingPipe {
+	return &closeRecordingPipe{
+		StdioPipe: mockos.NewMockReadWriteCloser(),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (p *closeRecordingPipe) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return p.StdioPipe.Close()
+}
+
+// cgroupFilesOS is a mock OS whose files are the given cgroup files.
+type cgroupFilesOS struct {
+	oslayer.OS
+	files map[string]string
+}
+
+func (o cgroupFilesOS) ReadFile(name string) ([]byte, error) {
+	contents, ok := o.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+	return []byte(contents), nil
+}
+
+// heldOutputRuntime is a mock runtime whose processes' output isn't copied in
+// full until a value is sent on release, or it is closed.
+type heldOutputRuntime struct {
+	runtime.Runtime
+	release chan struct{}
+}
+
+func (r heldOutputRuntime) GetStdioPipes(id string, pid int) (*runtime.StdioPipes, error) {
+	out, w := io.Pipe()
+	go func() {
+		<-r.release
+		w.Close()
+	}()
+	return &runtime.StdioPipes{Out: out}, nil
+}
+
+// blockingCheckpointRuntime is a mock runtime whose checkpoints don't finish
+// until they are released, and whose containers don't exit until exit is
+// closed. started is closed once the first checkpoint has begun.
+type blockingCheckpointRuntime struct {
+	runtime.Runtime
+	started chan struct{}
+	release chan struct{}
+	exit    chan struct{}
+	once    sync.Once
+}
+
+func (r *blockingCheckpointRuntime) WaitOnContainer(id string) (oslayer.ProcessExitState, error) {
+	<-r.exit
+	return r.Runtime.WaitOnContainer(id)
+}
+
+func (r *blockingCheckpointRuntime) CheckpointContainer(id string, imagePath string, options runtime.CheckpointOptions) error {
+	r.once.Do(func() { close(r.started) })
+	<-r.release
+	return r.Runtime.CheckpointContainer(id, imagePath, options)
+}
+
+// recordingOS is a mock OS which records the calls made to it while detaching a
+// device, and whose flush, write and device removal can be made to fail.
+type recordingOS struct {
+	oslayer.OS
+	calls      []string
+	flushErr   error
+	writeErr   error
+	removalErr error
+}
+
+func (o *recordingOS) Sync() {
+	o.calls = append(o.calls, "sync")
+}
+func (o *recordingOS) FlushBlockDevice(name string) error {
+	o.calls = append(o.calls, "flush "+name)
+	return o.flushErr
+}
+func (o *recordingOS) Unmount(target string, flags int) error {
+	o.calls = append(o.calls, "unmount "+target)
+	return nil
+}
+func (o *recordingOS) OpenFile(name string, flag int, perm os.FileMode) (oslayer.File, error) {
+	file, err := o.OS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingFile{File: file, os: o, name: name}, nil
+}
+func (o *recordingOS) WaitForBlockDeviceRemoval(ctx context.Context, name string) error {
+	o.calls = append(o.calls, "wait for removal of "+name)
+	return o.removalErr
+}
+
+// startTimeOS is a mock OS whose processes all have the start time it is
+// given in their /proc/<pid>/stat files.
+type startTimeOS struct {
+	oslayer.OS
+	mutex     sync.Mutex
+	startTime uint64
+}
+
+func (o *startTimeOS) setStartTime(startTime uint64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.startTime = startTime
+}
+func (o *startTimeOS) ReadFile(name string) ([]byte, error) {
+	if filepath.Base(name) != "stat" || filepath.Dir(filepath.Dir(name)) != "/proc" {
+		return o.OS.ReadFile(name)
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return []byte(fmt.Sprintf("101 (cat) S%s %d 0 0\n", strings.Repeat(" 0", statStartTime-1), o.startTime)), nil
+}
+
+// memoryOS is a mock OS which keeps the files opened for writing through it in
+// memory, and counts how many of them are open.
+type memoryOS struct {
+	oslayer.OS
+	mutex sync.Mutex
+	files map[string]*bytes.Buffer
+	open  int
+}
+
+func (o *memoryOS) OpenFile(name string, flag int, perm os.FileMode) (oslayer.File, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if _, ok := o.files[name]; !ok || flag&os.O_TRUNC != 0 {
+		o.files[name] = &bytes.Buffer{}
+	}
+	o.open++
+	return &memoryFile{os: o, buffer: o.files[name]}, nil
+}
+func (o *memoryOS) PathExists(name string) (bool, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	_, ok := o.files[name]
+	return ok, nil
+}
+func (o *memoryOS) ReadFile(name string) ([]byte, error) {
+	if contents := o.contents(name); contents != nil {
+		return contents, nil
+	}
+	return o.OS.ReadFile(name)
+}
+func (o *memoryOS) Rename(oldpath, newpath string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.files[newpath] = o.files[oldpath]
+	delete(o.files, oldpath)
+	return nil
+}
+
+// contents returns a copy of the contents of the file with the given name, or
+// nil if there is no such file.
+func (o *memoryOS) contents(name string) []byte {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	buffer, ok := o.files[name]
+	if !ok {
+		return nil
+	}
+	return append([]byte{}, buffer.Bytes()...)
+}
+
+// openFiles returns the number of files which are open.
+func (o *memoryOS) openFiles() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.open
+}
+
+// memoryFile is a file opened through a memoryOS. It keeps writing to the same
+// contents if the file is renamed or replaced.
+type memoryFile struct {
+	os     *memoryOS
+	buffer *bytes.Buffer
+	closed bool
+}
+
+func (f *memoryFile) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+func (f *memoryFile) Write(p []byte) (int, error) {
+	f.os.mutex.Lock()
+	defer f.os.mutex.Unlock()
+	if f.closed {
+		return 0, errors.New("file already closed")
+	}
+	return f.buffer.Write(p)
+}
+func (f *memoryFile) Close() error {
+	f.os.mutex.Lock()
+	defer f.os.mutex.Unlock()
+	if f.closed {
+		return errors.New("file already closed")
+	}
+	f.closed = true
+	f.os.open--
+	return nil
+}
+
+// failingMountOS is a mock OS on which mounting to the given target fails.
+type failingMountOS struct {
+	oslayer.OS
+	target string
+}
+
+func (o *failingMountOS) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	if target == o.target {
+		return errors.Errorf("failed to mount %s", target)
+	}
+	return o.OS.Mount(source, target, fstype, flags, data)
+}
+
+// recordingFile is a file opened through a recordingOS, which records what is
+// written to it.
+type recordingFile struct {
+	oslayer.File
+	os   *recordingOS
+	name string
+}
+
+func (f *recordingFile) Write(p []byte) (int, error) {
+	f.os.calls = append(f.os.calls, fmt.Sprintf("write %s %s", f.name, p))
+	if f.os.writeErr != nil {
+		return 0, f.os.writeErr
+	}
+	return f.File.Write(p)
+}
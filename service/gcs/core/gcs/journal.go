@@ -0,0 +1,431 @@
+package gcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+)
+
+// journalCompactionThreshold is the number of records which can be appended to
+// the journal before it is compacted. Compacting it this often keeps the
+// journal bounded by the size of the GCS's state, however many containers and
+// processes have come and gone.
+const journalCompactionThreshold = 1000
+
+// journalOp identifies the state transition described by a journalRecord.
+type journalOp string
+
+const (
+	// journalCreateContainer records that a container's storage, mapped
+	// virtual disks and network adapters were set up.
+	journalCreateContainer journalOp = "CreateContainer"
+	// journalAttachMappedVirtualDisk records that mapped virtual disks were
+	// hot added to a container.
+	journalAttachMappedVirtualDisk journalOp = "AttachMappedVirtualDisk"
+	// journalDetachMappedVirtualDisk records that mapped virtual disks were
+	// hot removed from a container.
+	journalDetachMappedVirtualDisk journalOp = "DetachMappedVirtualDisk"
+	// journalMoveNetworkAdapter records that network adapters were moved into
+	// a container's namespace.
+	journalMoveNetworkAdapter journalOp = "MoveNetworkAdapter"
+	// journalStartProcess records that a process was started, either in a
+	// container or, when the record has no container ID, externally.
+	journalStartProcess journalOp = "StartProcess"
+	// journalRegisterExitHook records that the host is waiting on the exit of
+	// a container or process.
+	journalRegisterExitHook journalOp = "RegisterExitHook"
+	// journalProcessExited records that a process exited and its exit hooks
+	// were run.
+	journalProcessExited journalOp = "ProcessExited"
+	// journalContainerExited records that a container exited, its exit hooks
+	// were run, and it was removed from the GCS.
+	journalContainerExited journalOp = "ContainerExited"
+)
+
+// journalRecord is a single line of the journal, describing one state
+// transition of the GCS.
+type journalRecord struct {
+	Op journalOp
+	// ID is the ID of the container the transition applies to. It is empty
+	// for transitions of external processes.
+	ID string `json:",omitempty"`
+	// Pid and StartTime identify the process the transition applies to.
+	Pid       int    `json:",omitempty"`
+	StartTime uint64 `json:",omitempty"`
+	ExitCode  int    `json:",omitempty"`
+
+	MappedVirtualDisks []prot.MappedVirtualDisk `json:",omitempty"`
+	NetworkAdapters    []prot.NetworkAdapter    `json:",omitempty"`
+}
+
+// journal appends records to the journal file. A nil journal discards them,
+// which is the case until the GCS has reconciled the state left behind by a
+// previous instance.
+type journal struct {
+	mutex   sync.Mutex
+	file    oslayer.File
+	encoder *json.Encoder
+	// appended is the number of records appended since the journal file was
+	// opened.
+	appended int
+	// full is signaled once journalCompactionThreshold records have been
+	// appended, so that the journal gets compacted.
+	full chan struct{}
+}
+
+// openJournal opens the journal file at the given path for appending.
+func openJournal(o oslayer.OS, path string) (*journal, error) {
+	j := &journal{full: make(chan struct{}, 1)}
+	if err := j.reopen(o, path); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// reopen opens the journal file at the given path for appending, and closes
+// the file the journal was appending to, if any. The file is opened for
+// synchronous writes, so that each record is on disk once it has been
+// recorded.
+func (j *journal) reopen(o oslayer.OS, path string) error {
+	file, err := o.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open journal %s", path)
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file != nil {
+		if err := j.file.Close(); err != nil {
+			logrus.Warnf("failed to close the replaced journal: %s", err)
+		}
+	}
+	j.file = file
+	j.encoder = json.NewEncoder(file)
+	j.appended = 0
+	return nil
+}
+
+// record appends the given record to the journal. Failing to do so doesn't
+// fail the state transition, which has already happened, so the error is only
+// logged.
+func (j *journal) record(record journalRecord) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if err := j.encoder.Encode(record); err != nil {
+		logrus.Errorf("failed to record %s in the journal: %s", record.Op, err)
+		return
+	}
+	j.appended++
+	if j.appended >= journalCompactionThreshold {
+		select {
+		case j.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// journaledState is the state of the GCS's containers and external processes
+// as described by the journal.
+type journaledState struct {
+	Containers        map[string]*journaledContainer
+	ExternalProcesses map[int]*journaledProcess
+}
+
+// journaledContainer is the state of a single container as described by the
+// journal.
+type journaledContainer struct {
+	MappedVirtualDisks   []prot.MappedVirtualDisk
+	NetworkAdapters      []prot.NetworkAdapter
+	MovedNetworkAdapters []prot.NetworkAdapter
+	// Processes are the container's processes which haven't exited, in the
+	// order they were started.
+	Processes       []*journaledProcess
+	ExitHookPending bool
+}
+
+// journaledProcess is the state of a single process as described by the
+// journal.
+type journaledProcess struct {
+	Pid             int
+	StartTime       uint64
+	ExitHookPending bool
+}
+
+// findProcess returns the process with the given pid, along with the ID of
+// the container it runs in, which is empty for external processes.
+func (s *journaledState) findProcess(pid int) (string, *journaledProcess) {
+	if process, ok := s.ExternalProcesses[pid]; ok {
+		return "", process
+	}
+	for id, container := range s.Containers {
+		for _, process := range container.Processes {
+			if process.Pid == pid {
+				return id, process
+			}
+		}
+	}
+	return "", nil
+}
+
+// apply updates the state with the transition described by the given record.
+// Records for unknown containers or processes are ignored.
+func (s *journaledState) apply(record journalRecord) {
+	container := s.Containers[record.ID]
+	switch record.Op {
+	case journalCreateContainer:
+		s.Containers[record.ID] = &journaledContainer{
+			MappedVirtualDisks: record.MappedVirtualDisks,
+			NetworkAdapters:    record.NetworkAdapters,
+		}
+	case journalAttachMappedVirtualDisk:
+		if container != nil {
+			container.MappedVirtualDisks = append(container.MappedVirtualDisks, record.MappedVirtualDisks...)
+		}
+	case journalDetachMappedVirtualDisk:
+		if container != nil {
+			for _, detached := range record.MappedVirtualDisks {
+				address := mappedVirtualDiskScsiAddress(detached)
+				for i, disk := range container.MappedVirtualDisks {
+					if mappedVirtualDiskScsiAddress(disk) == address {
+						container.MappedVirtualDisks = append(container.MappedVirtualDisks[:i], container.MappedVirtualDisks[i+1:]...)
+						break
+					}
+				}
+			}
+		}
+	case journalMoveNetworkAdapter:
+		if container != nil {
+			container.MovedNetworkAdapters = append(container.MovedNetworkAdapters, record.NetworkAdapters...)
+		}
+	case journalStartProcess:
+		// A reused pid replaces the process which used it before.
+		s.removeProcess(record.Pid)
+		process := &journaledProcess{Pid: record.Pid, StartTime: record.StartTime}
+		if record.ID == "" {
+			s.ExternalProcesses[record.Pid] = process
+		} else if container != nil {
+			container.Processes = append(container.Processes, process)
+		}
+	case journalRegisterExitHook:
+		if record.ID != "" {
+			if container != nil {
+				container.ExitHookPending = true
+			}
+		} else if _, process := s.findProcess(record.Pid); process != nil {
+			process.ExitHookPending = true
+		}
+	case journalProcessExited:
+		s.removeProcess(record.Pid)
+	case journalContainerExited:
+		delete(s.Containers, record.ID)
+	}
+}
+
+// removeProcess removes the process with the given pid from the state.
+func (s *journaledState) removeProcess(pid int) {
+	id, process := s.findProcess(pid)
+	if process == nil {
+		return
+	}
+	if id == "" {
+		delete(s.ExternalProcesses, pid)
+		return
+	}
+	container := s.Containers[id]
+	for i, other := range container.Processes {
+		if other == process {
+			container.Processes = append(container.Processes[:i], container.Processes[i+1:]...)
+			break
+		}
+	}
+}
+
+// replayJournal returns the state described by the given journal contents.
+// The last record may have been cut short by the GCS stopping while it was
+// being written, in which case it is ignored.
+func replayJournal(contents []byte) (*journaledState, error) {
+	state := &journaledState{
+		Containers:        make(map[string]*journaledContainer),
+		ExternalProcesses: make(map[int]*journaledProcess),
+	}
+	lines := bytes.Split(bytes.TrimSpace(contents), []byte{'\n'})
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			if i == len(lines)-1 {
+				logrus.Warnf("ignoring truncated journal record \"%s\"", line)
+				break
+			}
+			return nil, errors.Wrapf(err, "failed to parse journal record %d", i+1)
+		}
+		state.apply(record)
+	}
+	return state, nil
+}
+
+// getJournalPath returns the path of the journal file.
+func (c *gcsCore) getJournalPath() string {
+	return filepath.Join(c.getStorageRootPath(), "journal.json")
+}
+
+// readJournal returns the state described by the journal file, which is empty
+// if there is no journal file.
+func (c *gcsCore) readJournal() (*journaledState, error) {
+	path := c.getJournalPath()
+	exists, err := c.OS.PathExists(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to determine if journal %s exists", path)
+	}
+	var contents []byte
+	if exists {
+		if contents, err = c.OS.ReadFile(path); err != nil {
+			return nil, errors.Wrapf(err, "failed to read journal %s", path)
+		}
+	}
+	return replayJournal(contents)
+}
+
+// snapshotJournal returns the records which describe the current state of the
+// GCS's caches.
+// This function expects containerCacheMutex, processCacheMutex and
+// externalProcessCacheMutex to be locked on entry.
+func (c *gcsCore) snapshotJournal() []journalRecord {
+	var records []journalRecord
+	ids := make([]string, 0, len(c.containerCache))
+	for id := range c.containerCache {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		entry := c.containerCache[id]
+		record := journalRecord{Op: journalCreateContainer, ID: id}
+		if entry.ExitStatus == nil {
+			record.NetworkAdapters = entry.NetworkAdapters
+			for _, disk := range entry.MappedVirtualDisks {
+				record.MappedVirtualDisks = append(record.MappedVirtualDisks, disk)
+			}
+			sort.Slice(record.MappedVirtualDisks, func(i, j int) bool {
+				a, b := record.MappedVirtualDisks[i], record.MappedVirtualDisks[j]
+				return a.Controller < b.Controller || (a.Controller == b.Controller && a.Lun < b.Lun)
+			})
+		}
+		records = append(records, record)
+		if entry.ExitStatus == nil && len(entry.Processes) > 0 && len(entry.NetworkAdapters) > 0 {
+			records = append(records, journalRecord{Op: journalMoveNetworkAdapter, ID: id, NetworkAdapters: entry.NetworkAdapters})
+		}
+		for _, pid := range entry.Processes {
+			records = append(records, snapshotProcess(id, pid, c.processCache[pid])...)
+		}
+		if entry.exitHookPending() {
+			records = append(records, journalRecord{Op: journalRegisterExitHook, ID: id})
+		}
+	}
+
+	pids := make([]int, 0, len(c.externalProcessCache))
+	for pid := range c.externalProcessCache {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		records = append(records, snapshotProcess("", pid, c.externalProcessCache[pid])...)
+	}
+	return records
+}
+
+// snapshotProcess returns the records which describe the process with the
+// given pid and cache entry, if it is still running or the host is still
+// waiting on its exit.
+func snapshotProcess(id string, pid int, entry *processCacheEntry) []journalRecord {
+	if entry == nil || (entry.ExitStatus != nil && !entry.exitHookPending()) {
+		return nil
+	}
+	records := []journalRecord{{Op: journalStartProcess, ID: id, Pid: pid, StartTime: entry.StartTime}}
+	if entry.exitHookPending() {
+		records = append(records, journalRecord{Op: journalRegisterExitHook, Pid: pid})
+	}
+	return records
+}
+
+// compactJournal replaces the journal file with the records describing the
+// current state of the GCS's caches, and opens it for appending further
+// records. The new journal is written to a temporary file first, so that a
+// GCS stopping while it is being written still finds the old journal.
+// The process caches stay locked until the new journal is opened, so that no
+// process's transition can be recorded in the old journal after the snapshot
+// has been taken without it.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) compactJournal() error {
+	c.processCacheMutex.Lock()
+	defer c.processCacheMutex.Unlock()
+	c.externalProcessCacheMutex.Lock()
+	defer c.externalProcessCacheMutex.Unlock()
+
+	path := c.getJournalPath()
+	tempPath := path + ".tmp"
+	file, err := c.OS.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_SYNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create journal %s", tempPath)
+	}
+	encoder := json.NewEncoder(file)
+	for _, record := range c.snapshotJournal() {
+		if err := encoder.Encode(record); err != nil {
+			file.Close()
+			return errors.Wrapf(err, "failed to write journal %s", tempPath)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close journal %s", tempPath)
+	}
+	if err := c.OS.Rename(tempPath, path); err != nil {
+		return errors.Wrapf(err, "failed to replace journal %s", path)
+	}
+	if c.journal != nil {
+		return c.journal.reopen(c.OS, path)
+	}
+	if c.journal, err = openJournal(c.OS, path); err != nil {
+		return err
+	}
+	go c.compactJournalWhenFull(c.journal)
+	return nil
+}
+
+// compactJournalWhenFull compacts the given journal each time it signals that
+// enough records have been appended to it.
+func (c *gcsCore) compactJournalWhenFull(j *journal) {
+	for range j.full {
+		c.containerCacheMutex.Lock()
+		if err := c.compactJournal(); err != nil {
+			logrus.Errorf("failed to compact the journal: %s", err)
+		}
+		c.containerCacheMutex.Unlock()
+	}
+}
+
+// processStarted adds the entry of the process with the given pid, which was
+// started in the container with the given ID, or externally if the ID is
+// empty, to the process caches, and records its start in the journal. The
+// process's start time is saved in the entry, so that the process can be told
+// apart from a later one reusing its pid. The start is only recorded once the
+// process is cached, so that a compaction of the journal in between doesn't
+// leave it out.
+func (c *gcsCore) processStarted(id string, pid int, entry *processCacheEntry) {
+	if startTime, err := c.getProcessStartTime(pid); err == nil {
+		entry.StartTime = startTime
+	}
+	c.cacheProcess(pid, entry, id == "")
+	c.journal.record(journalRecord{Op: journalStartProcess, ID: id, Pid: pid, StartTime: entry.StartTime})
+}
@@ -0,0 +1,188 @@
+package gcs
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+)
+
+// layerDevice identifies the device holding a layer.
+type layerDevice struct {
+	// Name is the name of the device (sda, pmem0, etc.).
+	Name string
+	// Verity, if set, is the hash tree the layer is verified against.
+	Verity *prot.LayerVerity
+}
+
+// rootDigest returns the root digest the layer is verified against, or an
+// empty string if it isn't verified.
+func (l layerDevice) rootDigest() string {
+	if l.Verity == nil {
+		return ""
+	}
+	return l.Verity.RootDigest
+}
+
+// layerCacheEntry stores cached information for a single layer device mounted
+// in the utility VM.
+type layerCacheEntry struct {
+	// Path is the VM-wide path the layer is mounted at.
+	Path string
+	// LinkPath is a short symlink to Path, used when the full paths of a
+	// container's layers don't fit in the overlay mount options.
+	LinkPath string
+	// VerityDevice is the name of the device-mapper device the layer is
+	// verified through, if any.
+	VerityDevice string
+	// RootDigest is the root digest the layer is verified against, if any.
+	RootDigest string
+	// Containers is the set of IDs of the containers whose root filesystems
+	// use the layer. The layer is unmounted once it is empty.
+	Containers map[string]struct{}
+}
+
+// acquireLayer adds a reference to the layer on the given device for the
+// container with the given ID, mounting the device if no other container is
+// using it yet. It returns the path the layer is mounted at, as well as a
+// shorter symlink to that path.
+// If the layer has a hash tree, it is mounted through a dm-verity device, and
+// mounting fails if the device doesn't match the tree.
+func (c *gcsCore) acquireLayer(id string, layer layerDevice) (layerPath string, linkPath string, err error) {
+	c.layerCacheMutex.Lock()
+	defer c.layerCacheMutex.Unlock()
+
+	device := layer.Name
+	if entry, ok := c.layerCache[device]; ok {
+		if entry.RootDigest != layer.rootDigest() {
+			return "", "", errors.Errorf("layer on device %s is already in use with a different root digest", device)
+		}
+		entry.Containers[id] = struct{}{}
+		return entry.Path, entry.LinkPath, nil
+	}
+
+	layerPath = c.getLayerPath(device)
+	if err := c.OS.MkdirAll(layerPath, 0700); err != nil {
+		return "", "", errors.Wrapf(err, "failed to create directory for layer %s", layerPath)
+	}
+	devicePath := filepath.Join("/dev", device)
+	var verityDevice string
+	if layer.Verity != nil {
+		verityDevice = getVerityLayerName(device)
+		devicePath, err = c.createVerityDevice(verityDevice, device, layer.Verity)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "failed to set up verification of layer device %s", device)
+		}
+	}
+	// Layers on persistent memory are accessed directly where the filesystem
+	// allows it, rather than through the page cache. This isn't possible
+	// through dm-verity, which must check each block as it is read.
+	var options []string
+	if isPmemDevice(device) && layer.Verity == nil {
+		options = []string{daxMountOption}
+	}
+	if err := c.mountDevice(devicePath, layerPath, true, options); err != nil {
+		if verityDevice != "" {
+			c.removeDeviceMapperDevice(verityDevice)
+		}
+		return "", "", errors.Wrapf(err, "failed to mount layer directory %s", layerPath)
+	}
+	linkPath = c.getLayerLinkPath(device)
+	if err := c.createLayerLink(layerPath, linkPath); err != nil {
+		c.OS.Unmount(layerPath, 0)
+		if verityDevice != "" {
+			c.removeDeviceMapperDevice(verityDevice)
+		}
+		return "", "", err
+	}
+	c.layerCache[device] = &layerCacheEntry{
+		Path:         layerPath,
+		LinkPath:     linkPath,
+		VerityDevice: verityDevice,
+		RootDigest:   layer.rootDigest(),
+		Containers:   map[string]struct{}{id: struct{}{}},
+	}
+	return layerPath, linkPath, nil
+}
+
+// createLayerLink creates a symlink at linkPath to the layer mounted at
+// layerPath, replacing any link left behind at that path.
+func (c *gcsCore) createLayerLink(layerPath, linkPath string) error {
+	if err := c.OS.MkdirAll(filepath.Dir(linkPath), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create directory for layer link %s", linkPath)
+	}
+	if err := c.OS.RemoveAll(linkPath); err != nil {
+		return errors.Wrapf(err, "failed to remove existing layer link %s", linkPath)
+	}
+	if err := c.OS.Symlink(layerPath, linkPath); err != nil {
+		return errors.Wrapf(err, "failed to create layer link %s", linkPath)
+	}
+	return nil
+}
+
+// releaseLayers removes the references held by the container with the given
+// ID to any layers, unmounting the layers which are no longer used by any
+// container.
+func (c *gcsCore) releaseLayers(id string) error {
+	c.layerCacheMutex.Lock()
+	defer c.layerCacheMutex.Unlock()
+
+	for device, entry := range c.layerCache {
+		if _, ok := entry.Containers[id]; !ok {
+			continue
+		}
+		delete(entry.Containers, id)
+		if len(entry.Containers) > 0 {
+			continue
+		}
+
+		layerPath := entry.Path
+		mounted, err := c.OS.PathIsMounted(layerPath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to determine if layer path is mounted %s", layerPath)
+		}
+		if mounted {
+			if err := c.OS.Unmount(layerPath, 0); err != nil {
+				return errors.Wrapf(err, "failed to unmount layer path %s", layerPath)
+			}
+		}
+		if err := c.OS.RemoveAll(layerPath); err != nil {
+			return errors.Wrapf(err, "failed to remove layer path %s", layerPath)
+		}
+		if err := c.OS.RemoveAll(entry.LinkPath); err != nil {
+			return errors.Wrapf(err, "failed to remove layer link %s", entry.LinkPath)
+		}
+		if entry.VerityDevice != "" {
+			if err := c.removeDeviceMapperDevice(entry.VerityDevice); err != nil {
+				return err
+			}
+		}
+		delete(c.layerCache, device)
+	}
+	return nil
+}
+
+// getLayersRootPath returns the path under which the layers shared between
+// containers are mounted.
+func (c *gcsCore) getLayersRootPath() string {
+	return filepath.Join(c.getStorageRootPath(), "layers")
+}
+
+// getLayerPath returns the path where the layer on the given device is
+// mounted.
+func (c *gcsCore) getLayerPath(device string) string {
+	return filepath.Join(c.getLayersRootPath(), device)
+}
+
+// getLayerLinksRootPath returns the path under which the short symlinks to
+// the layers are created.
+func (c *gcsCore) getLayerLinksRootPath() string {
+	return filepath.Join(c.getStorageRootPath(), "l")
+}
+
+// getLayerLinkPath returns the path of the short symlink to the layer on the
+// given device.
+func (c *gcsCore) getLayerLinkPath(device string) string {
+	return filepath.Join(c.getLayerLinksRootPath(), device)
+}
@@ -0,0 +1,131 @@
+package gcs
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+)
+
+// exitedProcessRetention is how long the entry of an exited process is kept in
+// the process caches once the host has been told of its exit, so that the host
+// can still wait on it or query it for a while.
+const exitedProcessRetention = 5 * time.Minute
+
+// exited records that the process has exited with the given state, and runs
+// its exit hooks.
+// This function expects the mutex of the cache holding the entry to be locked
+// on entry.
+func (e *processCacheEntry) exited(state oslayer.ProcessExitState) {
+	e.recordExit(state)
+	e.runExitHooks()
+}
+
+// recordExit records that the process has exited with the given state, as soon
+// as it has been waited on, so that its pid is no longer treated as its own.
+// Its exit hooks aren't run, nor are any registered from then on, until
+// runExitHooks is called once its output has been sent.
+// This function expects the mutex of the cache holding the entry to be locked
+// on entry.
+func (e *processCacheEntry) recordExit(state oslayer.ProcessExitState) {
+	e.ExitStatus = state
+	e.ExitTime = time.Now()
+	e.exitHooksDelayed = true
+}
+
+// runExitHooks runs the exit hooks of the process once its exit has been
+// recorded. Hooks registered from then on are run immediately.
+// This function expects the mutex of the cache holding the entry to be locked
+// on entry.
+func (e *processCacheEntry) runExitHooks() {
+	e.exitHooksDelayed = false
+	for _, hook := range e.ExitHooks {
+		hook(e.ExitStatus)
+	}
+}
+
+// expired returns whether the entry can be removed from its cache at the given
+// time, because its process exited more than exitedProcessRetention ago and
+// the host isn't waiting on it.
+func (e *processCacheEntry) expired(now time.Time) bool {
+	return e.ExitStatus != nil && !e.exitHookPending() && now.Sub(e.ExitTime) >= exitedProcessRetention
+}
+
+// pruneProcessCache removes the expired entries from the given process cache.
+func pruneProcessCache(cache map[int]*processCacheEntry, now time.Time) {
+	for pid, entry := range cache {
+		if entry.expired(now) {
+			delete(cache, pid)
+		}
+	}
+}
+
+// cacheProcess adds the entry of the newly started process with the given pid
+// to the external process cache if external is true, and to the process cache
+// otherwise. Since the pid may have belonged to an earlier process which has
+// since exited, any entry for it is removed from both caches first, so that
+// neither its exit state nor its exit hooks are mistaken for the new
+// process's. Requests naming the earlier process by its start time are
+// rejected from then on, rather than applied to the new process.
+func (c *gcsCore) cacheProcess(pid int, entry *processCacheEntry, external bool) {
+	c.processCacheMutex.Lock()
+	defer c.processCacheMutex.Unlock()
+	c.externalProcessCacheMutex.Lock()
+	defer c.externalProcessCacheMutex.Unlock()
+
+	c.pruneProcessCaches()
+	delete(c.processCache, pid)
+	delete(c.externalProcessCache, pid)
+	if external {
+		c.externalProcessCache[pid] = entry
+	} else {
+		c.processCache[pid] = entry
+	}
+}
+
+// pruneProcessCaches removes the expired entries from both process caches,
+// which keeps them bounded.
+// This function expects processCacheMutex and externalProcessCacheMutex to be
+// locked on entry.
+func (c *gcsCore) pruneProcessCaches() {
+	now := time.Now()
+	pruneProcessCache(c.processCache, now)
+	pruneProcessCache(c.externalProcessCache, now)
+}
+
+// lookupProcess returns the cache entry of the process with the given pid,
+// whether it runs in a container or externally. A process is identified by its
+// pid together with the start time returned when it was started, so an error
+// is returned if the cached process with that pid was started at a different
+// time, in which case the given process has exited and its pid was reused.
+// Hosts which predate start times send zero, in which case the process is
+// identified by its pid alone.
+// Either way, an error is returned if the pid now belongs to a later process
+// than the cached one, which hasn't been seen to exit yet.
+// Expired entries are pruned first, so that a process isn't found once its
+// retention is over.
+// This function expects processCacheMutex and externalProcessCacheMutex to be
+// locked on entry.
+func (c *gcsCore) lookupProcess(pid int, startTime uint64) (*processCacheEntry, error) {
+	c.pruneProcessCaches()
+	entry, ok := c.processCache[pid]
+	if !ok {
+		entry, ok = c.externalProcessCache[pid]
+		if !ok {
+			return nil, errors.WithStack(gcserr.NewProcessDoesNotExistError(pid))
+		}
+	}
+	if startTime != 0 && entry.StartTime != startTime {
+		return nil, errors.Wrapf(gcserr.NewProcessDoesNotExistError(pid), "process %d was started at %d rather than %d, so its pid was reused", pid, entry.StartTime, startTime)
+	}
+	if entry.ExitStatus == nil && entry.StartTime != 0 {
+		// A process whose start time can't be read is exiting, and is still
+		// the cached one until it has been waited on.
+		if currentStartTime, err := c.getProcessStartTime(pid); err == nil && currentStartTime != entry.StartTime {
+			return nil, errors.Wrapf(gcserr.NewProcessDoesNotExistError(pid), "process %d was started at %d rather than %d, so its pid was reused", pid, currentStartTime, entry.StartTime)
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,387 @@
+package gcs
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+)
+
+// The indices of the fields of /proc/<pid>/stat used by the GCS, counted from
+// the state, which is the first field after the command name. See proc(5).
+const (
+	statState       = 0
+	statParentPid   = 1
+	statUserTime    = 11
+	statSystemTime  = 12
+	statThreadCount = 17
+	statStartTime   = 19
+	statRSS         = 21
+)
+
+// clockTicksPerSecond is USER_HZ, the unit of the times in /proc/<pid>/stat.
+// It is part of the kernel's ABI, and is 100 on every architecture the utility
+// VM runs on.
+const clockTicksPerSecond = 100
+
+// procStatFields returns the fields of the given contents of a
+// /proc/<pid>/stat file which follow the command name.
+func procStatFields(contents []byte) ([]string, error) {
+	// The command name may contain spaces and parentheses, so the remaining
+	// fields are found after its last closing parenthesis.
+	end := bytes.LastIndexByte(contents, ')')
+	if end == -1 {
+		return nil, errors.Errorf("stat \"%s\" is missing the command name", contents)
+	}
+	fields := strings.Fields(string(contents[end+1:]))
+	if len(fields) <= statRSS {
+		return nil, errors.Errorf("stat \"%s\" has too few fields", contents)
+	}
+	return fields, nil
+}
+
+// procStat holds the details of a process read from its /proc/<pid>/stat file.
+type procStat struct {
+	State       string
+	ParentPid   int
+	CPUTime     time.Duration
+	ThreadCount int
+	// StartTime is in clock ticks since boot.
+	StartTime uint64
+	// RSS is in pages.
+	RSS uint64
+}
+
+// parseProcStatDetails returns the details of a process from the contents of
+// its /proc/<pid>/stat file.
+func parseProcStatDetails(contents []byte) (*procStat, error) {
+	fields, err := procStatFields(contents)
+	if err != nil {
+		return nil, err
+	}
+	var values [statRSS + 1]uint64
+	for _, i := range []int{statParentPid, statUserTime, statSystemTime, statThreadCount, statStartTime, statRSS} {
+		if values[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse field \"%s\" of stat \"%s\"", fields[i], contents)
+		}
+	}
+	ticks := values[statUserTime] + values[statSystemTime]
+	return &procStat{
+		State:       fields[statState],
+		ParentPid:   int(values[statParentPid]),
+		CPUTime:     time.Duration(ticks) * time.Second / clockTicksPerSecond,
+		ThreadCount: int(values[statThreadCount]),
+		StartTime:   values[statStartTime],
+		RSS:         values[statRSS],
+	}, nil
+}
+
+// parseProcStatusUID returns the real user ID of a process from the contents
+// of its /proc/<pid>/status file.
+func parseProcStatusUID(contents []byte) (int, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "Uid:" {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to parse uid \"%s\"", fields[1])
+		}
+		return uid, nil
+	}
+	return 0, errors.New("status is missing the Uid field")
+}
+
+// parseBootTime returns the time the system booted at from the contents of
+// /proc/stat.
+func parseBootTime(contents []byte) (time.Time, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "btime" {
+			continue
+		}
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "failed to parse boot time \"%s\"", fields[1])
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Time{}, errors.New("stat is missing the boot time")
+}
+
+// parsePasswd returns the user names by user ID from the contents of an
+// /etc/passwd file. Malformed lines are ignored.
+func parsePasswd(contents []byte) map[int]string {
+	users := make(map[int]string)
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		if _, ok := users[uid]; !ok {
+			users[uid] = fields[0]
+		}
+	}
+	return users
+}
+
+// readBootTime returns the time the utility VM booted at, or the zero time if
+// it can't be read.
+func (c *gcsCore) readBootTime() time.Time {
+	contents, err := c.OS.ReadFile("/proc/stat")
+	if err != nil {
+		logrus.Warnf("failed to read the boot time: %v", err)
+		return time.Time{}
+	}
+	bootTime, err := parseBootTime(contents)
+	if err != nil {
+		logrus.Warnf("failed to read the boot time: %v", err)
+	}
+	return bootTime
+}
+
+// readUsers returns the user names by user ID from the passwd file at the
+// given path, or nil if it can't be read.
+func (c *gcsCore) readUsers(passwdPath string) map[int]string {
+	contents, err := c.OS.ReadFile(passwdPath)
+	if err != nil {
+		return nil
+	}
+	return parsePasswd(contents)
+}
+
+// startTimeFromTicks returns the time a process started at from its start
+// time in clock ticks after the given boot time, or the zero time if the boot
+// time is unknown.
+func startTimeFromTicks(bootTime time.Time, ticks uint64) time.Time {
+	if bootTime.IsZero() {
+		return time.Time{}
+	}
+	return bootTime.Add(time.Duration(ticks) * time.Second / clockTicksPerSecond)
+}
+
+// addProcessDetails fills in the details of the given processes from /proc,
+// looking up user names in the given users. The details of processes which
+// have already exited are left unset.
+func (c *gcsCore) addProcessDetails(processes []runtime.ContainerProcessState, users map[int]string) {
+	bootTime := c.readBootTime()
+	for i := range processes {
+		process := &processes[i]
+		procPath := filepath.Join("/proc", strconv.Itoa(process.Pid))
+		contents, err := c.OS.ReadFile(filepath.Join(procPath, "stat"))
+		if err != nil {
+			continue
+		}
+		stat, err := parseProcStatDetails(contents)
+		if err != nil {
+			logrus.Warnf("failed to parse stat of process %d: %v", process.Pid, err)
+			continue
+		}
+		process.ParentPid = stat.ParentPid
+		process.State = stat.State
+		process.CPUTime = stat.CPUTime
+		process.ThreadCount = stat.ThreadCount
+		process.MemoryRSS = stat.RSS * uint64(os.Getpagesize())
+		process.StartTime = startTimeFromTicks(bootTime, stat.StartTime)
+
+		contents, err = c.OS.ReadFile(filepath.Join(procPath, "status"))
+		if err != nil {
+			continue
+		}
+		uid, err := parseProcStatusUID(contents)
+		if err != nil {
+			logrus.Warnf("failed to parse status of process %d: %v", process.Pid, err)
+			continue
+		}
+		process.UID = uid
+		process.User = users[uid]
+		if process.User == "" {
+			process.User = strconv.Itoa(uid)
+		}
+	}
+}
+
+// readCommand returns the command line of the process with the given pid, or
+// nil if it can't be read, as is the case for kernel threads.
+func (c *gcsCore) readCommand(pid int) []string {
+	contents, err := c.OS.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil || len(contents) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(contents), "\x00"), "\x00")
+}
+
+// listVMPids returns the pids of every process running in the utility VM.
+func (c *gcsCore) listVMPids() ([]int, error) {
+	entries, err := c.OS.ReadDir("/proc")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the processes of the utility VM")
+	}
+	var pids []int
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(filepath.Base(entry.Name())); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// ListExternalProcesses returns the processes started by RunExternalProcess,
+// including those which have exited until their cache entries expire.
+func (c *gcsCore) ListExternalProcesses() ([]prot.ExternalProcess, error) {
+	bootTime := c.readBootTime()
+	c.externalProcessCacheMutex.Lock()
+	defer c.externalProcessCacheMutex.Unlock()
+
+	pruneProcessCache(c.externalProcessCache, time.Now())
+	pids := make([]int, 0, len(c.externalProcessCache))
+	for pid := range c.externalProcessCache {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	processes := make([]prot.ExternalProcess, 0, len(pids))
+	for _, pid := range pids {
+		entry := c.externalProcessCache[pid]
+		process := prot.ExternalProcess{
+			ProcessID: uint32(pid),
+			Command:   entry.Command,
+			Status:    prot.EpsRunning,
+		}
+		if entry.StartTime != 0 {
+			process.StartTime = startTimeFromTicks(bootTime, entry.StartTime)
+		}
+		if entry.ExitStatus != nil {
+			process.Status = prot.EpsExited
+			process.ExitCode = int32(entry.ExitStatus.ExitCode())
+		} else if process.Command == nil {
+			process.Command = c.readCommand(pid)
+		}
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+// ListVMProcesses returns every process running in the utility VM, whether in
+// a container or not, along with their details read from /proc. User names are
+// looked up in the utility VM's /etc/passwd.
+func (c *gcsCore) ListVMProcesses() ([]runtime.ContainerProcessState, error) {
+	pids, err := c.listVMPids()
+	if err != nil {
+		return nil, err
+	}
+	processes := make([]runtime.ContainerProcessState, 0, len(pids))
+	for _, pid := range pids {
+		processes = append(processes, runtime.ContainerProcessState{Pid: pid, Command: c.readCommand(pid)})
+	}
+	c.addProcessDetails(processes, c.readUsers("/etc/passwd"))
+	return processes, nil
+}
+
+// GetVMResources returns the resource usage of the utility VM.
+func (c *gcsCore) GetVMResources() (*prot.VMResources, error) {
+	resources := &prot.VMResources{CPUCount: goruntime.NumCPU()}
+
+	contents, err := c.OS.ReadFile("/proc/meminfo")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the memory usage of the utility VM")
+	}
+	if resources.MemoryTotal, resources.MemoryAvailable, err = parseMeminfo(contents); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the memory usage of the utility VM")
+	}
+	if contents, err = c.OS.ReadFile("/proc/loadavg"); err != nil {
+		return nil, errors.Wrap(err, "failed to read the load average of the utility VM")
+	}
+	if resources.LoadAverage, err = parseLoadAverage(contents); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the load average of the utility VM")
+	}
+	if contents, err = c.OS.ReadFile("/proc/uptime"); err != nil {
+		return nil, errors.Wrap(err, "failed to read the uptime of the utility VM")
+	}
+	if resources.UptimeInSeconds, err = parseUptime(contents); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the uptime of the utility VM")
+	}
+	pids, err := c.listVMPids()
+	if err != nil {
+		return nil, err
+	}
+	resources.ProcessCount = len(pids)
+	return resources, nil
+}
+
+// parseMeminfo returns the total and available memory, in bytes, from the
+// contents of /proc/meminfo.
+func parseMeminfo(contents []byte) (total uint64, available uint64, err error) {
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		// Lines are of the form "MemTotal:       2048000 kB".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid value \"%s\" of %s", fields[1], fields[0])
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = value * 1024
+	}
+	var ok bool
+	if total, ok = values["MemTotal"]; !ok {
+		return 0, 0, errors.New("meminfo is missing MemTotal")
+	}
+	if available, ok = values["MemAvailable"]; !ok {
+		return 0, 0, errors.New("meminfo is missing MemAvailable")
+	}
+	return total, available, nil
+}
+
+// parseLoadAverage returns the load averages over the last 1, 5 and 15
+// minutes from the contents of /proc/loadavg.
+func parseLoadAverage(contents []byte) ([3]float64, error) {
+	var loadAverage [3]float64
+	fields := strings.Fields(string(contents))
+	if len(fields) < 3 {
+		return loadAverage, errors.Errorf("loadavg \"%s\" has too few fields", contents)
+	}
+	for i := range loadAverage {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return loadAverage, errors.Wrapf(err, "invalid load average \"%s\"", fields[i])
+		}
+		loadAverage[i] = value
+	}
+	return loadAverage, nil
+}
+
+// parseUptime returns the time elapsed since boot, in seconds, from the
+// contents of /proc/uptime.
+func parseUptime(contents []byte) (float64, error) {
+	fields := strings.Fields(string(contents))
+	if len(fields) == 0 {
+		return 0, errors.New("uptime is empty")
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid uptime \"%s\"", fields[0])
+	}
+	return uptime, nil
+}
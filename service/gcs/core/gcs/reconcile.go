@@ -0,0 +1,549 @@
+package gcs
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+	"github.com/Microsoft/opengcs/service/libs/commonutils"
+)
+
+// adoptedProcessPollInterval is how often the init process of an adopted
+// container is checked for having exited.
+const adoptedProcessPollInterval = time.Second
+
+// ReconcileReport describes the state left behind by a previous instance of
+// the GCS, and what Reconcile did with it.
+type ReconcileReport struct {
+	// AdoptedContainers are the IDs of the running containers which were
+	// added back to the GCS's cache.
+	AdoptedContainers []string
+	// AdoptedProcesses are the pids of the running processes, other than
+	// containers' init processes, which were added back to the GCS's cache.
+	AdoptedProcesses []int
+	// RemovedContainers are the IDs of the containers whose processes,
+	// mounts and storage were torn down.
+	RemovedContainers []string
+	// RemovedLayers are the devices of the layers which were unmounted
+	// because no adopted container uses them.
+	RemovedLayers []string
+	// RemovedRuntimeFiles are the IDs of the containers whose files were
+	// removed from the runtime's state directory.
+	RemovedRuntimeFiles []string
+}
+
+// adoptedExitState is the exit state reported for the init process of an
+// adopted container. The process isn't a child of the GCS, so its exit code
+// can't be collected.
+type adoptedExitState struct{}
+
+func (adoptedExitState) ExitCode() int {
+	return -1
+}
+
+func (adoptedExitState) Signal() int {
+	return 0
+}
+
+// mountEntry describes a single mount, as listed in /proc/mounts.
+type mountEntry struct {
+	Source  string
+	Target  string
+	FSType  string
+	Options []string
+}
+
+// parseMounts parses the contents of /proc/mounts.
+func parseMounts(contents []byte) []mountEntry {
+	var mounts []mountEntry
+	for _, line := range bytes.Split(contents, []byte{'\n'}) {
+		fields := strings.Fields(string(line))
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			Source:  fields[0],
+			Target:  fields[1],
+			FSType:  fields[2],
+			Options: strings.Split(fields[3], ","),
+		})
+	}
+	return mounts
+}
+
+// findMount returns the topmost mount on the given target, if any.
+func findMount(mounts []mountEntry, target string) (mountEntry, bool) {
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].Target == target {
+			return mounts[i], true
+		}
+	}
+	return mountEntry{}, false
+}
+
+// overlayLowerDirs returns the lower directories of the given overlay mount.
+func overlayLowerDirs(mount mountEntry) []string {
+	for _, option := range mount.Options {
+		if strings.HasPrefix(option, "lowerdir=") {
+			return strings.Split(strings.TrimPrefix(option, "lowerdir="), ":")
+		}
+	}
+	return nil
+}
+
+// parseProcStat returns the state and start time of a process from the
+// contents of its /proc/<pid>/stat file.
+func parseProcStat(contents []byte) (state string, startTime uint64, err error) {
+	fields, err := procStatFields(contents)
+	if err != nil {
+		return "", 0, err
+	}
+	startTime, err = strconv.ParseUint(fields[statStartTime], 10, 64)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "failed to parse start time \"%s\"", fields[statStartTime])
+	}
+	return fields[statState], startTime, nil
+}
+
+// getProcessStartTime returns the start time of the process with the given
+// pid, which together with the pid identifies the process even if the pid is
+// reused. An error is returned if the process has exited.
+func (c *gcsCore) getProcessStartTime(pid int) (uint64, error) {
+	contents, err := c.OS.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read stat of process %d", pid)
+	}
+	state, startTime, err := parseProcStat(contents)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse stat of process %d", pid)
+	}
+	if state == "Z" || state == "X" {
+		return 0, errors.Errorf("process %d has exited", pid)
+	}
+	return startTime, nil
+}
+
+// Reconcile brings the GCS's cache back in line with the state left behind by
+// a previous instance of the GCS, as described by the journal and found on the
+// system. Running containers and processes are adopted, with exit hooks armed
+// on them, while any other containers, their storage, and the layers no longer
+// in use are torn down. The journal is then compacted, and records each state
+// transition from then on.
+// It should be called once, before any other calls into the gcsCore.
+func (c *gcsCore) Reconcile() (*ReconcileReport, error) {
+	c.containerCacheMutex.Lock()
+	defer c.containerCacheMutex.Unlock()
+
+	report := &ReconcileReport{}
+	journaled, err := c.readJournal()
+	if err != nil {
+		return nil, err
+	}
+	contents, err := c.OS.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the mount table")
+	}
+	mounts := parseMounts(contents)
+
+	states, err := c.Rtime.ListContainerStates()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the runtime's containers")
+	}
+	known := make(map[string]bool)
+	for _, state := range states {
+		known[state.ID] = true
+		container := journaled.Containers[state.ID]
+		pids, err := c.adoptContainer(state, container, mounts)
+		if err != nil {
+			utils.LogMsgf("not adopting container %s: %s", state.ID, err)
+			c.removeContainer(state.ID, container)
+			report.RemovedContainers = append(report.RemovedContainers, state.ID)
+			continue
+		}
+		report.AdoptedContainers = append(report.AdoptedContainers, state.ID)
+		report.AdoptedProcesses = append(report.AdoptedProcesses, pids...)
+	}
+
+	// Containers whose init process hasn't been started aren't known to the
+	// runtime, but are in the journal.
+	ids := make([]string, 0, len(journaled.Containers))
+	for id := range journaled.Containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if known[id] {
+			continue
+		}
+		known[id] = true
+		container := journaled.Containers[id]
+		if len(container.Processes) == 0 {
+			err = c.adoptCreatedContainer(id, container, mounts)
+		} else {
+			err = errors.New("its init process is no longer running")
+		}
+		if err != nil {
+			utils.LogMsgf("not adopting container %s: %s", id, err)
+			c.removeContainer(id, container)
+			report.RemovedContainers = append(report.RemovedContainers, id)
+			continue
+		}
+		report.AdoptedContainers = append(report.AdoptedContainers, id)
+	}
+
+	// Tear down the storage of containers which are neither known to the
+	// runtime nor in the journal, such as those which were being created when
+	// the previous GCS stopped.
+	rootPath := c.getStorageRootPath()
+	exists, err := c.OS.PathExists(rootPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to determine if storage path %s exists", rootPath)
+	}
+	if exists {
+		entries, err := c.OS.ReadDir(rootPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read storage path %s", rootPath)
+		}
+		for _, entry := range entries {
+			id := filepath.Base(entry.Name())
+			path := filepath.Join(rootPath, id)
+			if known[id] || path == c.getLayersRootPath() || path == c.getLayerLinksRootPath() || strings.HasPrefix(path, c.getJournalPath()) {
+				continue
+			}
+			if err := c.unmountLayers(id); err != nil {
+				logrus.Error(err)
+			}
+			if err := c.destroyContainerStorage(id); err != nil {
+				logrus.Error(err)
+			}
+			report.RemovedContainers = append(report.RemovedContainers, id)
+		}
+	}
+
+	pids := make([]int, 0, len(journaled.ExternalProcesses))
+	for pid := range journaled.ExternalProcesses {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		if c.adoptExternalProcess(journaled.ExternalProcesses[pid]) {
+			report.AdoptedProcesses = append(report.AdoptedProcesses, pid)
+		}
+	}
+
+	// Unmount the layers which no adopted container uses.
+	c.layerCacheMutex.Lock()
+	for _, mount := range mounts {
+		if filepath.Dir(mount.Target) != c.getLayersRootPath() {
+			continue
+		}
+		device := filepath.Base(mount.Target)
+		if _, ok := c.layerCache[device]; ok {
+			continue
+		}
+		if err := c.removeLayer(device); err != nil {
+			logrus.Error(err)
+			continue
+		}
+		report.RemovedLayers = append(report.RemovedLayers, device)
+	}
+	c.layerCacheMutex.Unlock()
+
+	removed, err := c.Rtime.CleanupStaleContainerFiles()
+	if err != nil {
+		logrus.Error(err)
+	}
+	report.RemovedRuntimeFiles = removed
+
+	if err := c.compactJournal(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// checkProcessStartTime returns the start time of the process with the given
+// pid, as long as it is still running and, if journaledStartTime isn't zero,
+// is the process which was started with that start time rather than a later
+// one reusing its pid.
+func (c *gcsCore) checkProcessStartTime(pid int, journaledStartTime uint64) (uint64, error) {
+	startTime, err := c.getProcessStartTime(pid)
+	if err != nil {
+		return 0, err
+	}
+	if journaledStartTime != 0 && startTime != journaledStartTime {
+		return 0, errors.Errorf("process %d was started at %d rather than %d, so its pid was reused", pid, startTime, journaledStartTime)
+	}
+	return startTime, nil
+}
+
+// watchAdoptedProcess calls exited once the process with the given pid and
+// start time has exited. The process isn't a child of the GCS, so it is polled
+// rather than waited on.
+func (c *gcsCore) watchAdoptedProcess(pid int, startTime uint64, exited func()) {
+	go func() {
+		for {
+			time.Sleep(adoptedProcessPollInterval)
+			if current, err := c.getProcessStartTime(pid); err != nil || current != startTime {
+				break
+			}
+		}
+		exited()
+	}()
+}
+
+// restoreContainerEntry adds a cache entry for the container with the given ID
+// to the cache, along with references to its mapped virtual disks as described
+// by the given journaled container, which may be nil.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) restoreContainerEntry(id string, container *journaledContainer) *containerCacheEntry {
+	containerEntry := newContainerCacheEntry(id)
+	if container != nil {
+		c.mappedVirtualDiskCacheMutex.Lock()
+		for _, disk := range container.MappedVirtualDisks {
+			if err := containerEntry.AddMappedVirtualDisk(disk); err != nil {
+				logrus.Warn(err)
+				continue
+			}
+			key := newMappedVirtualDiskKey(disk)
+			if entry, ok := c.mappedVirtualDiskCache[key]; ok {
+				entry.RefCount++
+			} else {
+				c.mappedVirtualDiskCache[key] = &mappedVirtualDiskCacheEntry{Disk: disk, RefCount: 1}
+			}
+		}
+		c.mappedVirtualDiskCacheMutex.Unlock()
+		containerEntry.NetworkAdapters = container.NetworkAdapters
+		containerEntry.ExitHookPending = container.ExitHookPending
+	}
+	c.containerCache[id] = containerEntry
+	return containerEntry
+}
+
+// removeContainer tears down the processes, mounts and storage of the
+// container with the given ID, which can't be adopted. If the host was waiting
+// on the exit of the container, or of any of its processes, they are kept in
+// the cache as having exited, so that the host is told of their exit once it
+// registers an exit hook on them again.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) removeContainer(id string, container *journaledContainer) {
+	containerEntry := c.restoreContainerEntry(id, container)
+	if err := c.CleanupContainer(id); err != nil {
+		logrus.Error(err)
+	}
+	if !containerEntry.ExitHookPending {
+		delete(c.containerCache, id)
+	} else {
+		containerEntry.ExitStatus = adoptedExitState{}
+	}
+	if container == nil {
+		return
+	}
+	c.processCacheMutex.Lock()
+	defer c.processCacheMutex.Unlock()
+	for _, process := range container.Processes {
+		if process.ExitHookPending {
+			c.processCache[process.Pid] = &processCacheEntry{
+				ExitStatus:      adoptedExitState{},
+				StartTime:       process.StartTime,
+				ExitTime:        time.Now(),
+				ExitHookPending: true,
+			}
+		}
+	}
+}
+
+// adoptContainer adds the container described by the given state and journaled
+// container, which may be nil, to the cache if its init process is still
+// running, along with the layers its root filesystem uses according to the
+// given mounts. It then arms its exit hooks by watching its init process, and
+// adopts its other processes. It returns the pids of the adopted processes
+// other than the init process.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) adoptContainer(state runtime.ContainerState, container *journaledContainer, mounts []mountEntry) ([]int, error) {
+	if state.Status != "running" && state.Status != "paused" {
+		return nil, errors.Errorf("container is %s", state.Status)
+	}
+	initProcess := &journaledProcess{Pid: state.Pid}
+	if container != nil && len(container.Processes) > 0 {
+		if container.Processes[0].Pid != state.Pid {
+			return nil, errors.Errorf("its init process %d is not the journaled init process %d", state.Pid, container.Processes[0].Pid)
+		}
+		initProcess = container.Processes[0]
+	}
+	startTime, err := c.checkProcessStartTime(state.Pid, initProcess.StartTime)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, rootfsPath := c.getUnioningPaths(state.ID)
+	if mount, ok := findMount(mounts, rootfsPath); ok && mount.FSType == "overlay" {
+		if err := c.adoptLayers(state.ID, overlayLowerDirs(mount), mounts); err != nil {
+			return nil, err
+		}
+	}
+
+	containerEntry := c.restoreContainerEntry(state.ID, container)
+	containerEntry.AddProcess(state.Pid)
+	processEntry := &processCacheEntry{StartTime: startTime, ExitHookPending: initProcess.ExitHookPending}
+	c.processCacheMutex.Lock()
+	c.processCache[state.Pid] = processEntry
+	c.processCacheMutex.Unlock()
+	c.watchContainerEvents(state.ID, containerEntry)
+	c.watchAdoptedProcess(state.Pid, startTime, func() {
+		utils.LogMsgf("adopted container init process %d exited", state.Pid)
+		c.containerExited(state.ID, state.Pid, containerEntry, processEntry, adoptedExitState{})
+	})
+
+	var pids []int
+	if container != nil && len(container.Processes) > 1 {
+		c.processCacheMutex.Lock()
+		defer c.processCacheMutex.Unlock()
+		for _, process := range container.Processes[1:] {
+			processEntry, adopted := c.adoptProcess(state.ID, process, &c.processCacheMutex)
+			if processEntry == nil {
+				continue
+			}
+			containerEntry.AddProcess(process.Pid)
+			c.processCache[process.Pid] = processEntry
+			if adopted {
+				pids = append(pids, process.Pid)
+			}
+		}
+	}
+	return pids, nil
+}
+
+// adoptCreatedContainer adds the container with the given ID, which was
+// created but whose init process wasn't started, to the cache, along with the
+// layers its root filesystem uses according to the given mounts.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) adoptCreatedContainer(id string, container *journaledContainer, mounts []mountEntry) error {
+	_, _, rootfsPath := c.getUnioningPaths(id)
+	mount, ok := findMount(mounts, rootfsPath)
+	if !ok {
+		return errors.Errorf("its root filesystem %s is not mounted", rootfsPath)
+	}
+	if mount.FSType == "overlay" {
+		if err := c.adoptLayers(id, overlayLowerDirs(mount), mounts); err != nil {
+			return err
+		}
+	}
+	c.restoreContainerEntry(id, container)
+	return nil
+}
+
+// adoptProcess returns the cache entry for the given journaled process, which
+// runs in the container with the given ID, or externally if the ID is empty.
+// If the process is still running, its exit hooks are armed and adopted is
+// true. If it has exited while the host was waiting on it, the entry records
+// its exit, and otherwise no entry is returned. The given mutex guards the
+// cache the entry is added to.
+func (c *gcsCore) adoptProcess(id string, process *journaledProcess, mutex *sync.RWMutex) (entry *processCacheEntry, adopted bool) {
+	startTime, err := c.checkProcessStartTime(process.Pid, process.StartTime)
+	if err != nil {
+		if !process.ExitHookPending {
+			return nil, false
+		}
+		return &processCacheEntry{
+			ExitStatus:      adoptedExitState{},
+			StartTime:       process.StartTime,
+			ExitTime:        time.Now(),
+			ExitHookPending: true,
+		}, false
+	}
+	entry = &processCacheEntry{StartTime: startTime, ExitHookPending: process.ExitHookPending}
+	c.watchAdoptedProcess(process.Pid, startTime, func() {
+		utils.LogMsgf("adopted process %d exited", process.Pid)
+		state := adoptedExitState{}
+		mutex.Lock()
+		entry.exited(state)
+		if len(entry.ExitHooks) > 0 {
+			entry.ExitHookPending = false
+		}
+		delivered := !entry.ExitHookPending
+		mutex.Unlock()
+		// The host hasn't been told of the exit if it was waiting on the
+		// process but hasn't registered an exit hook again yet.
+		if delivered {
+			c.journal.record(journalRecord{Op: journalProcessExited, ID: id, Pid: process.Pid, ExitCode: state.ExitCode()})
+		}
+		if id != "" {
+			if err := c.Rtime.DeleteProcess(id, process.Pid); err != nil {
+				logrus.Error(err)
+			}
+		}
+	})
+	return entry, true
+}
+
+// adoptExternalProcess adds the given journaled external process to the
+// cache, and returns whether it is still running.
+func (c *gcsCore) adoptExternalProcess(process *journaledProcess) bool {
+	c.externalProcessCacheMutex.Lock()
+	defer c.externalProcessCacheMutex.Unlock()
+	entry, adopted := c.adoptProcess("", process, &c.externalProcessCacheMutex)
+	if entry != nil {
+		c.externalProcessCache[process.Pid] = entry
+	}
+	return adopted
+}
+
+// adoptLayers adds references to the layers mounted at the given lower
+// directories of a container's root filesystem to the layer cache, on behalf
+// of the container with the given ID.
+func (c *gcsCore) adoptLayers(id string, lowerDirs []string, mounts []mountEntry) error {
+	c.layerCacheMutex.Lock()
+	defer c.layerCacheMutex.Unlock()
+
+	for _, dir := range lowerDirs {
+		device := filepath.Base(dir)
+		if dir != c.getLayerPath(device) && dir != c.getLayerLinkPath(device) {
+			continue
+		}
+		if entry, ok := c.layerCache[device]; ok {
+			entry.Containers[id] = struct{}{}
+			continue
+		}
+		entry := &layerCacheEntry{
+			Path:       c.getLayerPath(device),
+			LinkPath:   c.getLayerLinkPath(device),
+			Containers: map[string]struct{}{id: struct{}{}},
+		}
+		verityDevice := getVerityLayerName(device)
+		if mount, ok := findMount(mounts, entry.Path); ok && mount.Source == filepath.Join(deviceMapperPath, verityDevice) {
+			rootDigest, err := c.getVerityRootDigest(verityDevice)
+			if err != nil {
+				return err
+			}
+			entry.VerityDevice = verityDevice
+			entry.RootDigest = rootDigest
+		}
+		c.layerCache[device] = entry
+	}
+	return nil
+}
+
+// removeLayer unmounts the layer on the given device, which isn't in the layer
+// cache, and removes its path, link and verity device.
+func (c *gcsCore) removeLayer(device string) error {
+	layerPath := c.getLayerPath(device)
+	if err := c.OS.Unmount(layerPath, 0); err != nil {
+		return errors.Wrapf(err, "failed to unmount layer path %s", layerPath)
+	}
+	if err := c.OS.RemoveAll(layerPath); err != nil {
+		return errors.Wrapf(err, "failed to remove layer path %s", layerPath)
+	}
+	linkPath := c.getLayerLinkPath(device)
+	if err := c.OS.RemoveAll(linkPath); err != nil {
+		return errors.Wrapf(err, "failed to remove layer link %s", linkPath)
+	}
+	return c.removeDeviceMapperDevice(getVerityLayerName(device))
+}
@@ -2,10 +2,12 @@ package gcs
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -14,6 +16,7 @@ import (
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/Microsoft/opengcs/service/libs/commonutils"
 )
@@ -23,32 +26,50 @@ const (
 	// that will be used as the base layer for containers.
 	baseFilesPath = "/mnt/base/"
 
-	// deviceLookupTimeout is the amount of time before deviceIDToName will
-	// give up trying to look up the device name from its ID.
-	deviceLookupTimeout = time.Second * 2
+	// deviceTimeout is the amount of time to wait for a device to be added
+	// to or removed from the utility VM before giving up. Devices are
+	// reported as soon as the kernel announces them, so this only needs to
+	// cover a heavily loaded VM.
+	deviceTimeout = time.Second * 30
 
-	// mappedDiskMountTimeout is the amount of time before
-	// mountMappedVirtualDisks will give up trying to mount a device.
-	mappedDiskMountTimeout = time.Second * 2
+	// scsiHostsPath is the directory containing an entry for each SCSI host
+	// in the utility VM.
+	scsiHostsPath = "/sys/class/scsi_host"
+
+	// storvscDriverName is the name of the driver for Hyper-V SCSI
+	// controllers.
+	storvscDriverName = "storvsc"
 )
 
-// getLayerDevices turns a list of SCSI codes (0-0, 0-1, etc.) into a list of
-// the devices (sda, sdb, etc.) that they correspond to.
-func (c *gcsCore) getLayerDevices(scratch string, layers []prot.Layer) (scratchDevice string, layerDevices []string, err error) {
-	layerDevices = make([]string, len(layers))
+// getLayerDevices turns a list of layers, and optionally a scratch device,
+// into a list of the devices (sda, sdb, pmem0, etc.) that they correspond to.
+func (c *gcsCore) getLayerDevices(scratch *prot.ScsiAddress, layers []prot.Layer) (scratchDevice string, layerDevices []layerDevice, err error) {
+	layerDevices = make([]layerDevice, len(layers))
 	for i, layer := range layers {
-		deviceID := layer.Path
-		deviceName, err := c.deviceIDToName(deviceID)
+		layerDevices[i].Verity = layer.Verity
+		if layer.PmemDevice != nil {
+			deviceName, err := c.pmemDeviceName(*layer.PmemDevice)
+			if err != nil {
+				return "", nil, err
+			}
+			layerDevices[i].Name = deviceName
+			continue
+		}
+		address, err := layerScsiAddress(layer)
 		if err != nil {
 			return "", nil, err
 		}
-		layerDevices[i] = deviceName
+		deviceName, err := c.deviceIDToName(address)
+		if err != nil {
+			return "", nil, err
+		}
+		layerDevices[i].Name = deviceName
 	}
-	// An empty scratch value indicates no scratch space is to be attached.
-	if scratch == "" {
+	// A nil scratch address indicates no scratch space is to be attached.
+	if scratch == nil {
 		scratchDevice = ""
 	} else {
-		scratchDevice, err = c.deviceIDToName(scratch)
+		scratchDevice, err = c.deviceIDToName(*scratch)
 		if err != nil {
 			return "", nil, err
 		}
@@ -57,54 +78,192 @@ func (c *gcsCore) getLayerDevices(scratch string, layers []prot.Layer) (scratchD
 	return scratchDevice, layerDevices, nil
 }
 
-// getMappedVirtualDiskDevices uses the Lun values in the given disks to
+// layerScsiAddress returns the SCSI address of the given layer's device. If
+// the layer has no Address, its Path is treated as a LUN on the first SCSI
+// controller.
+func layerScsiAddress(layer prot.Layer) (prot.ScsiAddress, error) {
+	if layer.Address != nil {
+		return *layer.Address, nil
+	}
+	return parseLunScsiAddress(layer.Path)
+}
+
+// sandboxScsiAddress returns the SCSI address of the sandbox device given in
+// the settings, or nil if no sandbox device is to be attached.
+func sandboxScsiAddress(settings prot.VMHostedContainerSettings) (*prot.ScsiAddress, error) {
+	if settings.SandboxDataAddress != nil {
+		return settings.SandboxDataAddress, nil
+	}
+	if settings.SandboxDataPath == "" {
+		return nil, nil
+	}
+	address, err := parseLunScsiAddress(settings.SandboxDataPath)
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+// parseLunScsiAddress converts a bare LUN string (0, 1, etc.), as used by the
+// older LUN-only form of the protocol, into an address on the first SCSI
+// controller.
+func parseLunScsiAddress(lun string) (prot.ScsiAddress, error) {
+	value, err := strconv.ParseUint(lun, 10, 8)
+	if err != nil {
+		return prot.ScsiAddress{}, errors.Wrapf(err, "invalid SCSI LUN \"%s\"", lun)
+	}
+	return prot.ScsiAddress{Lun: uint8(value)}, nil
+}
+
+// mappedVirtualDiskScsiAddress returns the SCSI address of the given disk.
+func mappedVirtualDiskScsiAddress(disk prot.MappedVirtualDisk) prot.ScsiAddress {
+	return prot.ScsiAddress{Controller: disk.Controller, Lun: disk.Lun}
+}
+
+// getMappedVirtualDiskDevices uses the SCSI addresses of the given disks to
 // retrieve their associated device names.
 func (c *gcsCore) getMappedVirtualDiskDevices(disks []prot.MappedVirtualDisk) ([]string, error) {
 	devices := make([]string, len(disks))
 	for i, disk := range disks {
-		device, err := c.deviceIDToName(strconv.Itoa(int(disk.Lun)))
+		device, err := c.deviceIDToName(mappedVirtualDiskScsiAddress(disk))
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to get device name for mapped virtual disk %s, lun %d", disk.ContainerPath, disk.Lun)
+			return nil, errors.Wrapf(err, "failed to get device name for mapped virtual disk %s, controller %d, lun %d", disk.ContainerPath, disk.Controller, disk.Lun)
+		}
+		if disk.Partition != 0 || disk.PartitionLabel != "" {
+			device, err = c.getPartitionDevice(device, disk.Partition, disk.PartitionLabel)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get partition device for mapped virtual disk %s, controller %d, lun %d", disk.ContainerPath, disk.Controller, disk.Lun)
+			}
 		}
 		devices[i] = device
 	}
 	return devices, nil
 }
 
-// deviceIDToName converts from a SCSI location (0, 1, etc.) to a device (sda,
-// sdb, etc.).
+// getPartitionDevice waits for a partition of the given disk device to be
+// added, and returns the partition's device name (sda1, sdb2, etc.). The
+// partition is selected either by its index in the partition table or by its
+// GPT partition label, but not both.
+func (c *gcsCore) getPartitionDevice(device string, index uint32, label string) (string, error) {
+	if index != 0 && label != "" {
+		return "", errors.Errorf("only one of partition index %d and partition label \"%s\" may be specified", index, label)
+	}
+
+	// The kernel scans the partition table of a disk after the disk itself
+	// is added, so its partitions may not be available yet.
+	ctx, cancel := context.WithTimeout(context.Background(), deviceTimeout)
+	defer cancel()
+	partition, err := c.OS.WaitForBlockDevice(ctx, func(d oslayer.BlockDevice) bool {
+		if d.Disk != device {
+			return false
+		}
+		if label != "" {
+			return d.PartitionLabel == label
+		}
+		return d.Partition == index
+	})
+	if err != nil {
+		if label != "" {
+			return "", errors.Wrapf(err, "no partition with label \"%s\" found on device %s", label, device)
+		}
+		return "", errors.Wrapf(err, "partition %d of device %s does not exist", index, device)
+	}
+	return partition.Name, nil
+}
+
+// deviceIDToName converts from a SCSI address (controller 0, LUN 1, etc.) to a
+// device (sda, sdb, etc.), waiting for the device to be added if necessary.
 // NOTE: While this function currently works with SCSI codes, it will
 // eventually be reimplemented to use vSCM codes.
-func (c *gcsCore) deviceIDToName(deviceID string) (string, error) {
-	scsiID := fmt.Sprintf("0:0:0:%s", deviceID)
-
-	// Query for the device name up until the timeout.
-	var deviceNames []os.FileInfo
-	startTime := time.Now()
-	for {
-		// Devices matching the given SCSI code should each have a subdirectory
-		// under /sys/bus/scsi/devices/<scsiID>/block.
-		var err error
-		deviceNames, err = c.OS.ReadDir(filepath.Join("/sys", "bus", "scsi", "devices", scsiID, "block"))
-		if err != nil {
-			currentTime := time.Now()
-			elapsedTime := currentTime.Sub(startTime)
-			if elapsedTime > deviceLookupTimeout {
-				return "", errors.Wrap(err, "failed to retrieve SCSI device names from filesystem")
-			}
-		} else {
-			break
-		}
-		time.Sleep(time.Millisecond * 10)
+func (c *gcsCore) deviceIDToName(address prot.ScsiAddress) (string, error) {
+	scsiID, err := c.scsiDeviceID(address)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deviceTimeout)
+	defer cancel()
+	device, err := c.OS.WaitForBlockDevice(ctx, func(d oslayer.BlockDevice) bool {
+		return d.SCSIID == scsiID && d.Disk == ""
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "no block device found for SCSI ID \"%s\"", scsiID)
+	}
+	return device.Name, nil
+}
+
+// pmemDeviceName returns the name of the persistent memory device with the
+// given number (pmem0, pmem1, etc.), waiting for it to be added if necessary.
+func (c *gcsCore) pmemDeviceName(number uint32) (string, error) {
+	name := fmt.Sprintf("pmem%d", number)
+	ctx, cancel := context.WithTimeout(context.Background(), deviceTimeout)
+	defer cancel()
+	if _, err := c.OS.WaitForBlockDevice(ctx, func(d oslayer.BlockDevice) bool {
+		return d.Name == name
+	}); err != nil {
+		return "", errors.Wrapf(err, "persistent memory device %s was not found", name)
+	}
+	return name, nil
+}
+
+// isPmemDevice returns whether the device with the given name is a persistent
+// memory device.
+func isPmemDevice(device string) bool {
+	return strings.HasPrefix(device, "pmem")
+}
+
+// scsiDeviceID returns the ID (host:channel:target:lun) under
+// /sys/bus/scsi/devices of the device at the given SCSI address.
+func (c *gcsCore) scsiDeviceID(address prot.ScsiAddress) (string, error) {
+	hosts, err := c.scsiControllerHosts()
+	if err != nil {
+		return "", err
+	}
+	var host int
+	if len(hosts) == 0 && address.Controller == 0 {
+		// If no Hyper-V SCSI controllers could be identified, assume the
+		// device is on the first SCSI host, as in the LUN-only protocol.
+		host = 0
+	} else if int(address.Controller) < len(hosts) {
+		host = hosts[address.Controller]
+	} else {
+		return "", errors.Errorf("SCSI controller %d does not exist, %d controllers found", address.Controller, len(hosts))
 	}
+	return scsiDeviceAddress(host, address.Lun), nil
+}
 
-	if len(deviceNames) == 0 {
-		return "", errors.Errorf("no matching device names found for SCSI ID \"%s\"", scsiID)
+// scsiControllerHosts returns the numbers of the SCSI hosts which correspond
+// to Hyper-V SCSI controllers, ordered by controller index. Each controller is
+// exposed as a storvsc host, and hosts are numbered in the order the
+// controllers were offered to the utility VM.
+func (c *gcsCore) scsiControllerHosts() ([]int, error) {
+	hostDirs, err := c.OS.ReadDir(scsiHostsPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read SCSI hosts from %s", scsiHostsPath)
 	}
-	if len(deviceNames) > 1 {
-		return "", errors.Errorf("more than one block device could match SCSI ID \"%s\"", scsiID)
+	var hosts []int
+	for _, hostDir := range hostDirs {
+		var host int
+		if _, err := fmt.Sscanf(hostDir.Name(), "host%d", &host); err != nil {
+			continue
+		}
+		procName, err := c.OS.ReadFile(filepath.Join(scsiHostsPath, hostDir.Name(), "proc_name"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read driver name of SCSI host %d", host)
+		}
+		if strings.TrimSpace(string(procName)) == storvscDriverName {
+			hosts = append(hosts, host)
+		}
 	}
-	return deviceNames[0].Name(), nil
+	sort.Ints(hosts)
+	return hosts, nil
+}
+
+// scsiDeviceAddress returns the SCSI address (host:channel:target:lun) of the
+// device with the given LUN on the given host, as used under
+// /sys/bus/scsi/devices.
+func scsiDeviceAddress(host int, lun uint8) string {
+	return fmt.Sprintf("%d:0:0:%d", host, lun)
 }
 
 // mountMappedVirtualDisks mounts the given disks to the given directories,
@@ -124,33 +283,11 @@ func (c *gcsCore) mountMappedVirtualDisks(disks []prot.MappedVirtualDisk, device
 		if err := c.OS.MkdirAll(mountedPath, 0700); err != nil {
 			return errors.Wrapf(err, "failed to create directory for mapped virtual disk %s", disk.ContainerPath)
 		}
-		var mountOptions uintptr
-		var data string
-		if disk.ReadOnly {
-			mountOptions |= syscall.MS_RDONLY
-			data += "noload"
-		}
 
-		// Attempt mounting multiple times up until the given timout. This is
-		// necessary because there is a span of time between when the device
-		// name becomes available under /sys/bus/scsi and when it appears under
-		// /dev. Once it appears under /dev, there is still a span of time
-		// before it becomes mountable. Retrying mount should succeed in
-		// mounting the device as long as it becomes mountable under /dev
-		// before the timeout.
-		startTime := time.Now()
-		for {
-			err := c.OS.Mount(devicePath, mountedPath, "ext4", mountOptions, data)
-			if err != nil {
-				currentTime := time.Now()
-				elapsedTime := currentTime.Sub(startTime)
-				if elapsedTime > mappedDiskMountTimeout {
-					return errors.Wrapf(err, "failed to mount directory %s for mapped virtual disk device %s", disk.ContainerPath, devicePath)
-				}
-			} else {
-				break
-			}
-			time.Sleep(time.Millisecond * 10)
+		// The device is mountable as soon as it has been added, since the
+		// kernel creates its node under /dev before announcing it.
+		if err := c.mountDevice(devicePath, mountedPath, disk.ReadOnly, disk.MountOptions); err != nil {
+			return errors.Wrapf(err, "failed to mount directory %s for mapped virtual disk device %s", disk.ContainerPath, devicePath)
 		}
 	}
 	return nil
@@ -178,31 +315,92 @@ func (c *gcsCore) unmountMappedVirtualDisks(disks []prot.MappedVirtualDisk) erro
 	return nil
 }
 
-// mountLayers mounts each device into a mountpoint, and then layers them into a
-// union filesystem in the given order.
-// These mountpoints are all stored under a directory reserved for the container
-// with the given ID.
-func (c *gcsCore) mountLayers(id string, scratchDevice string, layers []string) error {
-	layerPrefix, scratchPath, workdirPath, rootfsPath := c.getUnioningPaths(id)
+// detachMappedVirtualDisk prepares the disk mounted by each of the given
+// mapped virtual disks, which all share the same SCSI address, to be
+// hot-removed by the host. It flushes any dirty data to the disk, unmounts
+// every mount of it, deletes its SCSI device from the utility VM, and then
+// waits for the device node to disappear from /dev.
+func (c *gcsCore) detachMappedVirtualDisk(disks []prot.MappedVirtualDisk) error {
+	disk := disks[0]
+	address := mappedVirtualDiskScsiAddress(disk)
+	scsiID, err := c.scsiDeviceID(address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get SCSI ID for mapped virtual disk %s, controller %d, lun %d", disk.ContainerPath, disk.Controller, disk.Lun)
+	}
+	device, err := c.deviceIDToName(address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get device name for mapped virtual disk %s, controller %d, lun %d", disk.ContainerPath, disk.Controller, disk.Lun)
+	}
+	devicePath := filepath.Join("/dev", device)
+
+	c.OS.Sync()
+	if err := c.OS.FlushBlockDevice(devicePath); err != nil {
+		return errors.Wrapf(err, "failed to flush mapped virtual disk device %s", devicePath)
+	}
+	if err := c.unmountMappedVirtualDisks(disks); err != nil {
+		return err
+	}
+
+	deletePath := filepath.Join("/sys", "bus", "scsi", "devices", scsiID, "delete")
+	deleteFile, err := c.OS.OpenFile(deletePath, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", deletePath)
+	}
+	defer deleteFile.Close()
+	if _, err := deleteFile.Write([]byte("1")); err != nil {
+		return errors.Wrapf(err, "failed to delete SCSI device for mapped virtual disk device %s", devicePath)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deviceTimeout)
+	defer cancel()
+	if err := c.OS.WaitForBlockDeviceRemoval(ctx, device); err != nil {
+		return errors.Wrapf(err, "mapped virtual disk device %s was not removed", devicePath)
+	}
+	return nil
+}
+
+// scratchSpace describes the writable scratch space of a container's root
+// filesystem.
+type scratchSpace struct {
+	// Device is the name of the device (sda, sdb, etc.) holding the scratch
+	// filesystem, if any.
+	Device string
+	// FormatOptions describes the filesystem to create on Device if it is
+	// blank.
+	FormatOptions *prot.SandboxFormatOptions
+	// Encrypted is whether Device should be encrypted with a random key
+	// generated in the utility VM. Its previous contents are then
+	// unreadable, so it is always formatted.
+	Encrypted bool
+	// EphemeralSizeInMB is the size of the tmpfs used as scratch space if
+	// there is no scratch device. If it is also zero, the container's root
+	// filesystem is read-only.
+	EphemeralSizeInMB uint64
+}
+
+// mountLayers mounts each layer device, and then layers them into a union
+// filesystem in the given order.
+// Layer devices are mounted once at VM-wide paths and shared by every
+// container using them. The union filesystem and scratch space are stored
+// under a directory reserved for the container with the given ID.
+func (c *gcsCore) mountLayers(id string, scratch scratchSpace, layers []layerDevice) error {
+	scratchPath, workdirPath, rootfsPath := c.getUnioningPaths(id)
 
-	utils.LogMsgf("layerPrefix=%s\n", layerPrefix)
 	utils.LogMsgf("scratchPath:%s\n", scratchPath)
 	utils.LogMsgf("workdirPath=%s\n", workdirPath)
 	utils.LogMsgf("rootfsPath=%s\n", rootfsPath)
 
-	// Mount the layer devices.
+	// Mount the layer devices, or reuse their existing mounts.
 	layerPaths := make([]string, len(layers)+1)
-	for i, device := range layers {
-		devicePath := filepath.Join("/dev", device)
-		layerPath := fmt.Sprintf("%s%d", layerPrefix, i)
-		utils.LogMsgf("layerPath: %s\n", layerPath)
-		if err := c.OS.MkdirAll(layerPath, 0700); err != nil {
-			return errors.Wrapf(err, "failed to create directory for layer %s", layerPath)
-		}
-		if err := c.OS.Mount(devicePath, layerPath, "ext4", syscall.MS_RDONLY, "noload"); err != nil {
-			return errors.Wrapf(err, "failed to mount layer directory %s", layerPath)
+	layerLinkPaths := make([]string, len(layers)+1)
+	for i, layer := range layers {
+		layerPath, linkPath, err := c.acquireLayer(id, layer)
+		if err != nil {
+			return err
 		}
+		utils.LogMsgf("layerPath: %s\n", layerPath)
 		layerPaths[i] = layerPath
+		layerLinkPaths[i] = linkPath
 	}
 	// TODO: The base path code may be temporary until a more permanent DNS
 	// solution is reached.
@@ -211,36 +409,88 @@ func (c *gcsCore) mountLayers(id string, scratchDevice string, layers []string)
 	// always be at least one layer, even if it's empty, to prevent this
 	// from happening.
 	layerPaths[len(layerPaths)-1] = baseFilesPath
+	layerLinkPaths[len(layerLinkPaths)-1] = baseFilesPath
 
 	// Mount the layers into a union filesystem.
-	var mountOptions uintptr
 	if err := c.OS.MkdirAll(baseFilesPath, 0700); err != nil {
 		return errors.Wrapf(err, "failed to create directory for base files %s", baseFilesPath)
 	}
 	if err := c.OS.MkdirAll(scratchPath, 0700); err != nil {
 		return errors.Wrapf(err, "failed to create directory for scratch space %s", scratchPath)
 	}
-	if scratchDevice != "" {
-		if err := c.OS.Mount(filepath.Join("/dev", scratchDevice), scratchPath, "ext4", 0, ""); err != nil {
+	writable := true
+	if scratch.Device != "" {
+		devicePath := filepath.Join("/dev", scratch.Device)
+		format := true
+		if scratch.Encrypted {
+			cryptPath, err := c.createCryptDevice(getCryptScratchName(id), scratch.Device)
+			if err != nil {
+				return errors.Wrapf(err, "failed to encrypt scratch device %s", devicePath)
+			}
+			devicePath = cryptPath
+		} else {
+			// A newly created scratch disk is attached without a filesystem,
+			// so it must be formatted on first use.
+			blank, err := c.isBlankDevice(devicePath)
+			if err != nil {
+				return errors.Wrapf(err, "failed to check whether scratch device %s is blank", devicePath)
+			}
+			format = blank
+		}
+		if format {
+			utils.LogMsgf("formatting scratch device %s\n", devicePath)
+			if err := c.formatDevice(devicePath, scratch.FormatOptions); err != nil {
+				return errors.Wrapf(err, "failed to format scratch device %s", devicePath)
+			}
+		}
+		if err := c.mountDevice(devicePath, scratchPath, false, nil); err != nil {
 			return errors.Wrapf(err, "failed to mount scratch directory %s", scratchPath)
 		}
+	} else if scratch.EphemeralSizeInMB != 0 {
+		// The scratch space is kept in memory, so the container's writes are
+		// discarded once it is unmounted.
+		data := fmt.Sprintf("size=%dm,mode=0700", scratch.EphemeralSizeInMB)
+		if err := c.OS.Mount("tmpfs", scratchPath, "tmpfs", 0, data); err != nil {
+			return errors.Wrapf(err, "failed to mount ephemeral scratch directory %s", scratchPath)
+		}
 	} else {
-		// If no scratch device is attached, the overlay filesystem should be
-		// readonly.
-		mountOptions |= syscall.O_RDONLY
+		// If there is no scratch space, the overlay filesystem should be
+		// read-only.
+		writable = false
 	}
-	upperDir := filepath.Join(scratchPath, "upper")
-	if err := c.OS.MkdirAll(upperDir, 0700); err != nil {
-		return errors.Wrap(err, "failed to create upper directory in scratch space")
-	}
-	if err := c.OS.MkdirAll(workdirPath, 0700); err != nil {
-		return errors.Wrap(err, "failed to create workdir in scratch space")
+	var upperDir, workdir string
+	if writable {
+		upperDir = filepath.Join(scratchPath, "upper")
+		if err := c.OS.MkdirAll(upperDir, 0700); err != nil {
+			return errors.Wrap(err, "failed to create upper directory in scratch space")
+		}
+		workdir = workdirPath
+		if err := c.OS.MkdirAll(workdir, 0700); err != nil {
+			return errors.Wrap(err, "failed to create workdir in scratch space")
+		}
 	}
 	if err := c.OS.MkdirAll(rootfsPath, 0700); err != nil {
 		return errors.Wrapf(err, "failed to create directory for container root filesystem %s", rootfsPath)
 	}
-	lowerdir := strings.Join(layerPaths, ":")
-	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerdir, upperDir, workdirPath)
+	if !writable && len(layerPaths) == 1 {
+		// A read-only overlay filesystem needs at least two lower
+		// directories, so a lone layer is bind mounted read-only instead.
+		return c.mountReadOnlyBind(layerPaths[0], rootfsPath)
+	}
+	var mountOptions uintptr
+	if !writable {
+		mountOptions |= syscall.MS_RDONLY
+	}
+	options := overlayMountData(layerPaths, upperDir, workdir)
+	if !fitsInMountData(options) {
+		// The mount data is limited to a single page, which the full paths
+		// of a large number of layers can exceed. Fall back to the layers'
+		// shorter symlinks, which the kernel resolves when mounting.
+		options = overlayMountData(layerLinkPaths, upperDir, workdir)
+		if !fitsInMountData(options) {
+			return errors.Errorf("too many layers (%d) to fit in the overlay mount options for container %s", len(layers), id)
+		}
+	}
 	if err := c.OS.Mount("overlay", rootfsPath, "overlay", mountOptions, options); err != nil {
 		return errors.Wrapf(err, "failed to mount container root filesystem using overlayfs %s", rootfsPath)
 	}
@@ -248,10 +498,45 @@ func (c *gcsCore) mountLayers(id string, scratchDevice string, layers []string)
 	return nil
 }
 
+// overlayMountData returns the mount data for an overlay filesystem with the
+// given lower directories, in order from top to bottom, and the given upper
+// and work directories. If upperDir is empty, the data describes a read-only
+// overlay filesystem.
+func overlayMountData(lowerdirs []string, upperDir, workdirPath string) string {
+	lowerdir := strings.Join(lowerdirs, ":")
+	if upperDir == "" {
+		return fmt.Sprintf("lowerdir=%s", lowerdir)
+	}
+	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerdir, upperDir, workdirPath)
+}
+
+// mountReadOnlyBind bind mounts the given source directory to the given
+// target, and makes the bind mount read-only. The read-only flag is ignored
+// when a bind mount is first created, so the mount must be remounted to
+// apply it.
+func (c *gcsCore) mountReadOnlyBind(source, target string) error {
+	if err := c.OS.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+		return errors.Wrapf(err, "failed to bind mount %s to %s", source, target)
+	}
+	if err := c.OS.Mount("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+		c.OS.Unmount(target, 0)
+		return errors.Wrapf(err, "failed to make bind mount %s read-only", target)
+	}
+	return nil
+}
+
+// fitsInMountData returns whether the given mount data fits in the single page
+// which the kernel copies from the mount system call, including its NUL
+// terminator.
+func fitsInMountData(data string) bool {
+	return len(data) < syscall.Getpagesize()
+}
+
 // unmountLayers unmounts the union filesystem for the container with the given
-// ID, as well as any devices whose mountpoints were layers in that filesystem.
+// ID, as well as any layer devices which are no longer used by another
+// container.
 func (c *gcsCore) unmountLayers(id string) error {
-	layerPrefix, scratchPath, _, rootfsPath := c.getUnioningPaths(id)
+	scratchPath, _, rootfsPath := c.getUnioningPaths(id)
 
 	// clean up rootfsPath operations
 	exists, err := c.OS.PathExists(rootfsPath)
@@ -283,25 +568,14 @@ func (c *gcsCore) unmountLayers(id string) error {
 		}
 	}
 
-	// Clean up layer path operations
-	layerPaths, err := filepath.Glob(layerPrefix + "*")
-	if err != nil {
-		return errors.Wrap(err, "failed to get layer paths using Glob")
+	// Discard the encryption key of the scratch device, if it was encrypted.
+	if err := c.removeDeviceMapperDevice(getCryptScratchName(id)); err != nil {
+		return err
 	}
-	for _, layerPath := range layerPaths {
-		exists, err = c.OS.PathExists(layerPath)
-		if err != nil {
-			return errors.Wrapf(err, "failed to determine if layer path exists %s", layerPath)
-		}
-		mounted, err = c.OS.PathIsMounted(layerPath)
-		if err != nil {
-			return errors.Wrapf(err, "failed to determine if layer path is mounted %s", layerPath)
-		}
-		if exists && mounted {
-			if err := c.OS.Unmount(layerPath, 0); err != nil {
-				return errors.Wrapf(err, "failed to unmount layer path %s", layerPath)
-			}
-		}
+
+	// Release the layers, unmounting any which are no longer in use.
+	if err := c.releaseLayers(id); err != nil {
+		return err
 	}
 
 	return nil
@@ -321,6 +595,16 @@ func (c *gcsCore) destroyContainerStorage(id string) error {
 // writeConfigFile writes the given oci.Spec to disk so that it can be consumed
 // by an OCI runtime.
 func (c *gcsCore) writeConfigFile(id string, config oci.Spec) error {
+	// The container is created under a known cgroup, which its statistics are
+	// read from. The Linux section is copied so that the caller's spec isn't
+	// modified.
+	linux := oci.Linux{}
+	if config.Linux != nil {
+		linux = *config.Linux
+	}
+	linux.CgroupsPath = containerCgroupPath(id)
+	config.Linux = &linux
+
 	configPath := c.getConfigPath(id)
 	if err := c.OS.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
 		return errors.Wrapf(err, "failed to create config file directory for container %s", id)
@@ -352,9 +636,8 @@ func (c *gcsCore) getContainerStoragePath(id string) string {
 
 // getUnioningPaths returns paths that will be used in the union filesystem for
 // the container with the given ID.
-func (c *gcsCore) getUnioningPaths(id string) (layerPrefix string, scratchPath string, workdirPath string, rootfsPath string) {
+func (c *gcsCore) getUnioningPaths(id string) (scratchPath string, workdirPath string, rootfsPath string) {
 	mountPath := c.getContainerStoragePath(id)
-	layerPrefix = filepath.Join(mountPath, "layer")
 	scratchPath = filepath.Join(mountPath, "scratch")
 	workdirPath = filepath.Join(mountPath, "scratch", "work")
 	rootfsPath = filepath.Join(mountPath, "rootfs")
@@ -58,8 +58,7 @@ var _ = Describe("Storage", func() {
 		Describe("getting the unioning paths", func() {
 			Context("when the ID is a valid string", func() {
 				It("should return the correct paths", func() {
-					layerPrefix, scratchPath, workdirPath, rootfsPath := coreint.getUnioningPaths(validID)
-					Expect(layerPrefix).To(Equal("/mnt/gcs/abcdef-ghi/layer"))
+					scratchPath, workdirPath, rootfsPath := coreint.getUnioningPaths(validID)
 					Expect(scratchPath).To(Equal("/mnt/gcs/abcdef-ghi/scratch"))
 					Expect(workdirPath).To(Equal("/mnt/gcs/abcdef-ghi/scratch/work"))
 					Expect(rootfsPath).To(Equal("/mnt/gcs/abcdef-ghi/rootfs"))
@@ -272,7 +271,7 @@ var _ = Describe("Storage", func() {
 			})
 			It("should behave properly", func() {
 				// Mount the layers.
-				err = coreint.mountLayers(containerID, "loop0", []string{"loop1", "loop2", "loop3"})
+				err = coreint.mountLayers(containerID, scratchSpace{Device: "loop0"}, []layerDevice{{Name: "loop1"}, {Name: "loop2"}, {Name: "loop3"}})
 				Expect(err).NotTo(HaveOccurred())
 
 				containerPath := filepath.Join("/mnt", "gcs", containerID)
@@ -296,7 +295,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeTrue())
 
 				// Check the state of layer0.
-				layer0Path := filepath.Join(containerPath, "layer0")
+				layer0Path := filepath.Join("/mnt", "gcs", "layers", "loop1")
 				exists, err = coreint.OS.PathExists(layer0Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeTrue())
@@ -305,7 +304,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeTrue())
 
 				// Check the state of layer1.
-				layer1Path := filepath.Join(containerPath, "layer1")
+				layer1Path := filepath.Join("/mnt", "gcs", "layers", "loop2")
 				exists, err = coreint.OS.PathExists(layer1Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeTrue())
@@ -314,7 +313,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeTrue())
 
 				// Check the state of layer2.
-				layer2Path := filepath.Join(containerPath, "layer2")
+				layer2Path := filepath.Join("/mnt", "gcs", "layers", "loop3")
 				exists, err = coreint.OS.PathExists(layer2Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeTrue())
@@ -359,6 +358,67 @@ var _ = Describe("Storage", func() {
 				Expect(exists).To(BeFalse())
 			})
 		})
+		Context("sharing layers between two containers", func() {
+			var (
+				otherContainerID string
+			)
+			BeforeEach(func() {
+				otherContainerID = "jklmno-pqr"
+				SetupLoopbacks("scratch", []string{"layer1", "layer2", "layer3"})
+			})
+			AfterEach(func() {
+				// Make sure to clean up in case the test fails halfway
+				// through.
+				coreint.unmountLayers(containerID)
+				coreint.unmountLayers(otherContainerID)
+				coreint.destroyContainerStorage(containerID)
+				coreint.destroyContainerStorage(otherContainerID)
+				UnsetupLoopbacks([]int{0, 1, 2, 3})
+			})
+			It("should mount each layer once", func() {
+				// Mount the layers for both containers.
+				err = coreint.mountLayers(containerID, scratchSpace{Device: "loop0"}, []layerDevice{{Name: "loop1"}, {Name: "loop2"}, {Name: "loop3"}})
+				Expect(err).NotTo(HaveOccurred())
+				err = coreint.mountLayers(otherContainerID, scratchSpace{}, []layerDevice{{Name: "loop1"}, {Name: "loop2"}, {Name: "loop3"}})
+				Expect(err).NotTo(HaveOccurred())
+
+				layerPaths := []string{
+					filepath.Join("/mnt", "gcs", "layers", "loop1"),
+					filepath.Join("/mnt", "gcs", "layers", "loop2"),
+					filepath.Join("/mnt", "gcs", "layers", "loop3"),
+				}
+				otherRootfsPath := filepath.Join("/mnt", "gcs", otherContainerID, "rootfs")
+				CheckFileContents(otherRootfsPath, "file1", "layer2")
+
+				// Each layer should have a short link to its mount.
+				for i, layerPath := range layerPaths {
+					linkPath := filepath.Join("/mnt", "gcs", "l", fmt.Sprintf("loop%d", i+1))
+					target, err := os.Readlink(linkPath)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(target).To(Equal(layerPath))
+				}
+
+				// Unmounting the first container should leave the layers
+				// mounted for the second.
+				err = coreint.unmountLayers(containerID)
+				Expect(err).NotTo(HaveOccurred())
+				for _, layerPath := range layerPaths {
+					mounted, err := coreint.OS.PathIsMounted(layerPath)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(mounted).To(BeTrue())
+				}
+				CheckFileContents(otherRootfsPath, "file3", "layer3")
+
+				// Unmounting the second container should unmount the layers.
+				err = coreint.unmountLayers(otherContainerID)
+				Expect(err).NotTo(HaveOccurred())
+				for _, layerPath := range layerPaths {
+					exists, err := coreint.OS.PathExists(layerPath)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeFalse())
+				}
+			})
+		})
 		Context("with no scratch device", func() {
 			BeforeEach(func() {
 				SetupLoopbacks("", []string{"layer1", "layer2", "layer3"})
@@ -368,7 +428,7 @@ var _ = Describe("Storage", func() {
 			})
 			It("should behave properly", func() {
 				// Mount the layers.
-				err = coreint.mountLayers(containerID, "", []string{"loop1", "loop2", "loop3"})
+				err = coreint.mountLayers(containerID, scratchSpace{}, []layerDevice{{Name: "loop1"}, {Name: "loop2"}, {Name: "loop3"}})
 				Expect(err).NotTo(HaveOccurred())
 
 				containerPath := filepath.Join("/mnt", "gcs", containerID)
@@ -381,6 +441,8 @@ var _ = Describe("Storage", func() {
 				mounted, err := coreint.OS.PathIsMounted(rootfsPath)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(mounted).To(BeTrue())
+				err = ioutil.WriteFile(filepath.Join(rootfsPath, "written"), []byte("data"), 0600)
+				Expect(err).To(HaveOccurred())
 
 				// Check the state of scratch.
 				scratchPath := filepath.Join(containerPath, "scratch")
@@ -392,7 +454,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeFalse())
 
 				// Check the state of layer0.
-				layer0Path := filepath.Join(containerPath, "layer0")
+				layer0Path := filepath.Join("/mnt", "gcs", "layers", "loop1")
 				exists, err = coreint.OS.PathExists(layer0Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeTrue())
@@ -401,7 +463,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeTrue())
 
 				// Check the state of layer1.
-				layer1Path := filepath.Join(containerPath, "layer1")
+				layer1Path := filepath.Join("/mnt", "gcs", "layers", "loop2")
 				exists, err = coreint.OS.PathExists(layer1Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeTrue())
@@ -410,7 +472,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeTrue())
 
 				// Check the state of layer2.
-				layer2Path := filepath.Join(containerPath, "layer2")
+				layer2Path := filepath.Join("/mnt", "gcs", "layers", "loop3")
 				exists, err = coreint.OS.PathExists(layer2Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeTrue())
@@ -456,7 +518,7 @@ var _ = Describe("Storage", func() {
 			})
 			It("should behave properly", func() {
 				// Mount the layers.
-				err = coreint.mountLayers(containerID, "loop0", []string{})
+				err = coreint.mountLayers(containerID, scratchSpace{Device: "loop0"}, []layerDevice{})
 				Expect(err).NotTo(HaveOccurred())
 
 				containerPath := filepath.Join("/mnt", "gcs", containerID)
@@ -480,7 +542,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeTrue())
 
 				// Check the state of layer0.
-				layer0Path := filepath.Join(containerPath, "layer0")
+				layer0Path := filepath.Join("/mnt", "gcs", "layers", "loop1")
 				exists, err = coreint.OS.PathExists(layer0Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeFalse())
@@ -489,7 +551,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeFalse())
 
 				// Check the state of layer1.
-				layer1Path := filepath.Join(containerPath, "layer1")
+				layer1Path := filepath.Join("/mnt", "gcs", "layers", "loop2")
 				exists, err = coreint.OS.PathExists(layer1Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeFalse())
@@ -498,7 +560,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeFalse())
 
 				// Check the state of layer2.
-				layer2Path := filepath.Join(containerPath, "layer2")
+				layer2Path := filepath.Join("/mnt", "gcs", "layers", "loop3")
 				exists, err = coreint.OS.PathExists(layer2Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeFalse())
@@ -544,7 +606,7 @@ var _ = Describe("Storage", func() {
 			})
 			It("should behave properly", func() {
 				// Mount the layers.
-				err = coreint.mountLayers(containerID, "", []string{})
+				err = coreint.mountLayers(containerID, scratchSpace{}, []layerDevice{})
 				Expect(err).NotTo(HaveOccurred())
 
 				containerPath := filepath.Join("/mnt", "gcs", containerID)
@@ -568,7 +630,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeFalse())
 
 				// Check the state of layer0.
-				layer0Path := filepath.Join(containerPath, "layer0")
+				layer0Path := filepath.Join("/mnt", "gcs", "layers", "loop1")
 				exists, err = coreint.OS.PathExists(layer0Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeFalse())
@@ -577,7 +639,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeFalse())
 
 				// Check the state of layer1.
-				layer1Path := filepath.Join(containerPath, "layer1")
+				layer1Path := filepath.Join("/mnt", "gcs", "layers", "loop2")
 				exists, err = coreint.OS.PathExists(layer1Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeFalse())
@@ -586,7 +648,7 @@ var _ = Describe("Storage", func() {
 				Expect(mounted).To(BeFalse())
 
 				// Check the state of layer2.
-				layer2Path := filepath.Join(containerPath, "layer2")
+				layer2Path := filepath.Join("/mnt", "gcs", "layers", "loop3")
 				exists, err = coreint.OS.PathExists(layer2Path)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(exists).To(BeFalse())
@@ -623,6 +685,100 @@ var _ = Describe("Storage", func() {
 				Expect(exists).To(BeFalse())
 			})
 		})
+		Context("with a blank scratch device", func() {
+			var blankScratch string
+			BeforeEach(func() {
+				file, err := ioutil.TempFile("", "blankscratch")
+				Expect(err).NotTo(HaveOccurred())
+				blankScratch = file.Name()
+				err = file.Truncate(32 * 1024 * 1024)
+				file.Close()
+				Expect(err).NotTo(HaveOccurred())
+				SetupLoopbacks(blankScratch, []string{"layer1"})
+			})
+			AfterEach(func() {
+				coreint.unmountLayers(containerID)
+				coreint.destroyContainerStorage(containerID)
+				UnsetupLoopbacks([]int{0, 1})
+				os.Remove(blankScratch)
+			})
+			It("should format the device before mounting it", func() {
+				err = coreint.mountLayers(containerID, scratchSpace{
+					Device:        "loop0",
+					FormatOptions: &prot.SandboxFormatOptions{SizeInMB: 16, InodeCount: 1024},
+				}, []layerDevice{{Name: "loop1"}})
+				Expect(err).NotTo(HaveOccurred())
+
+				fsType, err := coreint.getFilesystemType("/dev/loop0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fsType).To(Equal("ext4"))
+
+				scratchPath := filepath.Join("/mnt", "gcs", containerID, "scratch")
+				mounted, err := coreint.OS.PathIsMounted(scratchPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounted).To(BeTrue())
+				var stat syscall.Statfs_t
+				err = syscall.Statfs(scratchPath, &stat)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stat.Files).To(BeNumerically("<=", 2048))
+				Expect(uint64(stat.Blocks) * uint64(stat.Bsize)).To(BeNumerically("<=", 16*1024*1024))
+			})
+		})
+		Context("with ephemeral scratch space", func() {
+			BeforeEach(func() {
+				SetupLoopbacks("", []string{"layer1", "layer2", "layer3"})
+			})
+			AfterEach(func() {
+				coreint.unmountLayers(containerID)
+				UnsetupLoopbacks([]int{1, 2, 3})
+			})
+			It("should behave properly", func() {
+				// Mount the layers.
+				err = coreint.mountLayers(containerID, scratchSpace{EphemeralSizeInMB: 16}, []layerDevice{{Name: "loop1"}, {Name: "loop2"}, {Name: "loop3"}})
+				Expect(err).NotTo(HaveOccurred())
+
+				containerPath := filepath.Join("/mnt", "gcs", containerID)
+
+				// Check the state of rootfs.
+				rootfsPath := filepath.Join(containerPath, "rootfs")
+				mounted, err := coreint.OS.PathIsMounted(rootfsPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounted).To(BeTrue())
+
+				// Check the state of scratch.
+				scratchPath := filepath.Join(containerPath, "scratch")
+				mounted, err = coreint.OS.PathIsMounted(scratchPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounted).To(BeTrue())
+
+				// Check that rootfs is writable, and that writes go to
+				// scratch.
+				err = ioutil.WriteFile(filepath.Join(rootfsPath, "written"), []byte("data"), 0600)
+				Expect(err).NotTo(HaveOccurred())
+				exists, err := coreint.OS.PathExists(filepath.Join(scratchPath, "upper", "written"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeTrue())
+
+				// Unmount the layers.
+				err = coreint.unmountLayers(containerID)
+				Expect(err).NotTo(HaveOccurred())
+
+				// Check the final state of the layers.
+				mounted, err = coreint.OS.PathIsMounted(rootfsPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounted).To(BeFalse())
+				mounted, err = coreint.OS.PathIsMounted(scratchPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounted).To(BeFalse())
+
+				// Detroy the layers.
+				err = coreint.destroyContainerStorage(containerID)
+				Expect(err).NotTo(HaveOccurred())
+				exists, err = coreint.OS.PathExists(containerPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse())
+			})
+		})
 		Describe("mounting and unmounting mapped virtual disks", func() {
 			Context("mounting two basic layers", func() {
 				var (
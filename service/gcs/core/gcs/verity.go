@@ -0,0 +1,96 @@
+package gcs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+)
+
+const (
+	// verityBlockSize is the size of both the data blocks and the hash blocks
+	// of a layer's dm-verity hash tree.
+	verityBlockSize = 4096
+
+	// verityAlgorithm is the hash algorithm of a layer's dm-verity hash tree.
+	verityAlgorithm = "sha256"
+
+	// verityDigestSize is the size in bytes of a verityAlgorithm digest.
+	verityDigestSize = 32
+)
+
+// getVerityLayerName returns the name of the device-mapper device which
+// verifies the layer on the given device.
+func getVerityLayerName(device string) string {
+	return "gcs-verity-" + device
+}
+
+// verityTable returns the device-mapper table for a dm-verity device which
+// verifies the device at the given path against the given hash tree. The data
+// is read from the start of the device, and the tree from the same device at
+// the tree's offset.
+func verityTable(devicePath string, verity *prot.LayerVerity) (string, error) {
+	rootDigest, err := hex.DecodeString(verity.RootDigest)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid root digest %s", verity.RootDigest)
+	}
+	if len(rootDigest) != verityDigestSize {
+		return "", errors.Errorf("root digest %s is %d bytes long, but %s digests are %d bytes", verity.RootDigest, len(rootDigest), verityAlgorithm, verityDigestSize)
+	}
+	salt := "-"
+	if verity.Salt != "" {
+		if _, err := hex.DecodeString(verity.Salt); err != nil {
+			return "", errors.Wrapf(err, "invalid salt %s", verity.Salt)
+		}
+		salt = verity.Salt
+	}
+	if verity.HashOffsetInBytes == 0 || verity.HashOffsetInBytes%verityBlockSize != 0 {
+		return "", errors.Errorf("hash offset %d is not a positive multiple of the block size %d", verity.HashOffsetInBytes, verityBlockSize)
+	}
+	dataBlocks := verity.HashOffsetInBytes / verityBlockSize
+	dataSectors := verity.HashOffsetInBytes / 512
+	return fmt.Sprintf("0 %d verity 1 %s %s %d %d %d %d %s %s %s\n",
+		dataSectors, devicePath, devicePath, verityBlockSize, verityBlockSize,
+		dataBlocks, dataBlocks, verityAlgorithm, verity.RootDigest, salt), nil
+}
+
+// createVerityDevice sets up a read-only device-mapper device with the given
+// name, which verifies each block read from the given block device (sda, sdb,
+// etc.) against its hash tree, and returns the path of the new device.
+// Reading a block which doesn't match the tree fails, so a device which was
+// tampered with can't be mounted.
+func (c *gcsCore) createVerityDevice(name, device string, verity *prot.LayerVerity) (string, error) {
+	table, err := verityTable(filepath.Join("/dev", device), verity)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid hash tree for device %s", device)
+	}
+	devicePath, err := c.createDeviceMapperDevice(name, table, true)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create verity device %s", name)
+	}
+	return devicePath, nil
+}
+
+// verityTableRootDigest returns the root digest from the given dm-verity
+// device-mapper table, as printed by dmsetup.
+func verityTableRootDigest(table string) (string, error) {
+	fields := strings.Fields(table)
+	if len(fields) < 12 || fields[2] != "verity" {
+		return "", errors.Errorf("\"%s\" is not a dm-verity table", strings.TrimSpace(table))
+	}
+	return fields[11], nil
+}
+
+// getVerityRootDigest returns the root digest the existing dm-verity device
+// with the given name verifies its data against.
+func (c *gcsCore) getVerityRootDigest(name string) (string, error) {
+	out, err := c.OS.Command("dmsetup", "table", name).CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get table of verity device %s: %s", name, out)
+	}
+	return verityTableRootDigest(string(out))
+}
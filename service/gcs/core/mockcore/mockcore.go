@@ -30,7 +30,8 @@ type SignalContainerCall struct {
 
 // TerminateProcessCall captures the arguments of TerminateProcess.
 type TerminateProcessCall struct {
-	Pid int
+	Pid       int
+	StartTime uint64
 }
 
 // ListProcessesCall captures the arguments of ListProcesses.
@@ -50,6 +51,21 @@ type ModifySettingsCall struct {
 	Request prot.ResourceModificationRequestResponse
 }
 
+// CheckpointContainerCall captures the arguments of CheckpointContainer.
+type CheckpointContainerCall struct {
+	ID        string
+	ImagePath string
+	Options   prot.CheckpointOptions
+}
+
+// RestoreContainerCall captures the arguments of RestoreContainer.
+type RestoreContainerCall struct {
+	ID        string
+	ImagePath string
+	Params    prot.ProcessParameters
+	StdioSet  *core.StdioSet
+}
+
 // RegisterContainerExitHookCall captures the arguments of
 // RegisterContainerExitHook.
 type RegisterContainerExitHookCall struct {
@@ -60,23 +76,34 @@ type RegisterContainerExitHookCall struct {
 // RegisterProcessExitHookCall captures the arguments of
 // RegisterProcessExitHook.
 type RegisterProcessExitHookCall struct {
-	Pid      int
-	ExitHook func(oslayer.ProcessExitState)
+	Pid       int
+	StartTime uint64
+	ExitHook  func(oslayer.ProcessExitState)
+}
+
+// RegisterContainerEventHookCall captures the arguments of
+// RegisterContainerEventHook.
+type RegisterContainerEventHookCall struct {
+	ID        string
+	EventHook func(prot.ContainerNotification)
 }
 
 // MockCore serves as an argument capture mechanism which implements the Core
 // interface. Arguments passed to one of its methods are stored to be queried
 // later.
 type MockCore struct {
-	LastCreateContainer           CreateContainerCall
-	LastExecProcess               ExecProcessCall
-	LastSignalContainer           SignalContainerCall
-	LastTerminateProcess          TerminateProcessCall
-	LastListProcesses             ListProcessesCall
-	LastRunExternalProcess        RunExternalProcessCall
-	LastModifySettings            ModifySettingsCall
-	LastRegisterContainerExitHook RegisterContainerExitHookCall
-	LastRegisterProcessExitHook   RegisterProcessExitHookCall
+	LastCreateContainer            CreateContainerCall
+	LastExecProcess                ExecProcessCall
+	LastSignalContainer            SignalContainerCall
+	LastTerminateProcess           TerminateProcessCall
+	LastListProcesses              ListProcessesCall
+	LastRunExternalProcess         RunExternalProcessCall
+	LastModifySettings             ModifySettingsCall
+	LastCheckpointContainer        CheckpointContainerCall
+	LastRestoreContainer           RestoreContainerCall
+	LastRegisterContainerExitHook  RegisterContainerExitHookCall
+	LastRegisterProcessExitHook    RegisterProcessExitHookCall
+	LastRegisterContainerEventHook RegisterContainerEventHookCall
 }
 
 // CreateContainer captures its arguments and returns a nil error.
@@ -88,14 +115,15 @@ func (c *MockCore) CreateContainer(id string, settings prot.VMHostedContainerSet
 	return nil
 }
 
-// ExecProcess captures its arguments and returns pid 101 and a nil error.
-func (c *MockCore) ExecProcess(id string, params prot.ProcessParameters, stdioSet *core.StdioSet) (pid int, err error) {
+// ExecProcess captures its arguments and returns pid 101, start time 1001 and
+// a nil error.
+func (c *MockCore) ExecProcess(id string, params prot.ProcessParameters, stdioSet *core.StdioSet) (pid int, startTime uint64, err error) {
 	c.LastExecProcess = ExecProcessCall{
 		ID:       id,
 		Params:   params,
 		StdioSet: stdioSet,
 	}
-	return 101, nil
+	return 101, 1001, nil
 }
 
 // SignalContainer captures its arguments and returns a nil error.
@@ -105,8 +133,8 @@ func (c *MockCore) SignalContainer(id string, signal oslayer.Signal) error {
 }
 
 // TerminateProcess captures its arguments and returns a nil error.
-func (c *MockCore) TerminateProcess(pid int) error {
-	c.LastTerminateProcess = TerminateProcessCall{Pid: pid}
+func (c *MockCore) TerminateProcess(pid int, startTime uint64) error {
+	c.LastTerminateProcess = TerminateProcessCall{Pid: pid, StartTime: startTime}
 	return nil
 }
 
@@ -125,14 +153,49 @@ func (c *MockCore) ListProcesses(id string) ([]runtime.ContainerProcessState, er
 	}, nil
 }
 
-// RunExternalProcess captures its arguments and returns pid 101 and a nil
+// ListExternalProcesses returns a running process with pid 101 and command
+// "sh -c testexe", as well as a nil error.
+func (c *MockCore) ListExternalProcesses() ([]prot.ExternalProcess, error) {
+	return []prot.ExternalProcess{
+		prot.ExternalProcess{
+			ProcessID: 101,
+			Command:   []string{"sh", "-c", "testexe"},
+			Status:    prot.EpsRunning,
+		},
+	}, nil
+}
+
+// ListVMProcesses returns a process with pid 1 and command "init", as well as
+// a nil error.
+func (c *MockCore) ListVMProcesses() ([]runtime.ContainerProcessState, error) {
+	return []runtime.ContainerProcessState{
+		runtime.ContainerProcessState{
+			Pid:     1,
+			Command: []string{"init"},
+		},
+	}, nil
+}
+
+// GetVMResources returns the resources of a utility VM with 2 CPUs and 1GB of
+// memory, half of which is available, running 10 processes, as well as a nil
 // error.
-func (c *MockCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *core.StdioSet) (pid int, err error) {
+func (c *MockCore) GetVMResources() (*prot.VMResources, error) {
+	return &prot.VMResources{
+		CPUCount:        2,
+		MemoryTotal:     1 << 30,
+		MemoryAvailable: 1 << 29,
+		ProcessCount:    10,
+	}, nil
+}
+
+// RunExternalProcess captures its arguments and returns pid 101, start time
+// 1001 and a nil error.
+func (c *MockCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *core.StdioSet) (pid int, startTime uint64, err error) {
 	c.LastRunExternalProcess = RunExternalProcessCall{
 		Params:   params,
 		StdioSet: stdioSet,
 	}
-	return 101, nil
+	return 101, 1001, nil
 }
 
 // ModifySettings captures its arguments and returns a nil error.
@@ -144,6 +207,28 @@ func (c *MockCore) ModifySettings(id string, request prot.ResourceModificationRe
 	return nil
 }
 
+// CheckpointContainer captures its arguments and returns a nil error.
+func (c *MockCore) CheckpointContainer(id string, imagePath string, options prot.CheckpointOptions) error {
+	c.LastCheckpointContainer = CheckpointContainerCall{
+		ID:        id,
+		ImagePath: imagePath,
+		Options:   options,
+	}
+	return nil
+}
+
+// RestoreContainer captures its arguments and returns pid 101, start time 1001
+// and a nil error.
+func (c *MockCore) RestoreContainer(id string, imagePath string, params prot.ProcessParameters, stdioSet *core.StdioSet) (pid int, startTime uint64, err error) {
+	c.LastRestoreContainer = RestoreContainerCall{
+		ID:        id,
+		ImagePath: imagePath,
+		Params:    params,
+		StdioSet:  stdioSet,
+	}
+	return 101, 1001, nil
+}
+
 // RegisterContainerExitHook captures its arguments and returns a nil error.
 func (c *MockCore) RegisterContainerExitHook(id string, exitHook func(oslayer.ProcessExitState)) error {
 	c.LastRegisterContainerExitHook = RegisterContainerExitHookCall{
@@ -155,15 +240,25 @@ func (c *MockCore) RegisterContainerExitHook(id string, exitHook func(oslayer.Pr
 
 // RegisterProcessExitHook captures its arguments, runs the given exit hook on
 // a process exit state with exit code 103, and returns a nil error.
-func (c *MockCore) RegisterProcessExitHook(pid int, exitHook func(oslayer.ProcessExitState)) error {
+func (c *MockCore) RegisterProcessExitHook(pid int, startTime uint64, exitHook func(oslayer.ProcessExitState)) error {
 	c.LastRegisterProcessExitHook = RegisterProcessExitHookCall{
-		Pid:      pid,
-		ExitHook: exitHook,
+		Pid:       pid,
+		StartTime: startTime,
+		ExitHook:  exitHook,
 	}
 	exitHook(mockos.NewProcessExitState(103))
 	return nil
 }
 
+// RegisterContainerEventHook captures its arguments and returns a nil error.
+func (c *MockCore) RegisterContainerEventHook(id string, eventHook func(prot.ContainerNotification)) error {
+	c.LastRegisterContainerEventHook = RegisterContainerEventHookCall{
+		ID:        id,
+		EventHook: eventHook,
+	}
+	return nil
+}
+
 // CleanupContainer returns a nil error.
 func (c *MockCore) CleanupContainer(id string) error {
 	return nil
@@ -0,0 +1,257 @@
+// Package devicewatcher keeps track of the block devices in the system by
+// listening for uevents from the kernel, so that callers can wait for a
+// device to be added or removed rather than polling sysfs.
+package devicewatcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+)
+
+const (
+	// sysfsPath is the mountpoint of sysfs. Device paths in uevents are
+	// relative to it.
+	sysfsPath = "/sys"
+
+	// blockClassPath is the directory containing a link to each block device
+	// in sysfs.
+	blockClassPath = "/sys/class/block"
+
+	// ueventGroupKernel is the netlink multicast group on which the kernel
+	// broadcasts uevents.
+	ueventGroupKernel = 1
+
+	// ueventBufferSize is the size of the buffer used to receive a single
+	// uevent. Uevents are limited to a few kilobytes by the kernel.
+	ueventBufferSize = 64 * 1024
+)
+
+// Watcher maintains an index of the block devices in the system, updated as
+// uevents are received from the kernel.
+type Watcher struct {
+	fd int
+
+	mutex   sync.Mutex
+	devices map[string]oslayer.BlockDevice
+	// changed is closed and replaced whenever devices is updated, waking up
+	// any callers waiting for a device.
+	changed chan struct{}
+	// err is set if the watcher stops receiving uevents.
+	err error
+}
+
+// New creates a Watcher, populating its index from the block devices already
+// present in sysfs, and starts listening for uevents.
+func New() (*Watcher, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create uevent netlink socket")
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: ueventGroupKernel}); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrap(err, "failed to bind uevent netlink socket")
+	}
+
+	w := &Watcher{
+		fd:      fd,
+		devices: make(map[string]oslayer.BlockDevice),
+		changed: make(chan struct{}),
+	}
+	// The index is populated only after subscribing to uevents, so that a
+	// device added in between is still picked up from its uevent.
+	if err := w.rescan(); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// WaitForBlockDevice waits until a block device for which match returns true
+// is present, and returns it. It gives up once ctx is done.
+func (w *Watcher) WaitForBlockDevice(ctx context.Context, match func(oslayer.BlockDevice) bool) (oslayer.BlockDevice, error) {
+	for {
+		w.mutex.Lock()
+		for _, device := range w.devices {
+			if match(device) {
+				w.mutex.Unlock()
+				return device, nil
+			}
+		}
+		changed, err := w.changed, w.err
+		w.mutex.Unlock()
+
+		if err != nil {
+			return oslayer.BlockDevice{}, err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return oslayer.BlockDevice{}, errors.Wrap(ctx.Err(), "timed out waiting for block device")
+		}
+	}
+}
+
+// WaitForBlockDeviceRemoval waits until the block device with the given name
+// is no longer present. It gives up once ctx is done.
+func (w *Watcher) WaitForBlockDeviceRemoval(ctx context.Context, name string) error {
+	for {
+		w.mutex.Lock()
+		_, exists := w.devices[name]
+		changed, err := w.changed, w.err
+		w.mutex.Unlock()
+
+		if !exists {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "timed out waiting for block device %s to be removed", name)
+		}
+	}
+}
+
+// run receives uevents from the kernel and applies them to the index until
+// the socket fails.
+func (w *Watcher) run() {
+	buf := make([]byte, ueventBufferSize)
+	for {
+		n, from, err := syscall.Recvfrom(w.fd, buf, 0)
+		if err != nil {
+			switch err {
+			case syscall.EINTR:
+				continue
+			case syscall.ENOBUFS:
+				// The socket's receive buffer overflowed and some uevents
+				// were dropped, so the index must be rebuilt from sysfs.
+				if err := w.rescan(); err != nil {
+					w.fail(err)
+					return
+				}
+				continue
+			}
+			w.fail(errors.Wrap(err, "failed to receive uevent"))
+			return
+		}
+		// Only trust uevents sent by the kernel.
+		if sender, ok := from.(*syscall.SockaddrNetlink); !ok || sender.Pid != 0 {
+			continue
+		}
+		event, err := parseUevent(buf[:n])
+		if err != nil {
+			continue
+		}
+		w.handleEvent(event)
+	}
+}
+
+// handleEvent updates the index according to the given uevent.
+func (w *Watcher) handleEvent(event *uevent) {
+	if !event.isBlockDevice() {
+		return
+	}
+	switch event.Action {
+	case "add", "change":
+		device := newBlockDevice(event)
+		w.mutex.Lock()
+		w.devices[device.Name] = device
+		w.notify()
+		w.mutex.Unlock()
+	case "remove":
+		w.mutex.Lock()
+		delete(w.devices, event.deviceName())
+		w.notify()
+		w.mutex.Unlock()
+	}
+}
+
+// rescan rebuilds the index from the block devices present in sysfs.
+func (w *Watcher) rescan() error {
+	entries, err := ioutil.ReadDir(blockClassPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read block devices from %s", blockClassPath)
+	}
+	devices := make(map[string]oslayer.BlockDevice)
+	for _, entry := range entries {
+		// Each entry is a link to the device's directory under
+		// /sys/devices.
+		link, err := os.Readlink(filepath.Join(blockClassPath, entry.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrapf(err, "failed to resolve block device %s", entry.Name())
+		}
+		devPath := strings.TrimPrefix(filepath.Join(blockClassPath, link), sysfsPath)
+		contents, err := ioutil.ReadFile(filepath.Join(sysfsPath, devPath, "uevent"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrapf(err, "failed to read uevent for block device %s", entry.Name())
+		}
+		event := parseUeventFile(devPath, contents)
+		if !event.isBlockDevice() {
+			continue
+		}
+		device := newBlockDevice(event)
+		devices[device.Name] = device
+	}
+
+	w.mutex.Lock()
+	w.devices = devices
+	w.notify()
+	w.mutex.Unlock()
+	return nil
+}
+
+// fail records that the watcher has stopped, waking up any waiters so that
+// they return the error.
+func (w *Watcher) fail(err error) {
+	w.mutex.Lock()
+	w.err = err
+	w.notify()
+	w.mutex.Unlock()
+}
+
+// notify wakes up any callers waiting for the index to change.
+// This function expects mutex to be locked on entry.
+func (w *Watcher) notify() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// newBlockDevice creates an oslayer.BlockDevice from a uevent for a disk or a
+// partition, reading the device's serial number from sysfs.
+func newBlockDevice(event *uevent) oslayer.BlockDevice {
+	diskDevPath := event.DevPath
+	if event.diskName() != "" {
+		diskDevPath = filepath.Dir(event.DevPath)
+	}
+	var serial string
+	page, err := ioutil.ReadFile(filepath.Join(sysfsPath, diskDevPath, "device", "vpd_pg80"))
+	if err == nil {
+		serial = parseUnitSerialNumber(page)
+	}
+	return oslayer.BlockDevice{
+		Name:           event.deviceName(),
+		Disk:           event.diskName(),
+		SCSIID:         event.scsiID(),
+		Serial:         serial,
+		Partition:      event.partition(),
+		PartitionLabel: event.Env["PARTNAME"],
+	}
+}
@@ -0,0 +1,13 @@
+package devicewatcher
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDeviceWatcher(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Device Watcher Suite")
+}
@@ -0,0 +1,133 @@
+package devicewatcher
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// scsiIDPattern matches the sysfs path component naming a SCSI device
+// (host:channel:target:lun).
+var scsiIDPattern = regexp.MustCompile(`^[0-9]+:[0-9]+:[0-9]+:[0-9]+$`)
+
+// uevent represents a single kernel uevent, as received over the uevent
+// netlink socket or read from a device's uevent file in sysfs.
+type uevent struct {
+	Action string
+	// DevPath is the path of the device under /sys, such as
+	// /devices/.../0:0:0:1/block/sdb.
+	DevPath string
+	Env     map[string]string
+}
+
+// parseUevent parses a uevent message received from the kernel. The message
+// consists of a header of the form "<action>@<devpath>", followed by a list
+// of KEY=VALUE pairs, all separated by NUL bytes.
+func parseUevent(msg []byte) (*uevent, error) {
+	fields := bytes.Split(msg, []byte{0})
+	header := string(fields[0])
+	at := strings.Index(header, "@")
+	if at == -1 {
+		return nil, errors.Errorf("uevent header \"%s\" is missing an @", header)
+	}
+	event := &uevent{
+		Action:  header[:at],
+		DevPath: header[at+1:],
+		Env:     parseUeventEnv(fields[1:]),
+	}
+	if action, ok := event.Env["ACTION"]; ok {
+		event.Action = action
+	}
+	if devPath, ok := event.Env["DEVPATH"]; ok {
+		event.DevPath = devPath
+	}
+	return event, nil
+}
+
+// parseUeventFile parses the contents of a device's uevent file in sysfs,
+// which contains one KEY=VALUE pair per line.
+func parseUeventFile(devPath string, contents []byte) *uevent {
+	return &uevent{
+		Action:  "add",
+		DevPath: devPath,
+		Env:     parseUeventEnv(bytes.Split(contents, []byte{'\n'})),
+	}
+}
+
+func parseUeventEnv(fields [][]byte) map[string]string {
+	env := make(map[string]string)
+	for _, field := range fields {
+		pair := strings.SplitN(string(field), "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		env[pair[0]] = pair[1]
+	}
+	return env
+}
+
+// isBlockDevice returns whether the event describes a disk or a partition.
+func (e *uevent) isBlockDevice() bool {
+	if subsystem, ok := e.Env["SUBSYSTEM"]; ok && subsystem != "block" {
+		return false
+	}
+	devType := e.Env["DEVTYPE"]
+	return devType == "disk" || devType == "partition"
+}
+
+// deviceName returns the name of the device under /dev.
+func (e *uevent) deviceName() string {
+	if name, ok := e.Env["DEVNAME"]; ok {
+		return name
+	}
+	return filepath.Base(e.DevPath)
+}
+
+// diskName returns the name of the disk containing the device if it is a
+// partition, and an empty string otherwise. A partition's sysfs path is
+// nested under its disk's, as in .../block/sdb/sdb1.
+func (e *uevent) diskName() string {
+	if e.Env["DEVTYPE"] != "partition" {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(e.DevPath))
+}
+
+// scsiID returns the SCSI address (host:channel:target:lun) of the device
+// from its sysfs path, or an empty string if it is not a SCSI device.
+func (e *uevent) scsiID() string {
+	components := strings.Split(e.DevPath, "/")
+	for i := len(components) - 1; i >= 0; i-- {
+		if scsiIDPattern.MatchString(components[i]) {
+			return components[i]
+		}
+	}
+	return ""
+}
+
+// partition returns the 1-based index of the device in its disk's partition
+// table, or 0 if it is not a partition.
+func (e *uevent) partition() uint32 {
+	partn, err := strconv.ParseUint(e.Env["PARTN"], 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(partn)
+}
+
+// parseUnitSerialNumber extracts the serial number from the contents of a
+// SCSI device's Unit Serial Number VPD page (page 0x80).
+func parseUnitSerialNumber(page []byte) string {
+	if len(page) < 4 || page[1] != 0x80 {
+		return ""
+	}
+	length := int(page[3])
+	if len(page) < 4+length {
+		length = len(page) - 4
+	}
+	return strings.TrimSpace(string(page[4 : 4+length]))
+}
@@ -0,0 +1,113 @@
+package devicewatcher
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Uevents", func() {
+	var (
+		event *uevent
+		err   error
+	)
+
+	Describe("parsing a uevent message", func() {
+		var (
+			msg []byte
+		)
+		JustBeforeEach(func() {
+			event, err = parseUevent(msg)
+		})
+		Context("the message describes a SCSI disk", func() {
+			BeforeEach(func() {
+				msg = []byte(strings.Join([]string{
+					"add@/devices/LNXSYSTM:00/device:00/VMBUS:00/vmbus_0/host1/target1:0:0/1:0:0:3/block/sdb",
+					"ACTION=add",
+					"DEVPATH=/devices/LNXSYSTM:00/device:00/VMBUS:00/vmbus_0/host1/target1:0:0/1:0:0:3/block/sdb",
+					"SUBSYSTEM=block",
+					"MAJOR=8",
+					"MINOR=16",
+					"DEVNAME=sdb",
+					"DEVTYPE=disk",
+					"SEQNUM=1234",
+				}, "\x00"))
+			})
+			It("should not produce an error", func() {
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("should be a block device", func() {
+				Expect(event.Action).To(Equal("add"))
+				Expect(event.isBlockDevice()).To(BeTrue())
+			})
+			It("should have the correct device name and SCSI ID", func() {
+				Expect(event.deviceName()).To(Equal("sdb"))
+				Expect(event.diskName()).To(BeEmpty())
+				Expect(event.scsiID()).To(Equal("1:0:0:3"))
+				Expect(event.partition()).To(BeZero())
+			})
+		})
+		Context("the message describes a partition", func() {
+			BeforeEach(func() {
+				msg = []byte(strings.Join([]string{
+					"add@/devices/vmbus_0/host0/target0:0:0/0:0:0:2/block/sdc/sdc1",
+					"ACTION=add",
+					"DEVPATH=/devices/vmbus_0/host0/target0:0:0/0:0:0:2/block/sdc/sdc1",
+					"SUBSYSTEM=block",
+					"DEVNAME=sdc1",
+					"DEVTYPE=partition",
+					"PARTN=1",
+					"PARTNAME=data",
+				}, "\x00"))
+			})
+			It("should not produce an error", func() {
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("should have the correct partition information", func() {
+				Expect(event.deviceName()).To(Equal("sdc1"))
+				Expect(event.diskName()).To(Equal("sdc"))
+				Expect(event.scsiID()).To(Equal("0:0:0:2"))
+				Expect(event.partition()).To(Equal(uint32(1)))
+				Expect(event.Env["PARTNAME"]).To(Equal("data"))
+			})
+		})
+		Context("the message describes a network device", func() {
+			BeforeEach(func() {
+				msg = []byte("add@/devices/virtual/net/eth1\x00ACTION=add\x00SUBSYSTEM=net\x00INTERFACE=eth1")
+			})
+			It("should not be a block device", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(event.isBlockDevice()).To(BeFalse())
+			})
+		})
+		Context("the message has no header", func() {
+			BeforeEach(func() {
+				msg = []byte("libudev\x00ACTION=add")
+			})
+			It("should produce an error", func() {
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("parsing a uevent file", func() {
+		It("should read the partition label", func() {
+			event = parseUeventFile("/devices/block/sda/sda1", []byte("MAJOR=8\nMINOR=1\nDEVNAME=sda1\nDEVTYPE=partition\nPARTN=1\nPARTNAME=data\n"))
+			Expect(event.isBlockDevice()).To(BeTrue())
+			Expect(event.diskName()).To(Equal("sda"))
+			Expect(event.Env["PARTNAME"]).To(Equal("data"))
+		})
+	})
+
+	Describe("parsing a unit serial number page", func() {
+		It("should return the trimmed serial number", func() {
+			page := append([]byte{0x00, 0x80, 0x00, 0x08}, []byte("ABC123  ")...)
+			Expect(parseUnitSerialNumber(page)).To(Equal("ABC123"))
+		})
+		It("should ignore other pages", func() {
+			page := append([]byte{0x00, 0x83, 0x00, 0x04}, []byte("ABCD")...)
+			Expect(parseUnitSerialNumber(page)).To(BeEmpty())
+		})
+	})
+})
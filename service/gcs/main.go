@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"os"
 
 	"github.com/Sirupsen/logrus"
@@ -9,11 +10,37 @@ import (
 	"github.com/Microsoft/opengcs/service/gcs/bridge"
 	"github.com/Microsoft/opengcs/service/gcs/core/gcs"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer/realos"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/native"
 	"github.com/Microsoft/opengcs/service/gcs/runtime/runc"
 	"github.com/Microsoft/opengcs/service/gcs/transport"
 	"github.com/Microsoft/opengcs/service/libs/commonutils"
 )
 
+var (
+	runtimeName = flag.String("runtime", "runc", "container runtime: an OCI runtime binary (runc, crun or runsc), or native, which runs libcontainer in the GCS")
+	runtimePath = flag.String("runtime-path", "", "path to the OCI runtime binary, if not the default for -runtime")
+)
+
+// newRuntime returns the container runtime with the given name. The binary of
+// an OCI runtime is found at path, if set.
+func newRuntime(name string, path string) (runtime.Runtime, error) {
+	if name == "native" {
+		if !native.Available() {
+			return nil, errors.New("the native runtime is unavailable since the GCS was built without cgo; build it with make native")
+		}
+		return native.NewRuntime()
+	}
+	profile, ok := runc.Profiles[name]
+	if !ok {
+		return nil, errors.Errorf("unknown container runtime %s", name)
+	}
+	if path != "" {
+		profile.Path = path
+	}
+	return runc.NewOCIRuntime(profile)
+}
+
 func main() {
 	// parse command line parameters and init logger
 	if err := utils.ProcessCommandlineOptions(); err != nil {
@@ -31,12 +58,19 @@ func main() {
 
 	utils.LogMsg("GCS started")
 	tport := &transport.VsockTransport{}
-	rtime, err := runc.NewRuntime()
+	rtime, err := newRuntime(*runtimeName, *runtimePath)
 	if err != nil {
 		logrus.Fatalf("%+v", err)
 	}
 	os := realos.NewOS()
 	coreint := gcs.NewGCSCore(rtime, os)
+	report, err := coreint.Reconcile()
+	if err != nil {
+		logrus.Errorf("%+v", err)
+	} else {
+		utils.LogMsgf("reconciled state left behind by a previous GCS: adopted containers %v, adopted processes %v, removed containers %v, removed layers %v, removed runtime files %v",
+			report.AdoptedContainers, report.AdoptedProcesses, report.RemovedContainers, report.RemovedLayers, report.RemovedRuntimeFiles)
+	}
 	b := bridge.NewBridge(tport, coreint, true)
 	b.CommandLoop()
 }
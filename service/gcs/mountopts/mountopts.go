@@ -0,0 +1,64 @@
+// Package mountopts converts the options of mounts, as written in fstab or OCI
+// specs, to the arguments of the mount system call.
+package mountopts
+
+import (
+	"syscall"
+)
+
+// flag describes how a mount option sets or clears a mount flag.
+type flag struct {
+	clear bool
+	flag  uintptr
+}
+
+// flags maps the mount options which correspond to mount flags to those
+// flags. Any other option is passed to the filesystem as data.
+var flags = map[string]flag{
+	"async":         {true, syscall.MS_SYNCHRONOUS},
+	"atime":         {true, syscall.MS_NOATIME},
+	"bind":          {false, syscall.MS_BIND},
+	"defaults":      {false, 0},
+	"dev":           {true, syscall.MS_NODEV},
+	"diratime":      {true, syscall.MS_NODIRATIME},
+	"dirsync":       {false, syscall.MS_DIRSYNC},
+	"exec":          {true, syscall.MS_NOEXEC},
+	"mand":          {false, syscall.MS_MANDLOCK},
+	"noatime":       {false, syscall.MS_NOATIME},
+	"nodev":         {false, syscall.MS_NODEV},
+	"nodiratime":    {false, syscall.MS_NODIRATIME},
+	"noexec":        {false, syscall.MS_NOEXEC},
+	"nomand":        {true, syscall.MS_MANDLOCK},
+	"norelatime":    {true, syscall.MS_RELATIME},
+	"nostrictatime": {true, syscall.MS_STRICTATIME},
+	"nosuid":        {false, syscall.MS_NOSUID},
+	"rbind":         {false, syscall.MS_BIND | syscall.MS_REC},
+	"relatime":      {false, syscall.MS_RELATIME},
+	"remount":       {false, syscall.MS_REMOUNT},
+	"ro":            {false, syscall.MS_RDONLY},
+	"rw":            {true, syscall.MS_RDONLY},
+	"strictatime":   {false, syscall.MS_STRICTATIME},
+	"suid":          {true, syscall.MS_NOSUID},
+	"sync":          {false, syscall.MS_SYNCHRONOUS},
+}
+
+// Parse splits the given mount options into the flags they correspond to and
+// the filesystem-specific data which should be passed to mount. Options are
+// applied in order, so a later option such as rw overrides an earlier ro.
+func Parse(options []string) (mountFlags uintptr, data []string) {
+	for _, option := range options {
+		if option == "" {
+			continue
+		}
+		if f, ok := flags[option]; ok {
+			if f.clear {
+				mountFlags &^= f.flag
+			} else {
+				mountFlags |= f.flag
+			}
+		} else {
+			data = append(data, option)
+		}
+	}
+	return mountFlags, data
+}
@@ -0,0 +1,13 @@
+package mountopts
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestMountOpts(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Mount Options Suite")
+}
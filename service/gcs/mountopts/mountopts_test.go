@@ -0,0 +1,57 @@
+package mountopts
+
+import (
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mount options", func() {
+	Describe("calling Parse", func() {
+		var (
+			options    []string
+			mountFlags uintptr
+			data       []string
+		)
+		JustBeforeEach(func() {
+			mountFlags, data = Parse(options)
+		})
+		Context("options is empty", func() {
+			BeforeEach(func() {
+				options = []string{}
+			})
+			It("should produce no flags or data", func() {
+				Expect(mountFlags).To(BeZero())
+				Expect(data).To(BeEmpty())
+			})
+		})
+		Context("options contains only flags", func() {
+			BeforeEach(func() {
+				options = []string{"noexec", "nosuid"}
+			})
+			It("should produce only flags", func() {
+				Expect(mountFlags).To(Equal(uintptr(syscall.MS_NOEXEC | syscall.MS_NOSUID)))
+				Expect(data).To(BeEmpty())
+			})
+		})
+		Context("options contains flags and filesystem-specific options", func() {
+			BeforeEach(func() {
+				options = []string{"discard", "ro", "", "nodev", "barrier=0"}
+			})
+			It("should split the flags from the data", func() {
+				Expect(mountFlags).To(Equal(uintptr(syscall.MS_RDONLY | syscall.MS_NODEV)))
+				Expect(data).To(Equal([]string{"discard", "barrier=0"}))
+			})
+		})
+		Context("a later option clears a flag set by an earlier one", func() {
+			BeforeEach(func() {
+				options = []string{"ro", "nosuid", "rw"}
+			})
+			It("should clear the flag", func() {
+				Expect(mountFlags).To(Equal(uintptr(syscall.MS_NOSUID)))
+				Expect(data).To(BeEmpty())
+			})
+		})
+	})
+})
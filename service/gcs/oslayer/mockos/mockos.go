@@ -3,6 +3,7 @@ package mockos
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net"
 	"os"
@@ -33,6 +34,7 @@ func (c *mockReadWriteCloser) CloseWrite() error {
 
 type mockProcessExitState struct {
 	exitCode int
+	signal   int
 }
 
 // NewProcessExitState returns a *mockProcessExitState with the given exit
@@ -40,9 +42,18 @@ type mockProcessExitState struct {
 func NewProcessExitState(exitCode int) *mockProcessExitState {
 	return &mockProcessExitState{exitCode: exitCode}
 }
+
+// NewSignaledProcessExitState returns a *mockProcessExitState for a process
+// terminated by the given signal.
+func NewSignaledProcessExitState(signal int) *mockProcessExitState {
+	return &mockProcessExitState{exitCode: -1, signal: signal}
+}
 func (s *mockProcessExitState) ExitCode() int {
 	return s.exitCode
 }
+func (s *mockProcessExitState) Signal() int {
+	return s.signal
+}
 
 type mockFile struct {
 	name string
@@ -281,6 +292,9 @@ func (o *mockOS) ReadDir(dirname string) ([]os.FileInfo, error) {
 	}
 	return infos, nil
 }
+func (o *mockOS) ReadFile(filename string) ([]byte, error) {
+	return []byte{}, nil
+}
 func (o *mockOS) Mount(source string, target string, fstype string, flags uintptr, data string) (err error) {
 	return nil
 }
@@ -296,6 +310,25 @@ func (o *mockOS) PathIsMounted(name string) (bool, error) {
 func (o *mockOS) Link(oldname, newname string) error {
 	return nil
 }
+func (o *mockOS) Symlink(oldname, newname string) error {
+	return nil
+}
+func (o *mockOS) Rename(oldpath, newpath string) error {
+	return nil
+}
+func (o *mockOS) Sync() {
+}
+func (o *mockOS) FlushBlockDevice(name string) error {
+	return nil
+}
+
+// Devices
+func (o *mockOS) WaitForBlockDevice(ctx context.Context, match func(oslayer.BlockDevice) bool) (oslayer.BlockDevice, error) {
+	return oslayer.BlockDevice{Name: "sda"}, nil
+}
+func (o *mockOS) WaitForBlockDeviceRemoval(ctx context.Context, name string) error {
+	return nil
+}
 
 // Networking
 func (o *mockOS) GetLinkByName(name string) (oslayer.Link, error) {
@@ -3,6 +3,7 @@
 package oslayer
 
 import (
+	"context"
 	"io"
 	"net"
 	"os"
@@ -24,6 +25,9 @@ const (
 // provide fake exit states.
 type ProcessExitState interface {
 	ExitCode() int
+	// Signal returns the signal which terminated the process, or 0 if the
+	// process exited on its own.
+	Signal() int
 }
 
 // File is an interface describing the methods exposed by a file on the system.
@@ -87,6 +91,27 @@ type Namespace interface {
 	io.Closer
 }
 
+// BlockDevice describes a block device, such as a disk or a partition, which
+// has been added to the system.
+type BlockDevice struct {
+	// Name is the name of the device under /dev, such as sda or sda1.
+	Name string
+	// Disk is the name of the disk containing the device if it is a
+	// partition, and empty otherwise.
+	Disk string
+	// SCSIID is the SCSI address (host:channel:target:lun) of the device, or
+	// of the disk containing it if it is a partition. It is empty for non-SCSI
+	// devices.
+	SCSIID string
+	// Serial is the serial number reported by the device, if any.
+	Serial string
+	// Partition is the 1-based index of the device in its disk's partition
+	// table if it is a partition, and 0 otherwise.
+	Partition uint32
+	// PartitionLabel is the GPT label of the device if it is a partition.
+	PartitionLabel string
+}
+
 // OS is the interface describing operations that can be performed on and by
 // the operating system, such as filesystem access and networking.
 type OS interface {
@@ -97,11 +122,20 @@ type OS interface {
 	RemoveAll(path string) error
 	Create(name string) (File, error)
 	ReadDir(dirname string) ([]os.FileInfo, error)
+	ReadFile(filename string) ([]byte, error)
 	Mount(source string, target string, fstype string, flags uintptr, data string) (err error)
 	Unmount(target string, flags int) (err error)
 	PathExists(name string) (bool, error)
 	PathIsMounted(name string) (bool, error)
 	Link(oldname, newname string) error
+	Symlink(oldname, newname string) error
+	Rename(oldpath, newpath string) error
+	Sync()
+	FlushBlockDevice(name string) error
+
+	// Devices
+	WaitForBlockDevice(ctx context.Context, match func(BlockDevice) bool) (BlockDevice, error)
+	WaitForBlockDeviceRemoval(ctx context.Context, name string) error
 
 	// Networking
 	GetLinkByName(name string) (Link, error)
@@ -3,18 +3,21 @@
 package realos
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	"strconv"
+	"sync"
 	"syscall"
 
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 
+	"github.com/Microsoft/opengcs/service/gcs/devicewatcher"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 )
 
@@ -32,6 +35,13 @@ func NewProcessExitState(state *os.ProcessState) *realProcessExitState {
 func (s *realProcessExitState) ExitCode() int {
 	return s.state.Sys().(syscall.WaitStatus).ExitStatus()
 }
+func (s *realProcessExitState) Signal() int {
+	status := s.state.Sys().(syscall.WaitStatus)
+	if !status.Signaled() {
+		return 0
+	}
+	return int(status.Signal())
+}
 
 type realFile struct {
 	file *os.File
@@ -239,7 +249,17 @@ func (n *realNamespace) Close() error {
 	return nil
 }
 
-type realOS struct{}
+// blkflsbuf is the BLKFLSBUF ioctl request, which flushes a block device's
+// buffer cache.
+const blkflsbuf = 0x1261
+
+type realOS struct {
+	// The device watcher is started on first use, since it's only needed by
+	// callers which wait for devices.
+	deviceWatcherOnce sync.Once
+	deviceWatcher     *devicewatcher.Watcher
+	deviceWatcherErr  error
+}
 
 // NewOS returns a *realOS OS interface implementation which calls into actual
 // system OS functionality.
@@ -284,6 +304,13 @@ func (o *realOS) ReadDir(dirname string) ([]os.FileInfo, error) {
 	}
 	return dirs, nil
 }
+func (o *realOS) ReadFile(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
 func (o *realOS) Mount(source string, target string, fstype string, flags uintptr, data string) (err error) {
 	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
 		return errors.WithStack(err)
@@ -325,6 +352,54 @@ func (o *realOS) Link(oldname, newname string) error {
 	}
 	return nil
 }
+func (o *realOS) Symlink(oldname, newname string) error {
+	if err := os.Symlink(oldname, newname); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+func (o *realOS) Rename(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+func (o *realOS) Sync() {
+	syscall.Sync()
+}
+func (o *realOS) FlushBlockDevice(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), blkflsbuf, 0); errno != 0 {
+		return errors.WithStack(errno)
+	}
+	return nil
+}
+
+// Devices
+func (o *realOS) getDeviceWatcher() (*devicewatcher.Watcher, error) {
+	o.deviceWatcherOnce.Do(func() {
+		o.deviceWatcher, o.deviceWatcherErr = devicewatcher.New()
+	})
+	return o.deviceWatcher, o.deviceWatcherErr
+}
+func (o *realOS) WaitForBlockDevice(ctx context.Context, match func(oslayer.BlockDevice) bool) (oslayer.BlockDevice, error) {
+	watcher, err := o.getDeviceWatcher()
+	if err != nil {
+		return oslayer.BlockDevice{}, err
+	}
+	return watcher.WaitForBlockDevice(ctx, match)
+}
+func (o *realOS) WaitForBlockDeviceRemoval(ctx context.Context, name string) error {
+	watcher, err := o.getDeviceWatcher()
+	if err != nil {
+		return err
+	}
+	return watcher.WaitForBlockDeviceRemoval(ctx, name)
+}
 
 // Networking
 func (o *realOS) GetLinkByName(name string) (oslayer.Link, error) {
@@ -5,6 +5,7 @@ package prot
 
 import (
 	"encoding/json"
+	"time"
 
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
@@ -76,6 +77,8 @@ const (
 	ComputeSystemResizeConsoleV1    = 0x10100801
 	ComputeSystemGetPropertiesV1    = 0x10100901
 	ComputeSystemModifySettingsV1   = 0x10100a01
+	ComputeSystemCheckpointV1       = 0x10100b01
+	ComputeSystemRestoreV1          = 0x10100c01
 
 	// ComputeSystem responses.
 	ComputeSystemResponseCreateV1           = 0x20100101
@@ -88,6 +91,8 @@ const (
 	ComputeSystemResponseResizeConsoleV1    = 0x20100801
 	ComputeSystemResponseGetPropertiesV1    = 0x20100901
 	ComputeSystemResponseModifySettingsV1   = 0x20100a01
+	ComputeSystemResponseCheckpointV1       = 0x20100b01
+	ComputeSystemResponseRestoreV1          = 0x20100c01
 
 	// ComputeSystem notifications.
 	ComputeSystemNotificationV1 = 0x30100101
@@ -155,6 +160,11 @@ const (
 	NtStarted        = NotificationType("Started")
 	NtPaused         = NotificationType("Paused")
 	NtUnknown        = NotificationType("Unknown")
+	// NtOutOfMemory is sent when a process in the container has been killed
+	// by the OOM killer.
+	NtOutOfMemory = NotificationType("OutOfMemory")
+	// NtStatistics is sent periodically with the container's resource usage.
+	NtStatistics = NotificationType("Statistics")
 )
 
 // ActiveOperation defines an operation to be associated with a notification
@@ -172,14 +182,39 @@ const (
 )
 
 // ContainerNotification is a message sent from the GCS to the HCS to indicate
-// some kind of event. At the moment, it is only used for container exit
-// notifications.
+// some kind of event, such as the container exiting, running out of memory, or
+// a sample of its resource usage being taken.
+// For exit notifications, Result is the exit code of the container's init
+// process and Signal the signal which terminated it, if any.
 type ContainerNotification struct {
 	*MessageBase
 	Type       NotificationType
 	Operation  ActiveOperation
 	Result     int32
-	ResultInfo string `json:",omitempty"`
+	ResultInfo string               `json:",omitempty"`
+	Signal     int32                `json:",omitempty"`
+	Statistics *ContainerStatistics `json:",omitempty"`
+}
+
+// ContainerStatistics is the resource usage and limits of a container, sent in
+// notifications of type NtStatistics. Limits are 0 when unlimited.
+type ContainerStatistics struct {
+	// CPUUsage is the total CPU time consumed by the container, in
+	// nanoseconds.
+	CPUUsage uint64
+	// MemoryUsage, MemoryMaxUsage and MemoryLimit are the current, peak and
+	// maximum memory usage of the container, in bytes. MemoryMaxUsage is 0
+	// when the utility VM's kernel doesn't track it.
+	MemoryUsage    uint64
+	MemoryMaxUsage uint64
+	MemoryLimit    uint64
+	// MemoryWorkingSet is MemoryUsage less the inactive file cache, which is
+	// reclaimed before the container runs out of memory.
+	MemoryWorkingSet uint64
+	// ProcessCount and ProcessLimit are the current and maximum number of
+	// processes in the container.
+	ProcessCount uint64
+	ProcessLimit uint64
 }
 
 // ExecuteProcessVsockStdioRelaySettings defines the port numbers for each
@@ -219,6 +254,11 @@ type ContainerResizeConsole struct {
 type ContainerWaitForProcess struct {
 	*MessageBase
 	ProcessID uint32 `json:"ProcessId"`
+	// ProcessStartTime is the start time returned in the
+	// ContainerExecuteProcessResponse for the process. A process whose pid
+	// has been reused by a later one is no longer found. Hosts which don't
+	// send it identify the process by its pid alone.
+	ProcessStartTime uint64
 	// TimeoutInMs is currently ignored, since timeouts are handled on the host
 	// side.
 	TimeoutInMs uint32
@@ -229,6 +269,11 @@ type ContainerWaitForProcess struct {
 type ContainerTerminateProcess struct {
 	*MessageBase
 	ProcessID uint32 `json:"ProcessId"`
+	// ProcessStartTime is the start time returned in the
+	// ContainerExecuteProcessResponse for the process. A process whose pid
+	// has been reused by a later one is no longer found. Hosts which don't
+	// send it identify the process by its pid alone.
+	ProcessStartTime uint64
 }
 
 // ContainerGetProperties is the message from the HCS requesting certain
@@ -358,10 +403,15 @@ type ContainerCreateResponse struct {
 }
 
 // ContainerExecuteProcessResponse is the message to the HCS responding to a
-// ContainerExecuteProcess message. It provides back the process's pid.
+// ContainerExecuteProcess message. It provides back the process's pid, and its
+// start time, which identifies the process together with the pid in later
+// messages.
 type ContainerExecuteProcessResponse struct {
 	*MessageResponseBase
 	ProcessID uint32 `json:"ProcessId"`
+	// ProcessStartTime is an opaque value, which is zero if the start time
+	// of the process couldn't be read.
+	ProcessStartTime uint64
 }
 
 // ContainerWaitForProcessResponse is the message to the HCS responding to a
@@ -382,11 +432,149 @@ type ContainerGetPropertiesResponse struct {
 
 /* types added on to the current official protocol types */
 
+// ContainerCheckpoint is the message from the HCS specifying to save the state
+// of the container's processes as an image in the directory ImagePath in the
+// utility VM, so that the container can be restored from it later, possibly in
+// another utility VM. ImagePath must be on a writable mapped virtual disk
+// attached to the container. The response is a MessageResponseBase.
+type ContainerCheckpoint struct {
+	*MessageBase
+	ImagePath string
+	Options   CheckpointOptions
+}
+
+// CheckpointOptions specify how a container should be checkpointed.
+type CheckpointOptions struct {
+	// LeaveRunning keeps the container running after it has been
+	// checkpointed. Otherwise, it exits once the image has been saved.
+	LeaveRunning bool `json:",omitempty"`
+	// TCPEstablished allows established TCP connections to be checkpointed.
+	TCPEstablished bool `json:"TcpEstablished,omitempty"`
+	// ExternalUnixSockets allows connections to unix sockets outside of the
+	// container to be checkpointed.
+	ExternalUnixSockets bool `json:",omitempty"`
+	// ShellJob allows a container whose processes are attached to a terminal
+	// to be checkpointed.
+	ShellJob bool `json:",omitempty"`
+	// FileLocks allows file locks held by the container to be checkpointed.
+	FileLocks bool `json:",omitempty"`
+}
+
+// ContainerRestore is the message from the HCS specifying to recreate a
+// container from the image in the directory ImagePath in the utility VM,
+// rather than executing its init process. The container must have been set up
+// by a ContainerCreate message, with the mapped virtual disk holding the
+// image attached to it. Settings describe the init process as they do for a
+// ContainerExecuteProcess message, including its OCI specification and stdio.
+// The response is a ContainerExecuteProcessResponse carrying the pid of the
+// restored init process.
+type ContainerRestore struct {
+	*MessageBase
+	ImagePath string
+	Settings  ExecuteProcessSettings
+}
+
+// PropertyQuery is the query of a ContainerGetProperties message, naming the
+// property types requested. An empty query, or one requesting only
+// PtProcessList, is answered with the JSON array of the container's
+// processes. Other queries are answered with a JSON object holding the value
+// of each requested property type, keyed by the type.
+type PropertyQuery struct {
+	PropertyTypes []PropertyType `json:",omitempty"`
+}
+
+// Property types of the utility VM rather than of a container. The
+// ContainerID of a ContainerGetProperties message requesting only them is
+// ignored.
+const (
+	// PtExternalProcessList lists the processes started in the utility VM
+	// outside of any container, as ExternalProcesses.
+	PtExternalProcessList = PropertyType("ExternalProcessList")
+	// PtVMProcessList lists every process running in the utility VM.
+	PtVMProcessList = PropertyType("VmProcessList")
+	// PtVMResources is the resource usage of the utility VM, as VMResources.
+	PtVMResources = PropertyType("VmResources")
+)
+
+// ExternalProcessStatus is the status of an external process.
+type ExternalProcessStatus string
+
+const (
+	EpsRunning = ExternalProcessStatus("Running")
+	EpsExited  = ExternalProcessStatus("Exited")
+)
+
+// ExternalProcess describes a process started in the utility VM outside of
+// any container, by a ContainerExecuteProcess message with IsExternal set.
+// Exited processes are listed for five minutes after they exit, and for as
+// long as the host is waiting on them, unless their pid is reused sooner.
+type ExternalProcess struct {
+	ProcessID uint32 `json:"ProcessId"`
+	// Command is empty for processes started by a previous instance of the
+	// GCS.
+	Command []string `json:",omitempty"`
+	// StartTime is the time the process started at, according to the
+	// utility VM's clock. It is the zero time if it is unknown.
+	StartTime time.Time
+	Status    ExternalProcessStatus
+	// ExitCode is only set for exited processes.
+	ExitCode int32 `json:",omitempty"`
+}
+
+// VMResources is the resource usage of the utility VM.
+type VMResources struct {
+	CPUCount int `json:"CpuCount"`
+	// LoadAverage is the average number of runnable processes over the last
+	// 1, 5 and 15 minutes.
+	LoadAverage [3]float64
+	// MemoryTotal and MemoryAvailable are in bytes. MemoryAvailable is the
+	// memory which can be used without swapping, according to the kernel.
+	MemoryTotal     uint64
+	MemoryAvailable uint64
+	ProcessCount    int
+	// UptimeInSeconds is the time elapsed since the utility VM booted.
+	UptimeInSeconds float64
+}
+
+// ScsiAddress represents the location of a SCSI device attached to the utility
+// VM.
+type ScsiAddress struct {
+	// Controller is the index of the SCSI controller the device is attached
+	// to.
+	Controller uint8
+	// Lun is the logical unit number of the device on its controller.
+	Lun uint8
+}
+
 // Layer represents a filesystem layer for a container.
 type Layer struct {
 	// Path is in this case the identifier (such as the SCSI number) of the
-	// layer device.
+	// layer device. It is only used if Address is not set, in which case the
+	// device is assumed to be on the first SCSI controller.
 	Path string
+	// Address is the SCSI address of the layer device.
+	Address *ScsiAddress `json:",omitempty"`
+	// PmemDevice is the number N of the persistent memory device /dev/pmemN
+	// holding the layer. If set, it takes precedence over Address and Path.
+	PmemDevice *uint32 `json:",omitempty"`
+	// Verity, if set, describes the dm-verity hash tree on the layer device
+	// against which the layer's contents are verified as they are read.
+	Verity *LayerVerity `json:",omitempty"`
+}
+
+// LayerVerity describes a dm-verity hash tree (format version 1), computed
+// over the layer's filesystem with SHA-256 and 4096-byte blocks, and stored
+// on the layer device after the filesystem.
+type LayerVerity struct {
+	// RootDigest is the hex-encoded root hash of the tree.
+	RootDigest string
+	// Salt is the hex-encoded salt prepended to each block when it is hashed.
+	// It may be empty if the tree was computed without a salt.
+	Salt string `json:",omitempty"`
+	// HashOffsetInBytes is the offset of the tree on the layer device. The
+	// filesystem occupies the device up to this offset, which must be a
+	// multiple of the block size.
+	HashOffsetInBytes uint64
 }
 
 // NetworkAdapter represents a network interface and its associated
@@ -411,6 +599,35 @@ type MappedVirtualDisk struct {
 	Lun               uint8 `json:",omitempty"`
 	CreateInUtilityVM bool  `json:",omitempty"`
 	ReadOnly          bool  `json:",omitempty"`
+	// Controller is the index of the SCSI controller the disk is attached to.
+	// Together with Lun it makes up the disk's SCSI address.
+	Controller uint8 `json:",omitempty"`
+	// Partition is the 1-based index of the partition on the disk which should
+	// be mounted. If neither it nor PartitionLabel is specified, the whole
+	// disk is mounted.
+	Partition uint32 `json:",omitempty"`
+	// PartitionLabel is the GPT label of the partition on the disk which
+	// should be mounted.
+	PartitionLabel string `json:",omitempty"`
+	// MountOptions is a list of additional options to mount the disk with,
+	// such as "noexec", "nosuid" or "discard". The disk's filesystem type is
+	// detected automatically.
+	MountOptions []string `json:",omitempty"`
+}
+
+// SandboxFormatOptions describes the ext4 filesystem created on a blank
+// sandbox device. Any zero field takes the mkfs.ext4 default.
+type SandboxFormatOptions struct {
+	// SizeInMB is the size of the filesystem. It must not exceed the size of
+	// the device. If zero, the filesystem fills the whole device.
+	SizeInMB uint64 `json:",omitempty"`
+	// BlockSize is the size of each filesystem block in bytes.
+	BlockSize uint32 `json:",omitempty"`
+	// InodeSize is the size of each inode in bytes.
+	InodeSize uint32 `json:",omitempty"`
+	// InodeCount is the number of inodes to create, which limits the number
+	// of files the sandbox can hold.
+	InodeCount uint64 `json:",omitempty"`
 }
 
 // VMHostedContainerSettings is the set of settings used to specify the initial
@@ -419,9 +636,27 @@ type VMHostedContainerSettings struct {
 	Layers []Layer
 	// SandboxDataPath is in this case the identifier (such as the SCSI number)
 	// of the sandbox device.
-	SandboxDataPath    string
-	MappedVirtualDisks []MappedVirtualDisk
-	NetworkAdapters    []NetworkAdapter `json:",omitempty"`
+	SandboxDataPath string
+	// SandboxDataAddress is the SCSI address of the sandbox device. If set, it
+	// takes precedence over SandboxDataPath.
+	SandboxDataAddress *ScsiAddress `json:",omitempty"`
+	// SandboxFormatOptions describes the filesystem to create on the sandbox
+	// device if it is blank, allowing the host to attach a newly created
+	// empty disk. If nil, a blank sandbox device is formatted with the
+	// default settings.
+	SandboxFormatOptions *SandboxFormatOptions `json:",omitempty"`
+	// EncryptSandbox is whether the sandbox device should be encrypted with
+	// dm-crypt, using a random key which is generated in the utility VM and
+	// never leaves it. The sandbox's contents don't outlive the container, and
+	// it is always formatted using SandboxFormatOptions.
+	EncryptSandbox bool `json:",omitempty"`
+	// EphemeralScratchSizeInMB, if no sandbox device is given, is the size of
+	// a tmpfs to use as the container's scratch space, so that its writes are
+	// kept in memory and discarded when it exits. If it is zero and no
+	// sandbox device is given, the container's root filesystem is read-only.
+	EphemeralScratchSizeInMB uint64 `json:",omitempty"`
+	MappedVirtualDisks       []MappedVirtualDisk
+	NetworkAdapters          []NetworkAdapter `json:",omitempty"`
 }
 
 // ProcessParameters represents any process which may be started in the utility
@@ -2,6 +2,8 @@
 package mockruntime
 
 import (
+	"time"
+
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
@@ -123,3 +125,33 @@ func (r *mockRuntime) GetInitPid(id string) (pid int, err error) {
 func (r *mockRuntime) GetStdioPipes(id string, pid int) (*runtime.StdioPipes, error) {
 	return &runtime.StdioPipes{}, nil
 }
+
+func (r *mockRuntime) CheckpointContainer(id string, imagePath string, options runtime.CheckpointOptions) error {
+	return nil
+}
+
+func (r *mockRuntime) RestoreContainer(id string, bundlePath string, imagePath string, stdioOptions runtime.StdioOptions) (pid int, err error) {
+	return 101, nil
+}
+
+func (r *mockRuntime) Events(id string, statsInterval time.Duration) (<-chan runtime.Event, error) {
+	events := make(chan runtime.Event, 2)
+	events <- runtime.Event{
+		Type: runtime.EventStats,
+		ID:   id,
+		Stats: &runtime.ContainerStats{
+			CPUUsage:       1000,
+			MemoryUsage:    2048,
+			MemoryMaxUsage: 4096,
+			MemoryLimit:    8192,
+			Pids:           3,
+		},
+	}
+	events <- runtime.Event{Type: runtime.EventOOM, ID: id}
+	close(events)
+	return events, nil
+}
+
+func (r *mockRuntime) CleanupStaleContainerFiles() ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,74 @@
+package native
+
+import (
+	"time"
+
+	"github.com/opencontainers/runc/libcontainer"
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+)
+
+// Events sends the OOM notifications of the container's memory cgroup over
+// the returned channel, along with a sample of its cgroup statistics every
+// statsInterval. No statistics are sent if statsInterval isn't positive.
+func (r *nativeRuntime) Events(id string, statsInterval time.Duration) (<-chan runtime.Event, error) {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	oom, err := c.handle.NotifyOOM()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to register for OOM notifications of container %s", id)
+	}
+
+	events := make(chan runtime.Event)
+	go func() {
+		defer close(events)
+		var tick <-chan time.Time
+		if statsInterval > 0 {
+			ticker := time.NewTicker(statsInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case _, ok := <-oom:
+				// The notifications end when the memory cgroup is removed,
+				// which happens before the container is deleted.
+				if !ok {
+					oom = nil
+					continue
+				}
+				events <- runtime.Event{Type: runtime.EventOOM, ID: id}
+			case <-tick:
+				stats, err := c.handle.Stats()
+				if err != nil {
+					// The cgroups are gone once the container has been
+					// destroyed, which races with it being deleted.
+					continue
+				}
+				events <- runtime.Event{Type: runtime.EventStats, ID: id, Stats: convertStats(stats)}
+			case <-c.deleted:
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// convertStats converts the cgroup statistics of a libcontainer container to
+// the statistics reported by the runtime.
+func convertStats(stats *libcontainer.Stats) *runtime.ContainerStats {
+	cgroupStats := stats.CgroupStats
+	if cgroupStats == nil {
+		return &runtime.ContainerStats{}
+	}
+	return &runtime.ContainerStats{
+		CPUUsage:       cgroupStats.CpuStats.CpuUsage.TotalUsage,
+		MemoryUsage:    cgroupStats.MemoryStats.Usage.Usage,
+		MemoryMaxUsage: cgroupStats.MemoryStats.Usage.MaxUsage,
+		MemoryLimit:    cgroupStats.MemoryStats.Usage.Limit,
+		Pids:           cgroupStats.PidsStats.Current,
+	}
+}
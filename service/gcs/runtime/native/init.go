@@ -0,0 +1,32 @@
+package native
+
+import (
+	"os"
+	goruntime "runtime"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/runc/libcontainer"
+)
+
+// initCommand is the argument the GCS binary is re-executed with by
+// libcontainer to become a container's init process, or to join a container
+// for an exec.
+const initCommand = "init"
+
+// init turns the process into a container process instead of the GCS when it
+// has been re-executed by libcontainer. This has to happen before main runs,
+// while the process is still single threaded.
+func init() {
+	if len(os.Args) < 2 || os.Args[1] != initCommand {
+		return
+	}
+	goruntime.GOMAXPROCS(1)
+	goruntime.LockOSThread()
+	factory, _ := libcontainer.New("")
+	if err := factory.StartInitialization(); err != nil {
+		// The error has already been reported to the GCS through the init
+		// pipe.
+		logrus.Fatal(err)
+	}
+	panic("libcontainer failed to exec the container process")
+}
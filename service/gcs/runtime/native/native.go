@@ -0,0 +1,616 @@
+// Package native defines an implementation of the Runtime interface which runs
+// containers in process through libcontainer, rather than by exec'ing runC for
+// each operation.
+package native
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	containerdsys "github.com/docker/containerd/sys"
+	"github.com/opencontainers/runc/libcontainer"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer/realos"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+)
+
+// stateDir is the directory under which libcontainer keeps the state of each
+// container.
+const stateDir = "/var/lib/gcsnative"
+
+// nativeRuntime is an implementation of the Runtime interface which uses
+// libcontainer as the container runtime.
+// Handles to the containers and the processes started in them are kept in
+// memory, and processes are waited on directly as soon as they have started,
+// so their exits are known without polling. Containers left behind by a
+// previous instance of the GCS are loaded from their libcontainer state the
+// first time they are used.
+type nativeRuntime struct {
+	factory libcontainer.Factory
+
+	mutex      sync.Mutex
+	containers map[string]*container
+}
+
+// container holds the libcontainer handle to a container and the processes
+// started in it by the runtime.
+type container struct {
+	handle libcontainer.Container
+	// processes maps the pids of the processes started in the container by the
+	// runtime, including its init process, to those processes.
+	processes map[int]*process
+	// deleted is closed once the container has been deleted.
+	deleted chan struct{}
+}
+
+// process is a process started in a container by the runtime.
+type process struct {
+	handle  *libcontainer.Process
+	pid     int
+	command []string
+	pipes   *runtime.StdioPipes
+	// console is the master of the process's terminal, if it has one.
+	console *os.File
+
+	// exited is closed once the process has exited and been waited on, after
+	// which state and err are set.
+	exited chan struct{}
+	state  *os.ProcessState
+	err    error
+}
+
+// Available returns whether the native runtime can be used, which requires
+// the GCS to be built with cgo.
+func Available() bool {
+	return nsenterLinked
+}
+
+// NewRuntime instantiates a new nativeRuntime struct.
+func NewRuntime() (*nativeRuntime, error) {
+	if !nsenterLinked {
+		return nil, errors.New("the native runtime requires the GCS to be built with cgo")
+	}
+	// Restored processes are reparented to the GCS once CRIU exits, and must
+	// be waited on by it.
+	if err := containerdsys.SetSubreaper(1); err != nil {
+		return nil, errors.Wrap(err, "failed to set the GCS as a subreaper")
+	}
+	factory, err := libcontainer.New(stateDir, libcontainer.Cgroupfs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create the libcontainer factory in %s", stateDir)
+	}
+	return &nativeRuntime{
+		factory:    factory,
+		containers: make(map[string]*container),
+	}, nil
+}
+
+// CreateContainer creates a container with the given ID and the given
+// bundlePath.
+// bundlePath should be a path to an OCI bundle containing a config.json file
+// and a rootfs for the container.
+func (r *nativeRuntime) CreateContainer(id string, bundlePath string, stdioOptions runtime.StdioOptions) (pid int, err error) {
+	return r.createContainer(id, bundlePath, stdioOptions, func(c libcontainer.Container, p *libcontainer.Process) error {
+		return c.Start(p)
+	})
+}
+
+// createContainer creates the container with the given ID from the bundle at
+// bundlePath, and starts its init process with the given function.
+func (r *nativeRuntime) createContainer(id string, bundlePath string, stdioOptions runtime.StdioOptions, start func(libcontainer.Container, *libcontainer.Process) error) (pid int, err error) {
+	spec, err := readSpec(bundlePath)
+	if err != nil {
+		return -1, err
+	}
+	config, err := specToConfig(id, bundlePath, spec)
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to convert the spec for container %s", id)
+	}
+	handle, err := r.factory.Create(id, config)
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to create container %s", id)
+	}
+	p, err := startProcess(spec.Process, stdioOptions, func(lp *libcontainer.Process) error {
+		return start(handle, lp)
+	})
+	if err != nil {
+		handle.Destroy()
+		return -1, errors.Wrapf(err, "failed to start the init process for container %s", id)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.containers[id] = &container{
+		handle:    handle,
+		processes: map[int]*process{p.pid: p},
+		deleted:   make(chan struct{}),
+	}
+	return p.pid, nil
+}
+
+// StartContainer unblocks the container's init process created by the call to
+// CreateContainer.
+func (r *nativeRuntime) StartContainer(id string) error {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return err
+	}
+	if err := c.handle.Exec(); err != nil {
+		return errors.Wrapf(err, "failed to start container %s", id)
+	}
+	return nil
+}
+
+// ExecProcess executes a new process, represented as an OCI process struct,
+// inside an already-running container.
+func (r *nativeRuntime) ExecProcess(id string, ociProcess oci.Process, stdioOptions runtime.StdioOptions) (pid int, err error) {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return -1, err
+	}
+	p, err := startProcess(ociProcess, stdioOptions, c.handle.Start)
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to execute process in container %s", id)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c.processes[p.pid] = p
+	return p.pid, nil
+}
+
+// KillContainer sends the specified signal to the container's init process.
+func (r *nativeRuntime) KillContainer(id string, signal oslayer.Signal) error {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return err
+	}
+	if err := c.handle.Signal(syscall.Signal(signal), false); err != nil {
+		return errors.Wrapf(err, "failed to send signal %d to container %s", signal, id)
+	}
+	return nil
+}
+
+// DeleteContainer destroys the container, and releases any state held for it
+// by the runtime.
+func (r *nativeRuntime) DeleteContainer(id string) error {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return err
+	}
+	if err := c.handle.Destroy(); err != nil {
+		return errors.Wrapf(err, "failed to destroy container %s", id)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, p := range c.processes {
+		p.release()
+	}
+	close(c.deleted)
+	delete(r.containers, id)
+	return nil
+}
+
+// DeleteProcess releases any state held for the process by the runtime.
+func (r *nativeRuntime) DeleteProcess(id string, pid int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c, ok := r.containers[id]
+	if !ok {
+		return nil
+	}
+	if p, ok := c.processes[pid]; ok {
+		p.release()
+		delete(c.processes, pid)
+	}
+	return nil
+}
+
+// PauseContainer suspends all processes running in the container.
+func (r *nativeRuntime) PauseContainer(id string) error {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return err
+	}
+	if err := c.handle.Pause(); err != nil {
+		return errors.Wrapf(err, "failed to pause container %s", id)
+	}
+	return nil
+}
+
+// ResumeContainer unsuspends processes running in the container.
+func (r *nativeRuntime) ResumeContainer(id string) error {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return err
+	}
+	if err := c.handle.Resume(); err != nil {
+		return errors.Wrapf(err, "failed to resume container %s", id)
+	}
+	return nil
+}
+
+// GetContainerState returns information about the given container.
+func (r *nativeRuntime) GetContainerState(id string) (*runtime.ContainerState, error) {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	return containerState(c.handle)
+}
+
+// ContainerExists returns true if the container exists, false if it doesn't
+// exist.
+// It should be noted that containers that have stopped but have not been
+// deleted are still considered to exist.
+func (r *nativeRuntime) ContainerExists(id string) (bool, error) {
+	if _, err := r.getContainer(id); err != nil {
+		if isNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// ListContainerStates returns ContainerState structs for all existing
+// containers, whether they're running or not.
+func (r *nativeRuntime) ListContainerStates() ([]runtime.ContainerState, error) {
+	ids, err := listStateDirs()
+	if err != nil {
+		return nil, err
+	}
+	var states []runtime.ContainerState
+	for _, id := range ids {
+		c, err := r.getContainer(id)
+		if err != nil {
+			if isNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		state, err := containerState(c.handle)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, *state)
+	}
+	return states, nil
+}
+
+// GetRunningContainerProcesses gets only the running processes associated with
+// the given container. This excludes zombie processes.
+func (r *nativeRuntime) GetRunningContainerProcesses(id string) ([]runtime.ContainerProcessState, error) {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	pids, err := c.handle.Processes()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the processes of container %s", id)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var states []runtime.ContainerProcessState
+	for _, pid := range pids {
+		command, err := getProcessCommand(pid)
+		if err != nil {
+			return nil, err
+		}
+		_, created := c.processes[pid]
+		states = append(states, runtime.ContainerProcessState{Pid: pid, Command: command, CreatedByRuntime: created, IsZombie: false})
+	}
+	return states, nil
+}
+
+// GetAllContainerProcesses gets all processes associated with the given
+// container, including both running and zombie processes.
+// Processes started by the runtime are reaped as soon as they exit, so those
+// which have exited but have not yet been deleted are reported as zombies.
+func (r *nativeRuntime) GetAllContainerProcesses(id string) ([]runtime.ContainerProcessState, error) {
+	states, err := r.GetRunningContainerProcesses(id)
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[int]bool)
+	for _, state := range states {
+		running[state.Pid] = true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c, ok := r.containers[id]
+	if !ok {
+		return states, nil
+	}
+	for pid, p := range c.processes {
+		if !running[pid] && p.hasExited() {
+			states = append(states, runtime.ContainerProcessState{Pid: pid, Command: p.command, CreatedByRuntime: true, IsZombie: true})
+		}
+	}
+	return states, nil
+}
+
+// WaitOnProcess waits for the process to exit, and returns its
+// oslayer.ProcessExitState containing exit information.
+// Processes which weren't started by this instance of the runtime are waited
+// on through their pid.
+func (r *nativeRuntime) WaitOnProcess(id string, pid int) (oslayer.ProcessExitState, error) {
+	p := r.getProcess(id, pid)
+	if p == nil {
+		return waitOnPid(pid)
+	}
+	<-p.exited
+	if p.state == nil {
+		return nil, errors.Wrapf(p.err, "failed waiting on process %d", pid)
+	}
+	return realos.NewProcessExitState(p.state), nil
+}
+
+// WaitOnContainer waits on every non-init process in the container, and then
+// performs a final wait on the init process.
+// The oslayer.ProcessExitState returned is the state acquired from waiting on
+// the init process.
+func (r *nativeRuntime) WaitOnContainer(id string) (oslayer.ProcessExitState, error) {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	initPid, err := r.GetInitPid(id)
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	var processes []*process
+	for pid, p := range c.processes {
+		if pid != initPid {
+			processes = append(processes, p)
+		}
+	}
+	r.mutex.Unlock()
+	for _, p := range processes {
+		<-p.exited
+	}
+	return r.WaitOnProcess(id, initPid)
+}
+
+// GetInitPid gets the init process's pid for nativeRuntime.
+func (r *nativeRuntime) GetInitPid(id string) (pid int, err error) {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return -1, err
+	}
+	state, err := c.handle.State()
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to get the state of container %s", id)
+	}
+	return state.InitProcessPid, nil
+}
+
+// GetStdioPipes returns the stdio pipes used by the given process.
+func (r *nativeRuntime) GetStdioPipes(id string, pid int) (*runtime.StdioPipes, error) {
+	p := r.getProcess(id, pid)
+	if p == nil {
+		return nil, errors.Errorf("process %d in container %s wasn't started by the runtime", pid, id)
+	}
+	return p.pipes, nil
+}
+
+// CheckpointContainer saves the state of the container's processes as a CRIU
+// image in the given directory, which is created if it doesn't exist. Unless
+// options.LeaveRunning is set, the container is stopped once it has been
+// checkpointed.
+func (r *nativeRuntime) CheckpointContainer(id string, imagePath string, options runtime.CheckpointOptions) error {
+	c, err := r.getContainer(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(imagePath, 0700); err != nil {
+		return errors.Wrapf(err, "failed making checkpoint image directory %s", imagePath)
+	}
+	criuOpts := &libcontainer.CriuOpts{
+		ImagesDirectory:         imagePath,
+		LeaveRunning:            options.LeaveRunning,
+		TcpEstablished:          options.TCPEstablished,
+		ExternalUnixConnections: options.ExternalUnixSockets,
+		ShellJob:                options.ShellJob,
+		FileLocks:               options.FileLocks,
+	}
+	if err := c.handle.Checkpoint(criuOpts); err != nil {
+		return errors.Wrapf(err, "failed to checkpoint container %s", id)
+	}
+	return nil
+}
+
+// RestoreContainer recreates the container with the given ID and bundlePath
+// from the CRIU image in the given directory, and returns the pid of its init
+// process. The container is running once it has been restored, so it mustn't
+// be started with StartContainer. Its stdio is set up as it is for
+// CreateContainer, except that containers with a terminal can't be restored.
+func (r *nativeRuntime) RestoreContainer(id string, bundlePath string, imagePath string, stdioOptions runtime.StdioOptions) (pid int, err error) {
+	criuOpts := &libcontainer.CriuOpts{ImagesDirectory: imagePath}
+	return r.createContainer(id, bundlePath, stdioOptions, func(c libcontainer.Container, p *libcontainer.Process) error {
+		if p.ConsoleSocket != nil {
+			return errors.New("containers with a terminal can't be restored")
+		}
+		return c.Restore(p, criuOpts)
+	})
+}
+
+// CleanupStaleContainerFiles removes the state directories which libcontainer
+// can't load a container from, and returns their IDs.
+func (r *nativeRuntime) CleanupStaleContainerFiles() ([]string, error) {
+	ids, err := listStateDirs()
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, id := range ids {
+		_, err := r.getContainer(id)
+		if err == nil {
+			continue
+		}
+		if !isNotExist(err) {
+			return removed, err
+		}
+		if err := os.RemoveAll(filepath.Join(stateDir, id)); err != nil {
+			return removed, errors.Wrapf(err, "failed removing the state directory for container %s", id)
+		}
+		removed = append(removed, id)
+	}
+	return removed, nil
+}
+
+// getContainer returns the container with the given ID, loading it from its
+// libcontainer state if it isn't known to the runtime yet.
+func (r *nativeRuntime) getContainer(id string) (*container, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if c, ok := r.containers[id]; ok {
+		return c, nil
+	}
+	handle, err := r.factory.Load(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load container %s", id)
+	}
+	c := &container{
+		handle:    handle,
+		processes: make(map[int]*process),
+		deleted:   make(chan struct{}),
+	}
+	r.containers[id] = c
+	return c, nil
+}
+
+// getProcess returns the process with the given pid started in the given
+// container by the runtime, or nil if there is no such process.
+func (r *nativeRuntime) getProcess(id string, pid int) *process {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c, ok := r.containers[id]
+	if !ok {
+		return nil
+	}
+	return c.processes[pid]
+}
+
+// hasExited returns true if the process has exited and been waited on.
+func (p *process) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for the process to exit and records its exit state.
+func (p *process) wait() {
+	p.state, p.err = p.handle.Wait()
+	close(p.exited)
+}
+
+// release closes the process's terminal master, if any. Its stdio pipes are
+// owned by the caller of GetStdioPipes.
+func (p *process) release() {
+	if p.console != nil {
+		p.console.Close()
+		p.console = nil
+	}
+}
+
+// containerState converts the state of the given libcontainer container to a
+// runtime.ContainerState.
+func containerState(handle libcontainer.Container) (*runtime.ContainerState, error) {
+	state, err := handle.State()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the state of container %s", handle.ID())
+	}
+	status, err := handle.Status()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the status of container %s", handle.ID())
+	}
+	return &runtime.ContainerState{
+		OCIVersion: state.Config.Version,
+		ID:         state.ID,
+		Pid:        state.InitProcessPid,
+		BundlePath: bundlePathFromConfig(state.Config),
+		RootfsPath: state.Config.Rootfs,
+		Status:     status.String(),
+		Created:    state.Created.Format(time.RFC3339Nano),
+	}, nil
+}
+
+// isNotExist returns true if the given error was returned because a container
+// doesn't exist.
+func isNotExist(err error) bool {
+	lerr, ok := errors.Cause(err).(libcontainer.Error)
+	return ok && lerr.Code() == libcontainer.ContainerNotExists
+}
+
+// listStateDirs returns the IDs of the containers which have a state
+// directory.
+func listStateDirs() ([]string, error) {
+	entries, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading the libcontainer state directory %s", stateDir)
+	}
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// readSpec reads the OCI spec from the config.json in the given bundle.
+func readSpec(bundlePath string) (*oci.Spec, error) {
+	configPath := filepath.Join(bundlePath, "config.json")
+	configFile, err := os.Open(configPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open config file %s", configPath)
+	}
+	defer configFile.Close()
+	var spec oci.Spec
+	if err := json.NewDecoder(configFile).Decode(&spec); err != nil {
+		return nil, errors.Wrap(err, "failed to decode config file as JSON")
+	}
+	return &spec, nil
+}
+
+// waitOnPid waits for the process with the given pid to exit.
+func waitOnPid(pid int) (oslayer.ProcessExitState, error) {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find process %d", pid)
+	}
+	state, err := process.Wait()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed waiting on process %d", pid)
+	}
+	return realos.NewProcessExitState(state), nil
+}
+
+// getProcessCommand gets the command line command and arguments for the
+// process with the given pid.
+func getProcessCommand(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read cmdline file for process %d", pid)
+	}
+	cmdString := strings.TrimSuffix(string(data), "\x00")
+	return strings.Split(cmdString, "\x00"), nil
+}
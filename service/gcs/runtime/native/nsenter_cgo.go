@@ -0,0 +1,10 @@
+// +build cgo
+
+package native
+
+// nsenter sets up the namespaces of container processes before the Go runtime
+// starts in them, and is only available with cgo.
+import _ "github.com/opencontainers/runc/libcontainer/nsenter"
+
+// nsenterLinked is true if the GCS is able to start container processes.
+const nsenterLinked = true
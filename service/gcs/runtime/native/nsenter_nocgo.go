@@ -0,0 +1,6 @@
+// +build !cgo
+
+package native
+
+// nsenterLinked is true if the GCS is able to start container processes.
+const nsenterLinked = false
@@ -0,0 +1,493 @@
+package native
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runc/libcontainer"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runc/libcontainer/seccomp"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/Microsoft/opengcs/service/gcs/mountopts"
+)
+
+// bundleLabelPrefix prefixes the container config label recording the path to
+// the container's bundle, as runC does.
+const bundleLabelPrefix = "bundle="
+
+// namespaceTypes maps the OCI namespace types to their libcontainer
+// equivalents.
+var namespaceTypes = map[oci.LinuxNamespaceType]configs.NamespaceType{
+	oci.PIDNamespace:     configs.NEWPID,
+	oci.NetworkNamespace: configs.NEWNET,
+	oci.MountNamespace:   configs.NEWNS,
+	oci.UserNamespace:    configs.NEWUSER,
+	oci.IPCNamespace:     configs.NEWIPC,
+	oci.UTSNamespace:     configs.NEWUTS,
+}
+
+// mountPropagations maps the OCI rootfs propagation modes to mount flags.
+var mountPropagations = map[string]int{
+	"rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"private":  syscall.MS_PRIVATE,
+	"rslave":   syscall.MS_SLAVE | syscall.MS_REC,
+	"slave":    syscall.MS_SLAVE,
+	"rshared":  syscall.MS_SHARED | syscall.MS_REC,
+	"shared":   syscall.MS_SHARED,
+	"":         syscall.MS_PRIVATE | syscall.MS_REC,
+}
+
+// rlimitTypes maps the OCI rlimit names to their resource numbers.
+var rlimitTypes = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+// specToConfig converts the OCI spec of the container with the given ID and
+// bundlePath to the libcontainer config used to create it.
+// The container is created without pivot_root, as it is by runc create
+// --no-pivot, since the utility VM's root filesystem is an initramfs.
+func specToConfig(id string, bundlePath string, spec *oci.Spec) (*configs.Config, error) {
+	if spec.Linux == nil {
+		return nil, errors.New("the spec doesn't contain any Linux configuration")
+	}
+	rootfs := spec.Root.Path
+	if !filepath.IsAbs(rootfs) {
+		rootfs = filepath.Join(bundlePath, rootfs)
+	}
+	config := &configs.Config{
+		Rootfs:          rootfs,
+		NoPivotRoot:     true,
+		Readonlyfs:      spec.Root.Readonly,
+		Hostname:        spec.Hostname,
+		Labels:          []string{bundleLabelPrefix + bundlePath},
+		Version:         spec.Version,
+		MaskPaths:       spec.Linux.MaskedPaths,
+		ReadonlyPaths:   spec.Linux.ReadonlyPaths,
+		MountLabel:      spec.Linux.MountLabel,
+		Sysctl:          spec.Linux.Sysctl,
+		NoNewPrivileges: spec.Process.NoNewPrivileges,
+		AppArmorProfile: spec.Process.ApparmorProfile,
+		ProcessLabel:    spec.Process.SelinuxLabel,
+		Capabilities:    convertCapabilities(spec.Process.Capabilities),
+	}
+
+	propagation, ok := mountPropagations[spec.Linux.RootfsPropagation]
+	if !ok {
+		return nil, errors.Errorf("invalid rootfs propagation %s", spec.Linux.RootfsPropagation)
+	}
+	config.RootPropagation = propagation
+
+	for _, ns := range spec.Linux.Namespaces {
+		t, ok := namespaceTypes[ns.Type]
+		if !ok {
+			return nil, errors.Errorf("namespace type %s is not supported", ns.Type)
+		}
+		if config.Namespaces.Contains(t) {
+			return nil, errors.Errorf("duplicate namespace type %s", ns.Type)
+		}
+		config.Namespaces.Add(t, ns.Path)
+	}
+	// A new network namespace only needs its loopback interface brought up,
+	// since adapters are moved into it by the GCS.
+	if config.Namespaces.Contains(configs.NEWNET) && config.Namespaces.PathOf(configs.NEWNET) == "" {
+		config.Networks = []*configs.Network{{Type: "loopback"}}
+	}
+
+	for _, m := range spec.Mounts {
+		config.Mounts = append(config.Mounts, convertMount(bundlePath, m))
+	}
+
+	devices, err := convertDevices(spec.Linux.Devices)
+	if err != nil {
+		return nil, err
+	}
+	config.Devices = append(append([]*configs.Device{}, configs.DefaultAutoCreatedDevices...), devices...)
+
+	cgroup, err := convertCgroup(id, spec, devices)
+	if err != nil {
+		return nil, err
+	}
+	config.Cgroups = cgroup
+	if spec.Linux.Resources != nil && spec.Linux.Resources.OOMScoreAdj != nil {
+		config.OomScoreAdj = *spec.Linux.Resources.OOMScoreAdj
+	}
+
+	for _, m := range spec.Linux.UIDMappings {
+		config.UidMappings = append(config.UidMappings, convertIDMapping(m))
+	}
+	for _, m := range spec.Linux.GIDMappings {
+		config.GidMappings = append(config.GidMappings, convertIDMapping(m))
+	}
+
+	rlimits, err := convertRlimits(spec.Process.Rlimits)
+	if err != nil {
+		return nil, err
+	}
+	config.Rlimits = rlimits
+
+	if spec.Linux.Seccomp != nil {
+		config.Seccomp, err = convertSeccomp(spec.Linux.Seccomp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config.Hooks = convertHooks(spec.Hooks)
+	return config, nil
+}
+
+// bundlePathFromConfig returns the bundle path recorded in the given config
+// by specToConfig.
+func bundlePathFromConfig(config configs.Config) string {
+	for _, label := range config.Labels {
+		if strings.HasPrefix(label, bundleLabelPrefix) {
+			return strings.TrimPrefix(label, bundleLabelPrefix)
+		}
+	}
+	return ""
+}
+
+// convertMount converts an OCI mount to a libcontainer mount. The sources of
+// bind mounts are relative to bundlePath.
+func convertMount(bundlePath string, m oci.Mount) *configs.Mount {
+	flags, propagationFlags, data := parseMountOptions(m.Options)
+	source := m.Source
+	device := m.Type
+	if flags&syscall.MS_BIND != 0 {
+		device = "bind"
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(bundlePath, source)
+		}
+	}
+	return &configs.Mount{
+		Device:           device,
+		Source:           source,
+		Destination:      m.Destination,
+		Data:             data,
+		Flags:            flags,
+		PropagationFlags: propagationFlags,
+	}
+}
+
+// parseMountOptions splits the given mount options into mount flags,
+// propagation flags and the filesystem-specific data.
+func parseMountOptions(options []string) (flags int, propagationFlags []int, data string) {
+	var otherOptions []string
+	for _, option := range options {
+		if option != "" && mountPropagations[option] != 0 {
+			propagationFlags = append(propagationFlags, mountPropagations[option])
+		} else {
+			otherOptions = append(otherOptions, option)
+		}
+	}
+	mountFlags, dataOptions := mountopts.Parse(otherOptions)
+	return int(mountFlags), propagationFlags, strings.Join(dataOptions, ",")
+}
+
+// convertDevices converts the OCI devices to be created in the container to
+// libcontainer devices.
+func convertDevices(devices []oci.LinuxDevice) ([]*configs.Device, error) {
+	var converted []*configs.Device
+	for _, d := range devices {
+		t, err := deviceType(d.Type)
+		if err != nil {
+			return nil, err
+		}
+		device := &configs.Device{
+			Type:        t,
+			Path:        d.Path,
+			Major:       d.Major,
+			Minor:       d.Minor,
+			Permissions: "rwm",
+			Allow:       true,
+		}
+		if d.FileMode != nil {
+			device.FileMode = *d.FileMode
+		}
+		if d.UID != nil {
+			device.Uid = *d.UID
+		}
+		if d.GID != nil {
+			device.Gid = *d.GID
+		}
+		converted = append(converted, device)
+	}
+	return converted, nil
+}
+
+// deviceType returns the libcontainer device type for the given OCI device
+// type. An empty type matches all devices.
+func deviceType(t string) (rune, error) {
+	switch t {
+	case "":
+		return 'a', nil
+	case "a", "b", "c", "p":
+		return rune(t[0]), nil
+	case "u":
+		return 'c', nil
+	}
+	return 0, errors.Errorf("invalid device type %s", t)
+}
+
+// convertCgroup returns the cgroup config for the container with the given ID
+// and spec, which allows access to the default devices as well as the given
+// devices created in the container.
+func convertCgroup(id string, spec *oci.Spec, devices []*configs.Device) (*configs.Cgroup, error) {
+	path := spec.Linux.CgroupsPath
+	if path == "" {
+		path = id
+	}
+	cgroup := &configs.Cgroup{
+		Path:      filepath.Join("/", path),
+		Resources: &configs.Resources{},
+	}
+	r := spec.Linux.Resources
+	if r != nil {
+		for _, d := range r.Devices {
+			t, err := deviceType(d.Type)
+			if err != nil {
+				return nil, err
+			}
+			major, minor := int64(-1), int64(-1)
+			if d.Major != nil {
+				major = *d.Major
+			}
+			if d.Minor != nil {
+				minor = *d.Minor
+			}
+			cgroup.Resources.Devices = append(cgroup.Resources.Devices, &configs.Device{
+				Type:        t,
+				Major:       major,
+				Minor:       minor,
+				Permissions: d.Access,
+				Allow:       d.Allow,
+			})
+		}
+	}
+	for _, d := range configs.DefaultAllowedDevices {
+		allowed := *d
+		allowed.Allow = true
+		cgroup.Resources.Devices = append(cgroup.Resources.Devices, &allowed)
+	}
+	cgroup.Resources.Devices = append(cgroup.Resources.Devices, devices...)
+	if r == nil {
+		return cgroup, nil
+	}
+
+	if r.DisableOOMKiller != nil {
+		cgroup.Resources.OomKillDisable = *r.DisableOOMKiller
+	}
+	if m := r.Memory; m != nil {
+		if m.Limit != nil {
+			cgroup.Resources.Memory = *m.Limit
+		}
+		if m.Reservation != nil {
+			cgroup.Resources.MemoryReservation = *m.Reservation
+		}
+		if m.Swap != nil {
+			cgroup.Resources.MemorySwap = *m.Swap
+		}
+		if m.Kernel != nil {
+			cgroup.Resources.KernelMemory = *m.Kernel
+		}
+		if m.KernelTCP != nil {
+			cgroup.Resources.KernelMemoryTCP = *m.KernelTCP
+		}
+		cgroup.Resources.MemorySwappiness = m.Swappiness
+	}
+	if c := r.CPU; c != nil {
+		if c.Shares != nil {
+			cgroup.Resources.CpuShares = *c.Shares
+		}
+		if c.Quota != nil {
+			cgroup.Resources.CpuQuota = *c.Quota
+		}
+		if c.Period != nil {
+			cgroup.Resources.CpuPeriod = *c.Period
+		}
+		if c.RealtimeRuntime != nil {
+			cgroup.Resources.CpuRtRuntime = *c.RealtimeRuntime
+		}
+		if c.RealtimePeriod != nil {
+			cgroup.Resources.CpuRtPeriod = *c.RealtimePeriod
+		}
+		cgroup.Resources.CpusetCpus = c.Cpus
+		cgroup.Resources.CpusetMems = c.Mems
+	}
+	if r.Pids != nil {
+		cgroup.Resources.PidsLimit = r.Pids.Limit
+	}
+	if b := r.BlockIO; b != nil {
+		if b.Weight != nil {
+			cgroup.Resources.BlkioWeight = *b.Weight
+		}
+		if b.LeafWeight != nil {
+			cgroup.Resources.BlkioLeafWeight = *b.LeafWeight
+		}
+	}
+	for _, l := range r.HugepageLimits {
+		cgroup.Resources.HugetlbLimit = append(cgroup.Resources.HugetlbLimit, &configs.HugepageLimit{
+			Pagesize: l.Pagesize,
+			Limit:    l.Limit,
+		})
+	}
+	return cgroup, nil
+}
+
+// convertIDMapping converts an OCI user or group ID mapping to its
+// libcontainer equivalent.
+func convertIDMapping(m oci.LinuxIDMapping) configs.IDMap {
+	return configs.IDMap{
+		ContainerID: int(m.ContainerID),
+		HostID:      int(m.HostID),
+		Size:        int(m.Size),
+	}
+}
+
+// convertCapabilities converts the OCI capabilities of a process to their
+// libcontainer equivalent.
+func convertCapabilities(c *oci.LinuxCapabilities) *configs.Capabilities {
+	if c == nil {
+		return nil
+	}
+	return &configs.Capabilities{
+		Bounding:    c.Bounding,
+		Effective:   c.Effective,
+		Inheritable: c.Inheritable,
+		Permitted:   c.Permitted,
+		Ambient:     c.Ambient,
+	}
+}
+
+// convertRlimits converts the OCI rlimits of a process to their libcontainer
+// equivalent.
+func convertRlimits(rlimits []oci.LinuxRlimit) ([]configs.Rlimit, error) {
+	var converted []configs.Rlimit
+	for _, rlimit := range rlimits {
+		t, ok := rlimitTypes[rlimit.Type]
+		if !ok {
+			return nil, errors.Errorf("invalid rlimit type %s", rlimit.Type)
+		}
+		converted = append(converted, configs.Rlimit{Type: t, Hard: rlimit.Hard, Soft: rlimit.Soft})
+	}
+	return converted, nil
+}
+
+// convertSeccomp converts an OCI seccomp profile to its libcontainer
+// equivalent. The profile is only enforced if the GCS is built with seccomp
+// support, otherwise the container fails to start.
+func convertSeccomp(s *oci.LinuxSeccomp) (*configs.Seccomp, error) {
+	defaultAction, err := seccomp.ConvertStringToAction(string(s.DefaultAction))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid seccomp default action")
+	}
+	converted := &configs.Seccomp{DefaultAction: defaultAction}
+	for _, arch := range s.Architectures {
+		a, err := seccomp.ConvertStringToArch(string(arch))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid seccomp architecture")
+		}
+		converted.Architectures = append(converted.Architectures, a)
+	}
+	for _, call := range s.Syscalls {
+		action, err := seccomp.ConvertStringToAction(string(call.Action))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid seccomp syscall action")
+		}
+		var args []*configs.Arg
+		for _, arg := range call.Args {
+			op, err := seccomp.ConvertStringToOperator(string(arg.Op))
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid seccomp syscall argument operator")
+			}
+			args = append(args, &configs.Arg{
+				Index:    arg.Index,
+				Value:    arg.Value,
+				ValueTwo: arg.ValueTwo,
+				Op:       op,
+			})
+		}
+		for _, name := range call.Names {
+			converted.Syscalls = append(converted.Syscalls, &configs.Syscall{
+				Name:   name,
+				Action: action,
+				Args:   args,
+			})
+		}
+	}
+	return converted, nil
+}
+
+// convertHooks converts the OCI hooks of a container to their libcontainer
+// equivalent.
+func convertHooks(hooks *oci.Hooks) *configs.Hooks {
+	if hooks == nil {
+		return nil
+	}
+	convert := func(hooks []oci.Hook) []configs.Hook {
+		var converted []configs.Hook
+		for _, h := range hooks {
+			command := configs.Command{
+				Path: h.Path,
+				Args: h.Args,
+				Env:  h.Env,
+			}
+			if h.Timeout != nil {
+				timeout := time.Duration(*h.Timeout) * time.Second
+				command.Timeout = &timeout
+			}
+			converted = append(converted, configs.NewCommandHook(command))
+		}
+		return converted
+	}
+	return &configs.Hooks{
+		Prestart:  convert(hooks.Prestart),
+		Poststart: convert(hooks.Poststart),
+		Poststop:  convert(hooks.Poststop),
+	}
+}
+
+// newProcess converts an OCI process to a libcontainer process, with stdio
+// left to the caller.
+func newProcess(p oci.Process) (*libcontainer.Process, error) {
+	rlimits, err := convertRlimits(p.Rlimits)
+	if err != nil {
+		return nil, err
+	}
+	process := &libcontainer.Process{
+		Args:            p.Args,
+		Env:             p.Env,
+		User:            fmt.Sprintf("%d:%d", p.User.UID, p.User.GID),
+		Cwd:             p.Cwd,
+		Capabilities:    convertCapabilities(p.Capabilities),
+		AppArmorProfile: p.ApparmorProfile,
+		Label:           p.SelinuxLabel,
+		NoNewPrivileges: &p.NoNewPrivileges,
+		Rlimits:         rlimits,
+	}
+	for _, gid := range p.User.AdditionalGids {
+		process.AdditionalGroups = append(process.AdditionalGroups, strconv.FormatUint(uint64(gid), 10))
+	}
+	return process, nil
+}
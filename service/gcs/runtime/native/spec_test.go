@@ -0,0 +1,123 @@
+package native
+
+import (
+	"syscall"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Spec", func() {
+	var spec *oci.Spec
+
+	BeforeEach(func() {
+		spec = &oci.Spec{
+			Version: "1.0.0",
+			Process: oci.Process{
+				Args:    []string{"sh"},
+				Rlimits: []oci.LinuxRlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 512}},
+			},
+			Root:     oci.Root{Path: "rootfs", Readonly: true},
+			Hostname: "host",
+			Mounts: []oci.Mount{
+				{Destination: "/proc", Type: "proc", Source: "proc"},
+				{Destination: "/data", Type: "none", Source: "data", Options: []string{"rbind", "ro", "rslave"}},
+			},
+			Linux: &oci.Linux{
+				Namespaces: []oci.LinuxNamespace{
+					{Type: oci.PIDNamespace},
+					{Type: oci.NetworkNamespace},
+					{Type: oci.MountNamespace, Path: "/proc/1/ns/mnt"},
+				},
+				Resources: &oci.LinuxResources{
+					Devices: []oci.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}},
+				},
+			},
+		}
+	})
+
+	Describe("converting a spec to a libcontainer config", func() {
+		var (
+			config *configs.Config
+			err    error
+		)
+		JustBeforeEach(func() {
+			config, err = specToConfig("abcdef", "/bundle", spec)
+		})
+		It("should not produce an error", func() {
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("should make the rootfs relative to the bundle", func() {
+			Expect(config.Rootfs).To(Equal("/bundle/rootfs"))
+			Expect(config.Readonlyfs).To(BeTrue())
+			Expect(config.NoPivotRoot).To(BeTrue())
+		})
+		It("should record the bundle path", func() {
+			Expect(bundlePathFromConfig(*config)).To(Equal("/bundle"))
+		})
+		It("should convert the namespaces", func() {
+			Expect(config.Namespaces).To(Equal(configs.Namespaces{
+				{Type: configs.NEWPID},
+				{Type: configs.NEWNET},
+				{Type: configs.NEWNS, Path: "/proc/1/ns/mnt"},
+			}))
+			Expect(config.Networks).To(HaveLen(1))
+			Expect(config.Networks[0].Type).To(Equal("loopback"))
+		})
+		It("should convert the mounts", func() {
+			Expect(config.Mounts).To(HaveLen(2))
+			Expect(config.Mounts[0].Device).To(Equal("proc"))
+			Expect(config.Mounts[1].Device).To(Equal("bind"))
+			Expect(config.Mounts[1].Source).To(Equal("/bundle/data"))
+			Expect(config.Mounts[1].Flags).To(Equal(syscall.MS_BIND | syscall.MS_REC | syscall.MS_RDONLY))
+			Expect(config.Mounts[1].PropagationFlags).To(Equal([]int{syscall.MS_SLAVE | syscall.MS_REC}))
+		})
+		It("should deny devices before allowing the default ones", func() {
+			devices := config.Cgroups.Resources.Devices
+			Expect(devices).To(HaveLen(len(configs.DefaultAllowedDevices) + 1))
+			Expect(devices[0].CgroupString()).To(Equal("a *:* rwm"))
+			Expect(devices[0].Allow).To(BeFalse())
+			Expect(devices[1].Allow).To(BeTrue())
+			Expect(config.Cgroups.Path).To(Equal("/abcdef"))
+		})
+		It("should convert the rlimits", func() {
+			Expect(config.Rlimits).To(Equal([]configs.Rlimit{{Type: syscall.RLIMIT_NOFILE, Hard: 1024, Soft: 512}}))
+		})
+		Context("the spec has an unsupported namespace", func() {
+			BeforeEach(func() {
+				spec.Linux.Namespaces = append(spec.Linux.Namespaces, oci.LinuxNamespace{Type: oci.CgroupNamespace})
+			})
+			It("should produce an error", func() {
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Context("the spec has an invalid rlimit", func() {
+			BeforeEach(func() {
+				spec.Process.Rlimits[0].Type = "RLIMIT_INVALID"
+			})
+			It("should produce an error", func() {
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Context("the spec has no Linux configuration", func() {
+			BeforeEach(func() {
+				spec.Linux = nil
+			})
+			It("should produce an error", func() {
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("parsing mount options", func() {
+		It("should split flags, propagation and data", func() {
+			flags, propagationFlags, data := parseMountOptions([]string{"nosuid", "ro", "rw", "shared", "mode=755", "size=1k"})
+			Expect(flags).To(Equal(syscall.MS_NOSUID))
+			Expect(propagationFlags).To(Equal([]int{syscall.MS_SHARED}))
+			Expect(data).To(Equal("mode=755,size=1k"))
+		})
+	})
+})
@@ -0,0 +1,155 @@
+package native
+
+import (
+	"os"
+
+	"github.com/opencontainers/runc/libcontainer"
+	"github.com/opencontainers/runc/libcontainer/utils"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+)
+
+// startProcess converts the given OCI process to a libcontainer process, sets
+// up its stdio and starts it with the given function. It then begins waiting
+// on the process in a separate go routine.
+// Processes without a terminal are given a pipe for each stream requested in
+// stdioOptions. Processes with a terminal have their streams share the
+// terminal master.
+func startProcess(ociProcess oci.Process, stdioOptions runtime.StdioOptions, start func(*libcontainer.Process) error) (*process, error) {
+	lp, err := newProcess(ociProcess)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ends of the pipes and socket given to the process are closed once it
+	// has started, whether or not it started successfully.
+	var childFiles []*os.File
+	defer func() {
+		for _, f := range childFiles {
+			f.Close()
+		}
+	}()
+
+	pipes := &runtime.StdioPipes{}
+	var consoleSocket *os.File
+	if ociProcess.Terminal {
+		var childSocket *os.File
+		consoleSocket, childSocket, err = newSocketPair("console")
+		if err != nil {
+			return nil, err
+		}
+		defer consoleSocket.Close()
+		childFiles = append(childFiles, childSocket)
+		lp.ConsoleSocket = childSocket
+	} else {
+		if stdioOptions.CreateIn {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed call to os.Pipe for stdin")
+			}
+			childFiles = append(childFiles, r)
+			lp.Stdin, pipes.In = r, w
+		}
+		if stdioOptions.CreateOut {
+			r, w, err := os.Pipe()
+			if err != nil {
+				closePipes(pipes)
+				return nil, errors.Wrap(err, "failed call to os.Pipe for stdout")
+			}
+			childFiles = append(childFiles, w)
+			lp.Stdout, pipes.Out = w, r
+		}
+		if stdioOptions.CreateErr {
+			r, w, err := os.Pipe()
+			if err != nil {
+				closePipes(pipes)
+				return nil, errors.Wrap(err, "failed call to os.Pipe for stderr")
+			}
+			childFiles = append(childFiles, w)
+			lp.Stderr, pipes.Err = w, r
+		}
+	}
+
+	if err := start(lp); err != nil {
+		closePipes(pipes)
+		return nil, err
+	}
+	pid, err := lp.Pid()
+	if err != nil {
+		closePipes(pipes)
+		return nil, errors.Wrap(err, "failed to get the pid of the started process")
+	}
+	p := &process{
+		handle:  lp,
+		pid:     pid,
+		command: ociProcess.Args,
+		pipes:   pipes,
+		exited:  make(chan struct{}),
+	}
+	go p.wait()
+
+	if consoleSocket != nil {
+		if err := p.setupConsole(consoleSocket, stdioOptions); err != nil {
+			lp.Signal(unix.SIGKILL)
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// setupConsole receives the master of the process's terminal from the given
+// socket, and uses it for the stdio streams requested in stdioOptions.
+func (p *process) setupConsole(consoleSocket *os.File, stdioOptions runtime.StdioOptions) error {
+	console, err := utils.RecvFd(consoleSocket)
+	if err != nil {
+		return errors.Wrap(err, "failed to receive the terminal master")
+	}
+	p.console = console
+	if stdioOptions.CreateIn {
+		if p.pipes.In, err = dupFile(console); err != nil {
+			return err
+		}
+	}
+	if stdioOptions.CreateOut {
+		if p.pipes.Out, err = dupFile(console); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closePipes closes the non-nil stdio pipes in the given set.
+func closePipes(pipes *runtime.StdioPipes) {
+	if pipes.In != nil {
+		pipes.In.Close()
+	}
+	if pipes.Out != nil {
+		pipes.Out.Close()
+	}
+	if pipes.Err != nil {
+		pipes.Err.Close()
+	}
+}
+
+// newSocketPair returns both ends of a new unix socket pair with the given
+// name.
+func newSocketPair(name string) (parent *os.File, child *os.File, err error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to create %s socket pair", name)
+	}
+	return os.NewFile(uintptr(fds[1]), name+"-p"), os.NewFile(uintptr(fds[0]), name+"-c"), nil
+}
+
+// dupFile returns a duplicate of the given file which can be closed
+// independently of it.
+func dupFile(f *os.File) (*os.File, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_FCNTL, f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if errno != 0 {
+		return nil, errors.Wrapf(errno, "failed to duplicate file %s", f.Name())
+	}
+	return os.NewFile(fd, f.Name()), nil
+}
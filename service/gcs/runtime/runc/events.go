@@ -0,0 +1,143 @@
+package runc
+
+import (
+	"encoding/json"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+)
+
+// noStatsInterval is the interval passed to runc events when no statistics
+// are wanted, since it requires a positive interval.
+const noStatsInterval = 365 * 24 * time.Hour
+
+// runcEvent is an event written by runc events, in runC's JSON format. Only
+// the statistics the GCS reports are decoded.
+type runcEvent struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Data *struct {
+		CPU struct {
+			Usage struct {
+				Total uint64 `json:"total"`
+			} `json:"usage"`
+		} `json:"cpu"`
+		Memory struct {
+			Usage struct {
+				Usage uint64 `json:"usage"`
+				Max   uint64 `json:"max"`
+				Limit uint64 `json:"limit"`
+			} `json:"usage"`
+		} `json:"memory"`
+		Pids struct {
+			Current uint64 `json:"current"`
+		} `json:"pids"`
+	} `json:"data"`
+}
+
+// Events runs runc events for the given container, and sends the events it
+// writes over the returned channel. No statistics are sent if statsInterval
+// isn't positive. The runtime keeps running until the container is deleted, at
+// which point the channel is closed.
+func (r *runcRuntime) Events(id string, statsInterval time.Duration) (<-chan runtime.Event, error) {
+	if !r.profile.Events {
+		return nil, errors.Errorf("%s doesn't support events", r.profile.Name)
+	}
+	logPath, err := r.newInvocationLog("events")
+	if err != nil {
+		return nil, err
+	}
+	if statsInterval <= 0 {
+		statsInterval = noStatsInterval
+	}
+	args := append(r.globalArgs(logPath), "events", "--interval", statsInterval.String(), id)
+	cmd := exec.Command(r.profile.Path, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		r.finishInvocationLog(logPath)
+		return nil, errors.Wrapf(err, "failed to get the stdout of %s events", r.profile.Name)
+	}
+	if err := cmd.Start(); err != nil {
+		r.finishInvocationLog(logPath)
+		return nil, errors.Wrapf(err, "failed to start %s events", r.profile.Name)
+	}
+
+	r.eventsMutex.Lock()
+	if r.events == nil {
+		r.events = make(map[string]*exec.Cmd)
+	}
+	if previous, ok := r.events[id]; ok {
+		previous.Process.Kill()
+	}
+	r.events[id] = cmd
+	r.eventsMutex.Unlock()
+
+	events := make(chan runtime.Event)
+	go func() {
+		defer close(events)
+		decodeEvents(stdout, events)
+		// Once the runtime's output has ended there are no more events to
+		// read, so make sure it doesn't linger.
+		cmd.Process.Kill()
+		cmd.Wait()
+		r.eventsMutex.Lock()
+		if r.events[id] == cmd {
+			delete(r.events, id)
+		}
+		r.eventsMutex.Unlock()
+		for _, message := range r.finishInvocationLog(logPath) {
+			logrus.Errorf("%s events for container %s: %s", r.profile.Name, id, message)
+		}
+	}()
+	return events, nil
+}
+
+// decodeEvents decodes the events read from the given reader until it fails,
+// and sends those the GCS reports over the given channel.
+func decodeEvents(reader io.Reader, events chan<- runtime.Event) {
+	decoder := json.NewDecoder(reader)
+	for {
+		var e runcEvent
+		if err := decoder.Decode(&e); err != nil {
+			if err != io.EOF {
+				logrus.Errorf("failed to decode runtime event: %v", err)
+			}
+			return
+		}
+		switch e.Type {
+		case "oom":
+			events <- runtime.Event{Type: runtime.EventOOM, ID: e.ID}
+		case "stats":
+			if e.Data == nil {
+				continue
+			}
+			events <- runtime.Event{
+				Type: runtime.EventStats,
+				ID:   e.ID,
+				Stats: &runtime.ContainerStats{
+					CPUUsage:       e.Data.CPU.Usage.Total,
+					MemoryUsage:    e.Data.Memory.Usage.Usage,
+					MemoryMaxUsage: e.Data.Memory.Usage.Max,
+					MemoryLimit:    e.Data.Memory.Usage.Limit,
+					Pids:           e.Data.Pids.Current,
+				},
+			}
+		}
+	}
+}
+
+// stopEvents stops the runtime reading the events of the given container, if
+// it is running.
+func (r *runcRuntime) stopEvents(id string) {
+	r.eventsMutex.Lock()
+	defer r.eventsMutex.Unlock()
+	if cmd, ok := r.events[id]; ok {
+		cmd.Process.Kill()
+		delete(r.events, id)
+	}
+}
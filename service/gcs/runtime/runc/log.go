@@ -0,0 +1,141 @@
+package runc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	// invocationLogPrefix prefixes the names of the log files written by each
+	// invocation of the runtime, which are kept in containerFilesDir until the
+	// invocation has finished.
+	invocationLogPrefix = "invocation-"
+	// maxLogErrors is the maximum number of errors logged by an invocation of
+	// the runtime which are attached to the error returned for it.
+	maxLogErrors = 3
+	// maxSharedLogSize is the size past which the shared log is rotated.
+	maxSharedLogSize = 4 * 1024 * 1024
+)
+
+// logEntry is an entry of a runtime log in the JSON format.
+type logEntry struct {
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+// newInvocationLog creates the log file for an invocation of the runtime with
+// the given command, and returns its path.
+func (r *runcRuntime) newInvocationLog(command string) (string, error) {
+	f, err := ioutil.TempFile(containerFilesDir, invocationLogPrefix+command+"-")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create the log file for %s %s", r.profile.Name, command)
+	}
+	defer f.Close()
+	return f.Name(), nil
+}
+
+// logArgs returns the flags having the runtime write its log to the given
+// file.
+func (r *runcRuntime) logArgs(logPath string) []string {
+	if !r.profile.Log {
+		return nil
+	}
+	args := []string{"--log", logPath}
+	if r.profile.LogJSON {
+		args = append(args, "--log-format", "json")
+	}
+	return args
+}
+
+// finishInvocationLog appends the log of an invocation of the runtime to the
+// shared log, removes it, and returns the last errors it contains.
+func (r *runcRuntime) finishInvocationLog(logPath string) []string {
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		logrus.Errorf("failed to read %s log %s: %v", r.profile.Name, logPath, err)
+		return nil
+	}
+	if err := r.appendSharedLog(data); err != nil {
+		logrus.Errorf("%+v", err)
+	}
+	if err := os.Remove(logPath); err != nil {
+		logrus.Errorf("failed to remove %s log %s: %v", r.profile.Name, logPath, err)
+	}
+	if !r.profile.LogJSON {
+		return nil
+	}
+	return parseLogErrors(data)
+}
+
+// parseLogErrors returns the messages of the last maxLogErrors entries of at
+// least error level in the given JSON log. Lines which aren't JSON entries are
+// ignored.
+func parseLogErrors(data []byte) []string {
+	var messages []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var entry logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		switch entry.Level {
+		case "error", "fatal", "panic":
+			messages = append(messages, entry.Msg)
+		}
+	}
+	if len(messages) > maxLogErrors {
+		messages = messages[len(messages)-maxLogErrors:]
+	}
+	return messages
+}
+
+// appendSharedLog appends the given data to the shared log.
+func (r *runcRuntime) appendSharedLog(data []byte) error {
+	r.logMutex.Lock()
+	defer r.logMutex.Unlock()
+	return appendRotatedLog(r.getLogPath(), data)
+}
+
+// appendRotatedLog appends the given data to the log at logPath, first moving
+// the log to a backup file, replacing the previous one, if it has grown past
+// maxSharedLogSize.
+func appendRotatedLog(logPath string, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if info, err := os.Stat(logPath); err == nil && info.Size() >= maxSharedLogSize {
+		if err := os.Rename(logPath, logPath+".1"); err != nil {
+			return errors.Wrapf(err, "failed to rotate the shared log %s", logPath)
+		}
+	}
+	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open the shared log %s", logPath)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return errors.Wrapf(err, "failed to append to the shared log %s", logPath)
+	}
+	return nil
+}
+
+// commandError returns the error for a failed invocation of the runtime with
+// the given command, including the errors it logged and its output.
+func (r *runcRuntime) commandError(err error, command string, logErrors []string, out []byte) error {
+	message := fmt.Sprintf("%s %s failed", r.profile.Name, command)
+	if len(logErrors) > 0 {
+		message += ": " + strings.Join(logErrors, "; ")
+	}
+	if out = bytes.TrimSpace(out); len(out) > 0 {
+		message += fmt.Sprintf(" (output: %s)", out)
+	}
+	return errors.Wrap(err, message)
+}
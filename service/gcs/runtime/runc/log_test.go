@@ -0,0 +1,139 @@
+package runc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Runtime logs", func() {
+	Describe("parsing the errors of a log", func() {
+		cases := []struct {
+			description string
+			log         string
+			errors      []string
+		}{
+			{
+				description: "the log is empty",
+				log:         "",
+				errors:      nil,
+			},
+			{
+				description: "the log has a JSON error entry",
+				log:         `{"level":"error","msg":"container_linux.go:348: starting container process caused \"exec: \\\"foo\\\": executable file not found in $PATH\"","time":"2018-01-01T00:00:00Z"}` + "\n",
+				errors:      []string{`container_linux.go:348: starting container process caused "exec: \"foo\": executable file not found in $PATH"`},
+			},
+			{
+				description: "the log has fatal and panic entries",
+				log:         `{"level":"fatal","msg":"a"}` + "\n" + `{"level":"panic","msg":"b"}` + "\n",
+				errors:      []string{"a", "b"},
+			},
+			{
+				description: "the log only has entries below error level",
+				log:         `{"level":"debug","msg":"a"}` + "\n" + `{"level":"info","msg":"b"}` + "\n" + `{"level":"warning","msg":"c"}` + "\n",
+				errors:      nil,
+			},
+			{
+				description: "the log mixes error entries with other levels",
+				log:         `{"level":"warning","msg":"a"}` + "\n" + `{"level":"error","msg":"b"}` + "\n" + `{"level":"info","msg":"c"}` + "\n",
+				errors:      []string{"b"},
+			},
+			{
+				description: "the log is in the plain text format",
+				log:         "time=\"2018-01-01T00:00:00Z\" level=error msg=\"a\"\nlevel=fatal msg=\"b\"\n",
+				errors:      nil,
+			},
+			{
+				description: "the log mixes plain text lines with JSON entries",
+				log:         "panic: runtime error\n" + `{"level":"error","msg":"a"}` + "\n\ngoroutine 1 [running]:\n",
+				errors:      []string{"a"},
+			},
+			{
+				description: "the log has exactly the maximum number of errors",
+				log:         `{"level":"error","msg":"a"}` + "\n" + `{"level":"error","msg":"b"}` + "\n" + `{"level":"error","msg":"c"}` + "\n",
+				errors:      []string{"a", "b", "c"},
+			},
+			{
+				description: "the log has more than the maximum number of errors",
+				log:         `{"level":"error","msg":"a"}` + "\n" + `{"level":"error","msg":"b"}` + "\n" + `{"level":"info","msg":"c"}` + "\n" + `{"level":"error","msg":"d"}` + "\n" + `{"level":"fatal","msg":"e"}` + "\n",
+				errors:      []string{"b", "d", "e"},
+			},
+		}
+		for _, c := range cases {
+			c := c
+			It("should return the last errors when "+c.description, func() {
+				Expect(parseLogErrors([]byte(c.log))).To(Equal(c.errors))
+			})
+		}
+	})
+
+	Describe("appending to a rotated log", func() {
+		var (
+			dir     string
+			logPath string
+			err     error
+		)
+		BeforeEach(func() {
+			dir, err = ioutil.TempDir("", "runclog")
+			Expect(err).NotTo(HaveOccurred())
+			logPath = filepath.Join(dir, "log.log")
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		cases := []struct {
+			description string
+			// size is the size of the log before appending, or -1 if the log
+			// doesn't exist.
+			size    int
+			rotated bool
+		}{
+			{"the log doesn't exist", -1, false},
+			{"the log is empty", 0, false},
+			{"the log is just under the maximum size", maxSharedLogSize - 1, false},
+			{"the log is at the maximum size", maxSharedLogSize, true},
+			{"the log is past the maximum size", maxSharedLogSize + 1, true},
+		}
+		for _, c := range cases {
+			c := c
+			Context(c.description, func() {
+				var old []byte
+				BeforeEach(func() {
+					if c.size >= 0 {
+						old = bytes.Repeat([]byte("a"), c.size)
+						Expect(ioutil.WriteFile(logPath, old, 0600)).To(Succeed())
+					}
+					Expect(ioutil.WriteFile(logPath+".1", []byte("backup"), 0600)).To(Succeed())
+					err = appendRotatedLog(logPath, []byte("new\n"))
+				})
+				It("should not produce an error", func() {
+					Expect(err).NotTo(HaveOccurred())
+				})
+				if c.rotated {
+					It("should replace the backup with the log and start a new one", func() {
+						Expect(ioutil.ReadFile(logPath + ".1")).To(Equal(old))
+						Expect(ioutil.ReadFile(logPath)).To(Equal([]byte("new\n")))
+					})
+				} else {
+					It("should append to the log and keep the backup", func() {
+						Expect(ioutil.ReadFile(logPath + ".1")).To(Equal([]byte("backup")))
+						Expect(ioutil.ReadFile(logPath)).To(Equal(append(old, "new\n"...)))
+					})
+				}
+			})
+		}
+
+		Context("the data is empty", func() {
+			It("should not create the log", func() {
+				Expect(appendRotatedLog(logPath, nil)).To(Succeed())
+				_, err := os.Stat(logPath)
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+	})
+})
@@ -0,0 +1,86 @@
+package runc
+
+// Profile describes an OCI runtime binary driven through a runC-compatible
+// command line, along with the parts of runC's command line it supports.
+// Operations which depend on an unsupported feature either fall back to the
+// commands required of every OCI runtime, or fail.
+type Profile struct {
+	// Name is the name of the runtime, used in errors.
+	Name string
+	// Path is the path to the runtime binary.
+	Path string
+	// GlobalArgs are passed to the runtime before the command, on every
+	// invocation.
+	GlobalArgs []string
+	// Log is true if the runtime supports the global --log flag.
+	Log bool
+	// LogJSON is true if the runtime supports the global --log-format json
+	// flag, writing its log as logrus JSON entries.
+	LogJSON bool
+	// NoPivot is true if the runtime supports creating containers without
+	// pivot_root through --no-pivot, which is needed when the utility VM's
+	// root filesystem is an initramfs.
+	NoPivot bool
+	// ConsoleSocket is true if the runtime supports --console-socket, and so
+	// processes with a terminal.
+	ConsoleSocket bool
+	// ListJSON is true if the runtime supports list -f json. Otherwise,
+	// containers are listed by querying the state of each container the
+	// runtime was asked to create.
+	ListJSON bool
+	// PsJSON is true if the runtime supports ps -f json listing the host pids
+	// of the container's processes. Otherwise, the pids are read from the
+	// container's cgroup.
+	PsJSON bool
+	// Pause is true if the runtime supports pause and resume.
+	Pause bool
+	// Checkpoint is true if the runtime supports checkpoint and restore
+	// through CRIU, with runC's flags.
+	Checkpoint bool
+	// Events is true if the runtime supports events --interval, writing the
+	// container's OOM events and statistics in runC's JSON format.
+	Events bool
+}
+
+// Profiles are the profiles of the OCI runtimes known to the GCS, by name.
+var Profiles = map[string]Profile{
+	"runc": {
+		Name:          "runc",
+		Path:          "/sbin/runc",
+		Log:           true,
+		LogJSON:       true,
+		NoPivot:       true,
+		ConsoleSocket: true,
+		ListJSON:      true,
+		PsJSON:        true,
+		Pause:         true,
+		Checkpoint:    true,
+		Events:        true,
+	},
+	// crun has no events command, so its containers report neither OOM kills
+	// nor statistics.
+	"crun": {
+		Name:          "crun",
+		Path:          "/usr/bin/crun",
+		Log:           true,
+		LogJSON:       true,
+		NoPivot:       true,
+		ConsoleSocket: true,
+		ListJSON:      true,
+		PsJSON:        true,
+		Pause:         true,
+		Checkpoint:    true,
+	},
+	// runsc runs each container in a gVisor sandbox. It pivots into the
+	// container's root filesystem itself and reports sandbox pids from ps, and
+	// its checkpoints aren't CRIU images.
+	"runsc": {
+		Name:          "runsc",
+		Path:          "/usr/bin/runsc",
+		Log:           true,
+		LogJSON:       true,
+		ConsoleSocket: true,
+		Pause:         true,
+		Events:        true,
+	},
+}
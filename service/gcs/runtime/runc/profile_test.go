@@ -0,0 +1,152 @@
+package runc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+)
+
+var _ = Describe("Runtime profiles", func() {
+	Describe("finding the cgroup.procs file of a process", func() {
+		cases := []struct {
+			description string
+			cgroupFile  string
+			procsPath   string
+		}{
+			{
+				description: "the v1 pids controller is mounted",
+				cgroupFile:  "11:memory:/ctr\n4:pids:/ctr\n1:name=systemd:/ctr\n",
+				procsPath:   "/sys/fs/cgroup/pids/ctr/cgroup.procs",
+			},
+			{
+				description: "the v1 pids controller shares its hierarchy",
+				cgroupFile:  "3:cpu,pids:/ctr\n",
+				procsPath:   "/sys/fs/cgroup/pids/ctr/cgroup.procs",
+			},
+			{
+				description: "only the unified hierarchy is mounted",
+				cgroupFile:  "0::/ctr\n",
+				procsPath:   "/sys/fs/cgroup/ctr/cgroup.procs",
+			},
+			{
+				description: "both the v1 pids controller and the unified hierarchy are mounted",
+				cgroupFile:  "0::/other\n4:pids:/ctr\n",
+				procsPath:   "/sys/fs/cgroup/pids/ctr/cgroup.procs",
+			},
+			{
+				description: "the v1 hierarchies mounted don't include pids",
+				cgroupFile:  "11:memory:/ctr\n1:name=systemd:/ctr\n",
+				procsPath:   "",
+			},
+			{
+				description: "the file has malformed lines",
+				cgroupFile:  "garbage\n\n0::/ctr\n",
+				procsPath:   "/sys/fs/cgroup/ctr/cgroup.procs",
+			},
+		}
+		for _, c := range cases {
+			c := c
+			It("should find the right file when "+c.description, func() {
+				procsPath, err := cgroupProcsPath(strings.NewReader(c.cgroupFile))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(procsPath).To(Equal(c.procsPath))
+			})
+		}
+	})
+
+	Describe("parsing a cgroup.procs file", func() {
+		It("should return each pid", func() {
+			Expect(parsePids([]byte("1\n25\n300\n"))).To(Equal([]int{1, 25, 300}))
+		})
+		It("should return no pids for an empty file", func() {
+			Expect(parsePids(nil)).To(BeEmpty())
+		})
+		It("should produce an error for a line which isn't a pid", func() {
+			_, err := parsePids([]byte("1\nabc\n"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("listing container states from their state directories", func() {
+		var (
+			dir string
+			err error
+		)
+		BeforeEach(func() {
+			dir, err = ioutil.TempDir("", "runcstates")
+			Expect(err).NotTo(HaveOccurred())
+			for _, id := range []string{"a", "gone", "b"} {
+				Expect(os.Mkdir(filepath.Join(dir, id), 0700)).To(Succeed())
+			}
+			Expect(ioutil.WriteFile(filepath.Join(dir, invocationLogPrefix+"state-1"), nil, 0600)).To(Succeed())
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+		It("should return the states of the containers the runtime knows about", func() {
+			var queried []string
+			states, err := listContainerStatesInDir(dir, func(id string) (*runtime.ContainerState, error) {
+				queried = append(queried, id)
+				if id == "gone" {
+					return nil, errors.New("container does not exist")
+				}
+				return &runtime.ContainerState{ID: id}, nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(queried).To(ConsistOf("a", "b", "gone"))
+			Expect(states).To(ConsistOf(runtime.ContainerState{ID: "a"}, runtime.ContainerState{ID: "b"}))
+		})
+		It("should produce an error if the directory can't be read", func() {
+			_, err := listContainerStatesInDir(filepath.Join(dir, "missing"), nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("creating containers without pivot_root", func() {
+		It("should pass --no-pivot to runtimes which support it", func() {
+			r := &runcRuntime{profile: Profiles["runc"]}
+			Expect(r.noPivotArgs()).To(Equal([]string{"--no-pivot"}))
+		})
+		It("should pass nothing to runtimes which don't", func() {
+			r := &runcRuntime{profile: Profiles["runsc"]}
+			Expect(r.noPivotArgs()).To(BeEmpty())
+		})
+	})
+
+	Describe("using features the runtime doesn't support", func() {
+		var (
+			r *runcRuntime
+		)
+		BeforeEach(func() {
+			r = &runcRuntime{profile: Profile{Name: "minimal", Path: "/nonexistent/minimal"}}
+		})
+		It("should reject pausing a container", func() {
+			Expect(r.PauseContainer("a")).To(MatchError(ContainSubstring("minimal doesn't support pause")))
+		})
+		It("should reject resuming a container", func() {
+			Expect(r.ResumeContainer("a")).To(MatchError(ContainSubstring("minimal doesn't support resume")))
+		})
+		It("should reject checkpointing a container", func() {
+			Expect(r.CheckpointContainer("a", "/nonexistent/image", runtime.CheckpointOptions{})).To(MatchError(ContainSubstring("minimal doesn't support checkpointing")))
+		})
+		It("should reject restoring a container", func() {
+			_, err := r.RestoreContainer("a", "/nonexistent/bundle", "/nonexistent/image", runtime.StdioOptions{})
+			Expect(err).To(MatchError(ContainSubstring("minimal doesn't support restoring checkpoints")))
+		})
+		It("should reject processes with a terminal", func() {
+			Expect(r.checkTerminalSupported(true)).To(MatchError(ContainSubstring("minimal doesn't support processes with a terminal")))
+			Expect(r.checkTerminalSupported(false)).To(Succeed())
+		})
+		It("should accept processes with a terminal once the console socket is supported", func() {
+			r.profile.ConsoleSocket = true
+			Expect(r.checkTerminalSupported(true)).To(Succeed())
+		})
+	})
+})
@@ -1,5 +1,6 @@
 // Package runc defines an implementation of the Runtime interface which uses
-// runC as the container runtime.
+// runC, or another OCI runtime with a runC-compatible command line such as crun
+// or runsc, as the container runtime.
 package runc
 
 import (
@@ -10,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	containerdsys "github.com/docker/containerd/sys"
@@ -22,19 +24,33 @@ import (
 )
 
 const (
-	runcPath          = "/sbin/runc"
 	containerFilesDir = "/var/lib/gcsrunc"
 	initPidFilename   = "initpid"
 )
 
-// runcRuntime is an implementation of the Runtime interface which uses runC as
-// the container runtime.
+// runcRuntime is an implementation of the Runtime interface which drives an OCI
+// runtime binary through its command line.
 type runcRuntime struct {
+	profile Profile
+
+	// logMutex serializes appending the logs of invocations to the shared
+	// log.
+	logMutex sync.Mutex
+
+	// events holds the running invocations of runc events, by container ID.
+	events      map[string]*exec.Cmd
+	eventsMutex sync.Mutex
 }
 
-// NewRuntime instantiates a new runcRuntime struct.
+// NewRuntime instantiates a new runcRuntime struct using runC.
 func NewRuntime() (*runcRuntime, error) {
-	rtime := &runcRuntime{}
+	return NewOCIRuntime(Profiles["runc"])
+}
+
+// NewOCIRuntime instantiates a new runcRuntime struct using the OCI runtime
+// described by the given profile.
+func NewOCIRuntime(profile Profile) (*runcRuntime, error) {
+	rtime := &runcRuntime{profile: profile}
 	if err := rtime.initialize(); err != nil {
 		return nil, err
 	}
@@ -70,12 +86,9 @@ func (r *runcRuntime) CreateContainer(id string, bundlePath string, stdioOptions
 // StartContainer unblocks the container's init process created by the call to
 // CreateContainer.
 func (r *runcRuntime) StartContainer(id string) error {
-	logPath := r.getLogPath()
-	cmd := exec.Command(runcPath, "--log", logPath, "start", id)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
+	if _, err := r.runCommand("start", id); err != nil {
 		r.cleanupContainer(id)
-		return errors.Wrapf(err, "runc start failed with: %s", out)
+		return err
 	}
 	return nil
 }
@@ -92,11 +105,8 @@ func (r *runcRuntime) ExecProcess(id string, process oci.Process, stdioOptions r
 
 // KillContainer sends the specified signal to the container's init process.
 func (r *runcRuntime) KillContainer(id string, signal oslayer.Signal) error {
-	logPath := r.getLogPath()
-	cmd := exec.Command(runcPath, "--log", logPath, "kill", id, strconv.Itoa(int(signal)))
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "runc kill failed with: %s", out)
+	if _, err := r.runCommand("kill", id, strconv.Itoa(int(signal))); err != nil {
+		return err
 	}
 	return nil
 }
@@ -104,11 +114,9 @@ func (r *runcRuntime) KillContainer(id string, signal oslayer.Signal) error {
 // DeleteContainer deletes any state created for the container by either this
 // wrapper or runC itself.
 func (r *runcRuntime) DeleteContainer(id string) error {
-	logPath := r.getLogPath()
-	cmd := exec.Command(runcPath, "--log", logPath, "delete", id)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "runc delete failed with: %s", out)
+	r.stopEvents(id)
+	if _, err := r.runCommand("delete", id); err != nil {
+		return err
 	}
 	if err := r.cleanupContainer(id); err != nil {
 		return err
@@ -127,33 +135,31 @@ func (r *runcRuntime) DeleteProcess(id string, pid int) error {
 
 // PauseContainer suspends all processes running in the container.
 func (r *runcRuntime) PauseContainer(id string) error {
-	logPath := r.getLogPath()
-	cmd := exec.Command(runcPath, "--log", logPath, "pause", id)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "runc pause failed with: %s", out)
+	if !r.profile.Pause {
+		return errors.Errorf("%s doesn't support pause", r.profile.Name)
+	}
+	if _, err := r.runCommand("pause", id); err != nil {
+		return err
 	}
 	return nil
 }
 
 // ResumeContainer unsuspends processes running in the container.
 func (r *runcRuntime) ResumeContainer(id string) error {
-	logPath := r.getLogPath()
-	cmd := exec.Command(runcPath, "--log", logPath, "resume", id)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "runc resume failed with: %s", out)
+	if !r.profile.Pause {
+		return errors.Errorf("%s doesn't support resume", r.profile.Name)
+	}
+	if _, err := r.runCommand("resume", id); err != nil {
+		return err
 	}
 	return nil
 }
 
 // GetContainerState returns information about the given container.
 func (r *runcRuntime) GetContainerState(id string) (*runtime.ContainerState, error) {
-	logPath := r.getLogPath()
-	cmd := exec.Command(runcPath, "--log", logPath, "state", id)
-	out, err := cmd.CombinedOutput()
+	out, err := r.runCommand("state", id)
 	if err != nil {
-		return nil, errors.Wrapf(err, "runc state failed with: %s", out)
+		return nil, err
 	}
 	var state runtime.ContainerState
 	if err := json.Unmarshal(out, &state); err != nil {
@@ -184,11 +190,12 @@ func (r *runcRuntime) ContainerExists(id string) (bool, error) {
 // ListContainerStates returns ContainerState structs for all existing
 // containers, whether they're running or not.
 func (r *runcRuntime) ListContainerStates() ([]runtime.ContainerState, error) {
-	logPath := r.getLogPath()
-	cmd := exec.Command(runcPath, "--log", logPath, "list", "-f", "json")
-	out, err := cmd.CombinedOutput()
+	if !r.profile.ListJSON {
+		return r.listContainerStatesFromFiles()
+	}
+	out, err := r.runCommand("list", "-f", "json")
 	if err != nil {
-		return nil, errors.Wrapf(err, "runc list failed with: %s", out)
+		return nil, err
 	}
 	var states []runtime.ContainerState
 	if err := json.Unmarshal(out, &states); err != nil {
@@ -290,14 +297,15 @@ func (r *runcRuntime) GetAllContainerProcesses(id string) ([]runtime.ContainerPr
 	return r.pidMapToProcessStates(pidMap), nil
 }
 
-// getRunningPids gets the pids of all processes which runC recognizes as
-// running.
+// getRunningPids gets the pids of all processes which the runtime recognizes
+// as running.
 func (r *runcRuntime) getRunningPids(id string) ([]int, error) {
-	logPath := r.getLogPath()
-	cmd := exec.Command(runcPath, "--log", logPath, "ps", "-f", "json", id)
-	out, err := cmd.CombinedOutput()
+	if !r.profile.PsJSON {
+		return r.getCgroupPids(id)
+	}
+	out, err := r.runCommand("ps", "-f", "json", id)
 	if err != nil {
-		return nil, errors.Wrapf(err, "runc ps failed with: %s", out)
+		return nil, err
 	}
 	var pids []int
 	if err := json.Unmarshal(out, &pids); err != nil {
@@ -333,6 +341,64 @@ func (r *runcRuntime) pidMapToProcessStates(pidMap map[int]*runtime.ContainerPro
 	return processStates
 }
 
+// CheckpointContainer saves the state of the container's processes as a CRIU
+// image in the given directory, which is created if it doesn't exist. Unless
+// options.LeaveRunning is set, the container is stopped once it has been
+// checkpointed.
+func (r *runcRuntime) CheckpointContainer(id string, imagePath string, options runtime.CheckpointOptions) error {
+	if !r.profile.Checkpoint {
+		return errors.Errorf("%s doesn't support checkpointing", r.profile.Name)
+	}
+	if err := os.MkdirAll(imagePath, 0700); err != nil {
+		return errors.Wrapf(err, "failed making checkpoint image directory %s", imagePath)
+	}
+	args := []string{"checkpoint", "--image-path", imagePath}
+	args = append(args, checkpointArgs(options)...)
+	args = append(args, id)
+	if _, err := r.runCommand(args...); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkpointArgs returns the runc checkpoint flags for the given options.
+func checkpointArgs(options runtime.CheckpointOptions) []string {
+	var args []string
+	if options.LeaveRunning {
+		args = append(args, "--leave-running")
+	}
+	if options.TCPEstablished {
+		args = append(args, "--tcp-established")
+	}
+	if options.ExternalUnixSockets {
+		args = append(args, "--ext-unix-sk")
+	}
+	if options.ShellJob {
+		args = append(args, "--shell-job")
+	}
+	if options.FileLocks {
+		args = append(args, "--file-locks")
+	}
+	return args
+}
+
+// RestoreContainer recreates the container with the given ID and bundlePath
+// from the CRIU image in the given directory, and returns the pid of its init
+// process. The container is running once it has been restored, so it mustn't
+// be started with StartContainer. Its stdio is set up as it is for
+// CreateContainer.
+func (r *runcRuntime) RestoreContainer(id string, bundlePath string, imagePath string, stdioOptions runtime.StdioOptions) (pid int, err error) {
+	if !r.profile.Checkpoint {
+		return -1, errors.Errorf("%s doesn't support restoring checkpoints", r.profile.Name)
+	}
+	args := []string{"restore", "--detach", "--image-path", imagePath, "-b", bundlePath}
+	pid, err = r.runInitCommand(id, bundlePath, stdioOptions, append(args, r.noPivotArgs()...)...)
+	if err != nil {
+		return -1, err
+	}
+	return pid, nil
+}
+
 // WaitOnProcess waits for the process to exit, and returns its
 // oslayer.ProcessExitState containing exit information.
 // TODO: We might want to give more options for this, such as specifying
@@ -378,6 +444,22 @@ func (r *runcRuntime) WaitOnContainer(id string) (oslayer.ProcessExitState, erro
 
 // runCreateCommand sets up the arguments for calling runc create.
 func (r *runcRuntime) runCreateCommand(id string, bundlePath string, stdioOptions runtime.StdioOptions) (pid int, err error) {
+	args := []string{"create", "-b", bundlePath}
+	return r.runInitCommand(id, bundlePath, stdioOptions, append(args, r.noPivotArgs()...)...)
+}
+
+// noPivotArgs returns the flags creating a container without pivot_root, if
+// the runtime supports them.
+func (r *runcRuntime) noPivotArgs() []string {
+	if r.profile.NoPivot {
+		return []string{"--no-pivot"}
+	}
+	return nil
+}
+
+// runInitCommand calls runc with the given arguments to create the container's
+// init process, either with runc create or runc restore, and records its pid.
+func (r *runcRuntime) runInitCommand(id string, bundlePath string, stdioOptions runtime.StdioOptions, args ...string) (pid int, err error) {
 	if err := r.makeContainerDir(id); err != nil {
 		return -1, err
 	}
@@ -391,7 +473,6 @@ func (r *runcRuntime) runCreateCommand(id string, bundlePath string, stdioOption
 	if err != nil {
 		return -1, err
 	}
-	args := []string{"create", "-b", bundlePath, "--no-pivot"}
 	pid, err = r.startProcess(id, tempProcessDir, hasTerminal, stdioOptions, args...)
 	if err != nil {
 		return -1, err
@@ -445,18 +526,33 @@ func (r *runcRuntime) runExecCommand(id string, process oci.Process, stdioOption
 	return pid, nil
 }
 
+// checkTerminalSupported returns an error if a process is to have a terminal
+// but the runtime can't hand its console to the GCS.
+func (r *runcRuntime) checkTerminalSupported(hasTerminal bool) error {
+	if hasTerminal && !r.profile.ConsoleSocket {
+		return errors.Errorf("%s doesn't support processes with a terminal", r.profile.Name)
+	}
+	return nil
+}
+
 // startProcess performs the operations necessary to start a container process
 // and properly handle its stdio.
-// This function is used by both CreateContainer and ExecProcess.
+// This function is used by CreateContainer, ExecProcess and RestoreContainer.
 func (r *runcRuntime) startProcess(id string, tempProcessDir string, hasTerminal bool, stdioOptions runtime.StdioOptions, initialArgs ...string) (pid int, err error) {
 	args := initialArgs
 
+	if err := r.checkTerminalSupported(hasTerminal); err != nil {
+		return -1, err
+	}
 	if err := containerdsys.SetSubreaper(1); err != nil {
 		return -1, errors.Wrapf(err, "failed to set process as subreaper for process in container %s", id)
 	}
 
-	logPath := r.getLogPath()
-	args = append([]string{"--log", logPath}, args...)
+	logPath, err := r.newInvocationLog(initialArgs[0])
+	if err != nil {
+		return -1, err
+	}
+	args = append(r.globalArgs(logPath), args...)
 
 	args = append(args, "--pid-file", filepath.Join(tempProcessDir, "pid"))
 
@@ -488,15 +584,18 @@ func (r *runcRuntime) startProcess(id string, tempProcessDir string, hasTerminal
 	}
 	args = append(args, id)
 
-	cmd := exec.Command(runcPath, args...)
+	cmd := exec.Command(r.profile.Path, args...)
 	cmd.Stdin = cmdStdin
 	cmd.Stdout = cmdStdout
 	cmd.Stderr = cmdStderr
 	if err := cmd.Start(); err != nil {
-		return -1, errors.Wrapf(err, "failed to start runc create/exec call for container %s", id)
+		r.finishInvocationLog(logPath)
+		return -1, errors.Wrapf(err, "failed to start %s create/exec/restore call for container %s", r.profile.Name, id)
 	}
-	if err := cmd.Wait(); err != nil {
-		return -1, errors.Wrapf(err, "failed to wait on runc create/exec call for container %s", id)
+	err = cmd.Wait()
+	logErrors := r.finishInvocationLog(logPath)
+	if err != nil {
+		return -1, errors.Wrapf(r.commandError(err, initialArgs[0], logErrors, nil), "failed to wait on %s create/exec/restore call for container %s", r.profile.Name, id)
 	}
 
 	// Rename the process's directory to its pid.
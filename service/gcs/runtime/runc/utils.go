@@ -1,14 +1,147 @@
 package runc
 
 import (
+	"bufio"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
+
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
 )
 
+// runCommand runs the runtime with the given command and arguments, and
+// returns its combined output. If the runtime fails, the errors it logged are
+// attached to the returned error.
+func (r *runcRuntime) runCommand(args ...string) ([]byte, error) {
+	logPath, err := r.newInvocationLog(args[0])
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(r.profile.Path, append(r.globalArgs(logPath), args...)...)
+	out, err := cmd.CombinedOutput()
+	logErrors := r.finishInvocationLog(logPath)
+	if err != nil {
+		return nil, r.commandError(err, args[0], logErrors, out)
+	}
+	return out, nil
+}
+
+// globalArgs returns the arguments passed to the runtime before the command on
+// every invocation, having it write its log to the given file.
+func (r *runcRuntime) globalArgs(logPath string) []string {
+	args := append([]string{}, r.profile.GlobalArgs...)
+	return append(args, r.logArgs(logPath)...)
+}
+
+// listContainerStatesFromFiles returns the states of the containers which
+// have a state directory, for runtimes which can't list their containers as
+// JSON. Containers the runtime fails to return the state of are considered not
+// to exist.
+func (r *runcRuntime) listContainerStatesFromFiles() ([]runtime.ContainerState, error) {
+	return listContainerStatesInDir(containerFilesDir, r.GetContainerState)
+}
+
+// listContainerStatesInDir returns the states, as returned by getState, of the
+// containers whose state directories are in the given directory. Containers
+// whose state can't be found are skipped.
+func listContainerStatesInDir(dir string, getState func(id string) (*runtime.ContainerState, error)) ([]runtime.ContainerState, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading the runC container files directory %s", dir)
+	}
+	var states []runtime.ContainerState
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		state, err := getState(entry.Name())
+		if err != nil {
+			continue
+		}
+		states = append(states, *state)
+	}
+	return states, nil
+}
+
+// getCgroupPids returns the pids in the cgroup of the given container's init
+// process, for runtimes which can't list the pids of a container as JSON.
+func (r *runcRuntime) getCgroupPids(id string) ([]int, error) {
+	initPid, err := r.GetInitPid(id)
+	if err != nil {
+		return nil, err
+	}
+	cgroupFile := filepath.Join("/proc", strconv.Itoa(initPid), "cgroup")
+	f, err := os.Open(cgroupFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open cgroup file %s", cgroupFile)
+	}
+	defer f.Close()
+	procsPath, err := cgroupProcsPath(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read cgroup file %s", cgroupFile)
+	}
+	if procsPath == "" {
+		return nil, errors.Errorf("failed to find the cgroup of container %s", id)
+	}
+	data, err := ioutil.ReadFile(procsPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the pids of container %s", id)
+	}
+	return parsePids(data)
+}
+
+// cgroupProcsPath returns the path of the cgroup.procs file listing the pids
+// in the cgroup described by the given /proc/<pid>/cgroup file, or an empty
+// string if the file names no cgroup whose pids can be listed. Each line of
+// the file has the form "hierarchy-ID:controller-list:cgroup-path". The v1
+// pids hierarchy is used if it is mounted, otherwise the unified hierarchy,
+// with ID 0 and no controllers listed.
+func cgroupProcsPath(cgroupFile io.Reader) (string, error) {
+	var pidsPath, unifiedPath string
+	scanner := bufio.NewScanner(cgroupFile)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			unifiedPath = filepath.Join("/sys/fs/cgroup", fields[2], "cgroup.procs")
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "pids" {
+				pidsPath = filepath.Join("/sys/fs/cgroup/pids", fields[2], "cgroup.procs")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if pidsPath != "" {
+		return pidsPath, nil
+	}
+	return unifiedPath, nil
+}
+
+// parsePids parses the whitespace-separated pids in the given cgroup.procs
+// file.
+func parsePids(data []byte) ([]int, error) {
+	var pids []int
+	for _, line := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse string \"%s\" as pid", line)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
 // readPidFile reads the integer pid stored in the given file.
 func (r *runcRuntime) readPidFile(pidFile string) (pid int, err error) {
 	data, err := ioutil.ReadFile(pidFile)
@@ -37,6 +170,43 @@ func (r *runcRuntime) cleanupContainer(id string) error {
 	return nil
 }
 
+// CleanupStaleContainerFiles removes the state directories of containers
+// which runC no longer knows about, and returns their IDs. The logs of
+// invocations of runC which were interrupted are moved to the shared log.
+func (r *runcRuntime) CleanupStaleContainerFiles() ([]string, error) {
+	entries, err := ioutil.ReadDir(containerFilesDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading the runC container files directory %s", containerFilesDir)
+	}
+	states, err := r.ListContainerStates()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for _, state := range states {
+		existing[state.ID] = true
+	}
+	var removed []string
+	for _, entry := range entries {
+		id := entry.Name()
+		if !entry.IsDir() {
+			// Keep the logs of invocations which were interrupted.
+			if strings.HasPrefix(entry.Name(), invocationLogPrefix) {
+				r.finishInvocationLog(filepath.Join(containerFilesDir, entry.Name()))
+			}
+			continue
+		}
+		if existing[id] {
+			continue
+		}
+		if err := r.cleanupContainer(id); err != nil {
+			return removed, err
+		}
+		removed = append(removed, id)
+	}
+	return removed, nil
+}
+
 // cleanupProcess cleans up any state left behind by the process.
 func (r *runcRuntime) cleanupProcess(id string, pid int) error {
 	processDir := r.getProcessDir(id, pid)
@@ -67,7 +237,8 @@ func (r *runcRuntime) makeContainerDir(id string) error {
 	return nil
 }
 
-// getLogPath returns the path to the log file used by the runC wrapper.
+// getLogPath returns the path to the shared log file, to which the logs of
+// every invocation of the runtime are appended.
 func (r *runcRuntime) getLogPath() string {
 	return filepath.Join(containerFilesDir, "log.log")
 }
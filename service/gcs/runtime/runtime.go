@@ -4,6 +4,7 @@ package runtime
 
 import (
 	"io"
+	"time"
 
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 
@@ -28,6 +29,25 @@ type ContainerProcessState struct {
 	Command          []string
 	CreatedByRuntime bool
 	IsZombie         bool
+
+	// The remaining fields are read from /proc by the GCS rather than
+	// reported by the Runtime, and are left unset for processes which have
+	// already exited.
+	ParentPid int
+	// UID is the real user ID of the process, and User its name in the
+	// container, or the user ID if it has none.
+	UID   int
+	User  string
+	State string
+	// StartTime is the time the process started at, according to the
+	// utility VM's clock.
+	StartTime time.Time
+	// CPUTime is the CPU time consumed by the process, in user and kernel
+	// mode.
+	CPUTime time.Duration
+	// MemoryRSS is the resident set size of the process, in bytes.
+	MemoryRSS   uint64
+	ThreadCount int
 }
 
 // StdioOptions specify how the runtime should handle stdio for the process.
@@ -45,6 +65,58 @@ type StdioPipes struct {
 	Err io.ReadCloser
 }
 
+// CheckpointOptions specify how the runtime should checkpoint a container.
+type CheckpointOptions struct {
+	// LeaveRunning keeps the container running after it has been
+	// checkpointed, rather than stopping it.
+	LeaveRunning bool
+	// TCPEstablished allows established TCP connections to be checkpointed.
+	TCPEstablished bool
+	// ExternalUnixSockets allows connections to unix sockets outside of the
+	// container to be checkpointed.
+	ExternalUnixSockets bool
+	// ShellJob allows a container whose processes are attached to a terminal
+	// to be checkpointed.
+	ShellJob bool
+	// FileLocks allows file locks held by the container to be checkpointed.
+	FileLocks bool
+}
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	// EventOOM is sent when a process in the container has been killed by the
+	// OOM killer.
+	EventOOM = EventType("oom")
+	// EventStats is sent periodically with a sample of the container's
+	// resource usage.
+	EventStats = EventType("stats")
+)
+
+// ContainerStats is a sample of the resource usage of a container, as read
+// from its cgroups.
+type ContainerStats struct {
+	// CPUUsage is the total CPU time consumed by the container, in
+	// nanoseconds.
+	CPUUsage uint64
+	// MemoryUsage, MemoryMaxUsage and MemoryLimit are the current, peak and
+	// maximum memory usage of the container, in bytes.
+	MemoryUsage    uint64
+	MemoryMaxUsage uint64
+	MemoryLimit    uint64
+	// Pids is the number of processes in the container.
+	Pids uint64
+}
+
+// Event is an event which occurred in a container, as reported by
+// Runtime.Events. Stats is only set for events of type EventStats.
+type Event struct {
+	Type  EventType
+	ID    string
+	Stats *ContainerStats
+}
+
 // Runtime is the interface defining commands over an OCI container runtime,
 // such as runC.
 type Runtime interface {
@@ -66,4 +138,25 @@ type Runtime interface {
 
 	GetInitPid(id string) (pid int, err error)
 	GetStdioPipes(id string, pid int) (*StdioPipes, error)
+
+	// CheckpointContainer saves the state of the container's processes as an
+	// image in the given directory, from which it can later be restored by
+	// RestoreContainer, possibly in another utility VM.
+	CheckpointContainer(id string, imagePath string, options CheckpointOptions) error
+	// RestoreContainer recreates the container with the given ID and
+	// bundlePath from the image in the given directory, in place of
+	// CreateContainer and StartContainer, and returns the pid of its init
+	// process.
+	RestoreContainer(id string, bundlePath string, imagePath string, stdioOptions StdioOptions) (pid int, err error)
+
+	// Events returns a channel over which the container's OOM events are
+	// sent, along with a sample of its resource usage every statsInterval if
+	// it is positive. The channel is closed once the container has been
+	// deleted, or if the events can no longer be read.
+	Events(id string, statsInterval time.Duration) (<-chan Event, error)
+
+	// CleanupStaleContainerFiles removes the files kept by the runtime for
+	// containers which no longer exist, such as those left behind by a
+	// previous instance of the GCS, and returns the IDs of those containers.
+	CleanupStaleContainerFiles() ([]string, error)
 }
@@ -12,6 +12,7 @@ import (
 func tar2vhd() error {
 	tar2vhdArgs := commoncli.SetFlagsForTar2VHDLib()
 	logArgs := commoncli.SetFlagsForLogging()
+	appendHashTree := flag.Bool("verity", false, "Append a dm-verity hash tree to the disk and write its root hash to stderr")
 	flag.Parse()
 
 	options, err := commoncli.SetupTar2VHDLibOptions(tar2vhdArgs...)
@@ -26,6 +27,10 @@ func tar2vhd() error {
 		return err
 	}
 
+	if *appendHashTree {
+		options.VerityInfo = os.Stderr
+	}
+
 	_, err = libtar2vhd.Tar2VHD(os.Stdin, os.Stdout, options)
 	if err != nil {
 		utils.LogMsgf("svmutilsMain failed with %s\n", err)
@@ -1,6 +1,7 @@
 package libtar2vhd
 
 import (
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/Microsoft/opengcs/service/gcsutils/fs"
 	"github.com/Microsoft/opengcs/service/gcsutils/tarlib"
+	"github.com/Microsoft/opengcs/service/gcsutils/verity"
 	"github.com/Microsoft/opengcs/service/gcsutils/vhd"
 	"github.com/Microsoft/opengcs/service/libs/commonutils"
 )
@@ -20,6 +22,10 @@ type Options struct {
 	Filesystem    fs.Filesystem
 	Converter     vhd.Converter
 	TempDirectory string
+	// VerityInfo, if set, causes a dm-verity hash tree to be appended to the
+	// disk, and the tree's description (a JSON-encoded prot.LayerVerity) to be
+	// written to it.
+	VerityInfo io.Writer
 }
 
 func Tar2VHD(in io.Reader, out io.Writer, options *Options) (int64, error) {
@@ -44,6 +50,17 @@ func Tar2VHD(in io.Reader, out io.Writer, options *Options) (int64, error) {
 		return 0, err
 	}
 
+	if options.VerityInfo != nil {
+		utils.LogMsg("append hash tree")
+		info, err := verity.AppendHashTree(vhdFile)
+		if err != nil {
+			return 0, err
+		}
+		if err := json.NewEncoder(options.VerityInfo).Encode(info); err != nil {
+			return 0, err
+		}
+	}
+
 	utils.LogMsg("convert to VHD")
 	if err := options.Converter.ConvertToVHD(vhdFile); err != nil {
 		return 0, err
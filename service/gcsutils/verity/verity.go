@@ -0,0 +1,128 @@
+// Package verity computes dm-verity hash trees, which allow the kernel to
+// verify each block of a read-only filesystem as it is read.
+package verity
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+)
+
+const (
+	// BlockSize is the size of both the data blocks and the hash blocks of
+	// the trees computed by this package.
+	BlockSize = 4096
+
+	// SaltSize is the size in bytes of the random salt used for each tree.
+	SaltSize = 32
+)
+
+// AppendHashTree pads the data in f to a whole number of blocks, computes its
+// hash tree using a random salt, and writes the tree to f after the data. It
+// returns the description of the tree which the GCS needs to verify the data.
+func AppendHashTree(f *os.File) (*prot.LayerVerity, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("cannot compute the hash tree of empty file %s", f.Name())
+	}
+	hashOffset := (info.Size() + BlockSize - 1) / BlockSize * BlockSize
+	if err := f.Truncate(hashOffset); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	data := bufio.NewReaderSize(io.NewSectionReader(f, 0, hashOffset), 256*BlockSize)
+	tree, rootDigest, err := HashTree(data, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteAt(tree, hashOffset); err != nil {
+		return nil, err
+	}
+	return &prot.LayerVerity{
+		RootDigest:        hex.EncodeToString(rootDigest),
+		Salt:              hex.EncodeToString(salt),
+		HashOffsetInBytes: uint64(hashOffset),
+	}, nil
+}
+
+// HashTree computes the dm-verity (format version 1) hash tree of the data
+// read from r using SHA-256 and the given salt. The data must be a whole
+// number of blocks. It returns the tree, laid out with its top level first as
+// the kernel expects, along with its root digest.
+func HashTree(r io.Reader, salt []byte) (tree []byte, rootDigest []byte, err error) {
+	// The hashes of the data blocks form the lowest level of the tree.
+	level, blocks, err := hashBlocks(r, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if blocks == 0 {
+		return nil, nil, fmt.Errorf("cannot compute the hash tree of empty data")
+	}
+	// The kernel uses the hash of a lone data block as the root digest,
+	// without any tree.
+	if blocks == 1 {
+		return nil, level[:sha256.Size], nil
+	}
+
+	// Each level hashes the blocks of the level below it, until a level fits
+	// in a single block.
+	levels := [][]byte{level}
+	for len(level) > BlockSize {
+		level, _, err = hashBlocks(bytes.NewReader(level), salt)
+		if err != nil {
+			return nil, nil, err
+		}
+		levels = append(levels, level)
+	}
+	for i := len(levels) - 1; i >= 0; i-- {
+		tree = append(tree, levels[i]...)
+	}
+	return tree, hashBlock(salt, level), nil
+}
+
+// hashBlocks hashes each block read from r, and returns the hashes packed
+// into hash blocks, padded with zeros to a whole number of blocks, along with
+// the number of blocks which were hashed.
+func hashBlocks(r io.Reader, salt []byte) (hashes []byte, blocks int, err error) {
+	block := make([]byte, BlockSize)
+	for {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == io.ErrUnexpectedEOF {
+				return nil, 0, fmt.Errorf("data is not a whole number of %d-byte blocks", BlockSize)
+			}
+			return nil, 0, err
+		}
+		hashes = append(hashes, hashBlock(salt, block)...)
+		blocks++
+	}
+	if partial := len(hashes) % BlockSize; partial != 0 {
+		hashes = append(hashes, make([]byte, BlockSize-partial)...)
+	}
+	return hashes, blocks, nil
+}
+
+// hashBlock returns the hash of the given block, with the salt prepended as in
+// format version 1.
+func hashBlock(salt, block []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(block)
+	return h.Sum(nil)
+}
@@ -0,0 +1,13 @@
+package verity
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestVerity(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Verity Suite")
+}
@@ -0,0 +1,140 @@
+package verity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testSalt is the salt of the known-answer trees below. They are the trees
+// "veritysetup format --format=1 --hash=sha256 --data-block-size=4096
+// --hash-block-size=4096 --salt=<testSalt>" computes for testData(blocks).
+const testSalt = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// testData returns the given number of blocks, each filled with the low byte
+// of its index.
+func testData(blocks int) []byte {
+	data := make([]byte, 0, blocks*BlockSize)
+	for i := 0; i < blocks; i++ {
+		data = append(data, bytes.Repeat([]byte{byte(i)}, BlockSize)...)
+	}
+	return data
+}
+
+var _ = Describe("Verity", func() {
+	var (
+		salt       []byte
+		tree       []byte
+		rootDigest []byte
+		err        error
+	)
+	BeforeEach(func() {
+		salt, err = hex.DecodeString(testSalt)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("calling HashTree", func() {
+		var blocks int
+		JustBeforeEach(func() {
+			tree, rootDigest, err = HashTree(bytes.NewReader(testData(blocks)), salt)
+		})
+		// treeDigest is the SHA-256 digest of the whole tree, so that trees of
+		// several blocks can be compared against a known answer.
+		treeDigest := func() string {
+			digest := sha256.Sum256(tree)
+			return hex.EncodeToString(digest[:])
+		}
+
+		Context("the data is a single block", func() {
+			BeforeEach(func() {
+				blocks = 1
+			})
+			It("should not produce an error", func() {
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("should use the hash of the block as the root digest", func() {
+				Expect(tree).To(BeEmpty())
+				Expect(hex.EncodeToString(rootDigest)).To(Equal("4ce3ecf32c133bf6321901b6092219474b6ac91a19d0304621d629e6bb9987dc"))
+			})
+		})
+		Context("the hashes of the data fill exactly one block", func() {
+			BeforeEach(func() {
+				blocks = 128
+			})
+			It("should not produce an error", func() {
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("should produce a single level tree", func() {
+				Expect(tree).To(HaveLen(BlockSize))
+				Expect(treeDigest()).To(Equal("f4ff0ca4a169f179c28611e629de6b41f3be046b237074c9ed47ed76adb02beb"))
+				Expect(hex.EncodeToString(rootDigest)).To(Equal("acb37719c99f3ac554ecbbccb8910616915a08e5a67bd3b9778694c60e673da4"))
+			})
+		})
+		Context("the hashes of the data spill over into a second block", func() {
+			BeforeEach(func() {
+				blocks = 129
+			})
+			It("should not produce an error", func() {
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("should produce a two level tree with the top level first", func() {
+				Expect(tree).To(HaveLen(3 * BlockSize))
+				Expect(treeDigest()).To(Equal("98464b513ea866c3fced081f070047d47e884c9e8a804062cb53dae84eebc35b"))
+				Expect(hex.EncodeToString(rootDigest)).To(Equal("6093a2333523050b628581510028976d3d3e9c62458642a83727e6df641397a4"))
+				Expect(hashBlock(salt, tree[:BlockSize])).To(Equal(rootDigest))
+			})
+		})
+		Context("the data is empty", func() {
+			BeforeEach(func() {
+				blocks = 0
+			})
+			It("should produce an error", func() {
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("calling AppendHashTree", func() {
+		var (
+			f    *os.File
+			data []byte
+		)
+		BeforeEach(func() {
+			// The data doesn't end on a block boundary, so it must be padded
+			// before the tree is appended.
+			data = append(testData(128), 0xff)
+			f, err = ioutil.TempFile("", "verity")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = f.Write(data)
+			Expect(err).NotTo(HaveOccurred())
+		})
+		AfterEach(func() {
+			f.Close()
+			os.Remove(f.Name())
+		})
+		It("should append the tree of the padded data after it", func() {
+			verity, err := AppendHashTree(f)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(verity.HashOffsetInBytes).To(Equal(uint64(129 * BlockSize)))
+
+			contents, err := ioutil.ReadFile(f.Name())
+			Expect(err).NotTo(HaveOccurred())
+			padded := contents[:verity.HashOffsetInBytes]
+			Expect(padded[:len(data)]).To(Equal(data))
+			Expect(padded[len(data):]).To(Equal(make([]byte, len(padded)-len(data))))
+
+			salt, err := hex.DecodeString(verity.Salt)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(salt).To(HaveLen(SaltSize))
+			tree, rootDigest, err := HashTree(bytes.NewReader(padded), salt)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents[verity.HashOffsetInBytes:]).To(Equal(tree))
+			Expect(verity.RootDigest).To(Equal(hex.EncodeToString(rootDigest)))
+		})
+	})
+})